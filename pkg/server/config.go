@@ -18,7 +18,7 @@ type ConfigServiceImpl struct {
 }
 
 func (c *ConfigServiceImpl) LoadConfig() (*Config, error) {
-	r := &Config{}
+	r := &Config{CoreConfig: c.Config}
 	return r, mapstructure.Decode(c.Config.Get("server"), &r.Server)
 }
 
@@ -35,6 +35,30 @@ type Server struct {
 	EnableCORS         bool
 	EnableGzip         bool
 	DefaultLang        string
+	EnableApiDocs      bool
+	EnableMetrics      bool
+	ProblemTypeBaseUri string
+	Routes             []*Route
+	Alerts             *Alerts
+	Redaction          *Redaction
+
+	Idempotency *Idempotency
+	Cache       *Cache
+	Jobs        *Jobs
+	Scheduler   *Scheduler
+	Streaming   *Streaming
+	PubSub      *PubSub
+	JsonRpc     *JsonRpc
+	Batch       *Batch
+
+	// Формат ответа по заголовку Accept либо параметру format (xml, msgpack, cbor, protobuf). По умолчанию только JSON
+	EnableContentNegotiation bool
+
+	// Каждое N-е сообщение gRPC-потока пишется в лог экшенов. 0 - сообщения потоков не логируются
+	GrpcStreamLogEvery int
+
+	// Каталог состояний саг, по умолчанию <рабочий каталог>/<профиль>/sagas
+	SagaStateDir string
 }
 
 type Multipart struct {
@@ -56,3 +80,178 @@ type Http struct {
 	Multipart *Multipart
 	Ssl       *Ssl
 }
+
+// Маршрут, объявленный в конфиге: server.routes
+type Route struct {
+	Path      string
+	Method    string
+	Actions   []string
+	Presenter string
+	Throttle  *Throttle
+
+	// Режим цепочки экшенов: replace (по умолчанию) либо passThrough
+	Mode string
+
+	// Экшен выполняется фоновой задачей, клиент сразу получает 202 и задачу (состояние - GET /api/jobs/{id}, видит только поставивший задачу пользователь)
+	Async bool
+
+	// Кэширование результата маршрута и теги кэша, сбрасываемые после его успешного выполнения
+	Cache                *RouteCache
+	InvalidatesCacheTags []string
+
+	// Экшен возвращает поток событий, который отдается как Server-Sent Events либо WebSocket. Только GET
+	Stream bool
+
+	// Интерсепторы раннера: Interceptors включает интерсепторы с OptIn, SkipInterceptors отключает любые
+	Interceptors     []string
+	SkipInterceptors []string
+}
+
+// TTL - в формате time.ParseDuration. Scope: account (по умолчанию) либо shared
+type RouteCache struct {
+	TTL    string
+	Params []string
+	Scope  string
+	Tags   []string
+}
+
+type Throttle struct {
+	Eps   float64
+	Burst int
+}
+
+// Агрегация алертов: server.alerts. Длительности - в формате time.ParseDuration ("5m")
+type Alerts struct {
+	Window         string
+	MaxPerWindow   int
+	DigestSchedule string
+	Policies       []*AlertPolicy
+}
+
+// Политика алертов экшена по его имени. MaxPerWindow: 0 - как по умолчанию, -1 - без ограничения
+type AlertPolicy struct {
+	Action       string
+	Disabled     bool
+	Window       string
+	MaxPerWindow int
+	Level        int
+	NoDigest     bool
+}
+
+// Ключи идемпотентности (заголовок Idempotency-Key): server.idempotency.
+// Длительности - в формате time.ParseDuration. TTL по умолчанию 24h, WaitTimeout по умолчанию 0 - сразу конфликт.
+// MaxEntries (ключей в памяти, давно не использованные вытесняются) по умолчанию 10000
+type Idempotency struct {
+	Disabled    bool
+	TTL         string
+	WaitTimeout string
+	MaxEntries  int
+}
+
+// Кэш результатов экшенов: server.cache. MaxEntries по умолчанию 10000
+type Cache struct {
+	Disabled   bool
+	MaxEntries int
+}
+
+// Фоновые задачи: server.jobs. Очередь и /api/jobs/:id включаются секцией в конфиге. Длительности - в формате time.ParseDuration.
+// Dir по умолчанию <рабочий каталог>/<профиль>/jobs
+type Jobs struct {
+	Disabled    bool
+	Workers     int
+	MaxAttempts int
+	Backoff     string
+	MaxBackoff  string
+	Retention   string
+	Dir         string
+}
+
+// Экшены по расписанию: server.scheduler. Timezone - часовой пояс по умолчанию (IANA, например Europe/Moscow).
+// Если задан LockFile, задачи выполняет только один экземпляр приложения, захвативший файл
+type Scheduler struct {
+	Disabled bool
+	Timezone string
+	LockFile string
+	Tasks    []*ScheduledTask
+}
+
+// Задача по расписанию. Actions - имена экшенов из реестра, выполняемые цепочкой.
+// Params - параметры вызова в виде "имя=значение". Overlap: skip (по умолчанию), allow, queue
+type ScheduledTask struct {
+	Name     string
+	Schedule string
+	Timezone string
+	Actions  []string
+	Params   []string
+	Jitter   string
+	Overlap  string
+	Paused   bool
+}
+
+// Потоковые маршруты (SSE и WebSocket): server.streaming. Длительности - в формате time.ParseDuration.
+// Heartbeat по умолчанию 15s, Retry (задержка переподключения EventSource) - 3s, WriteTimeout (кадр WebSocket) - 10s.
+// AllowedOrigins - Origin, с которых браузер может открыть WebSocket (в том числе server.pubSub), "*" - любой.
+// Если не заданы - только с хоста самого сервера
+type Streaming struct {
+	Heartbeat      string
+	Retry          string
+	WriteTimeout   string
+	AllowedOrigins []string
+}
+
+// Подписки WebSocket-клиентов на топики EventBus: server.pubSub. Path по умолчанию /api/pubsub,
+// BufferSize (кадров на соединение) - 64, MaxWildcardTopics (разных топиков по правилам с *) - 1000.
+// Heartbeat и WriteTimeout - как в server.streaming
+type PubSub struct {
+	Disabled          bool
+	Path              string
+	BufferSize        int
+	MaxWildcardTopics int
+	Heartbeat         string
+	WriteTimeout      string
+	Topics            []*PubSubTopic
+}
+
+// JSON-RPC 2.0 поверх экшенов: server.jsonRpc. Эндпоинт включается секцией в конфиге.
+// Path по умолчанию /rpc, MaxBatch (запросов в пакете) - 100. Размер тела ограничен server.http.multipart.maxRequestSizeBytes
+type JsonRpc struct {
+	Disabled bool
+	Path     string
+	MaxBatch int
+	Methods  []*JsonRpcMethod
+}
+
+// Метод JSON-RPC: цепочка экшенов из реестра, как у маршрутов server.routes
+type JsonRpcMethod struct {
+	Name    string
+	Actions []string
+}
+
+// Пакетные запросы: server.batch. Эндпоинт включается секцией в конфиге.
+// Path по умолчанию /api/batch, MaxItems (подзапросов в пакете) - 20,
+// MaxParallel (одновременно выполняемых подзапросов в режиме parallel) - 4
+type Batch struct {
+	Disabled    bool
+	Path        string
+	MaxItems    int
+	MaxParallel int
+}
+
+// Доступ к топику. Name - топик либо префикс с * на конце. Roles пустой - любому авторизованному.
+// Personal - клиент получает только адресованные ему сообщения
+type PubSubTopic struct {
+	Name     string
+	Roles    []string
+	Personal bool
+}
+
+// Скрытие секретов в логе экшенов: server.redaction
+type Redaction struct {
+	// Дополнительные поля (имена либо пути через точку) к полям по умолчанию
+	Fields []string
+
+	// Регулярные выражения, совпадения с которыми скрываются
+	Patterns []string
+	Mask     string
+	Disabled bool
+}
@@ -1,15 +1,19 @@
 package di
 
 import (
+	"github.com/asaskevich/EventBus"
 	"github.com/itskovichanton/core/pkg/core"
 	"github.com/itskovichanton/core/pkg/core/di"
 	"github.com/itskovichanton/core/pkg/core/logger"
 	"github.com/itskovichanton/echo-http"
 	"github.com/itskovichanton/server/pkg/server"
 	"github.com/itskovichanton/server/pkg/server/filestorage"
+	"github.com/itskovichanton/server/pkg/server/i18n"
 	"github.com/itskovichanton/server/pkg/server/pipeline"
 	"github.com/itskovichanton/server/pkg/server/users"
 	"go.uber.org/dig"
+	"regexp"
+	"time"
 )
 
 type DI struct {
@@ -36,6 +40,7 @@ func (c *DI) buildContainer(container *dig.Container) *dig.Container {
 	container.Provide(c.NewAuthService)
 	container.Provide(c.NewGetUserAction)
 	container.Provide(c.NewValidateActiveUserAction)
+	container.Provide(c.NewValidateAdminAction)
 	container.Provide(c.NewValidateCallerAction)
 	container.Provide(c.NewGetSessionAction)
 	container.Provide(c.NewServerSettingsProviderService)
@@ -46,6 +51,23 @@ func (c *DI) buildContainer(container *dig.Container) *dig.Container {
 	container.Provide(c.NewDefaultFilePresenter)
 	container.Provide(c.NewResponsePresenter)
 	container.Provide(c.NewServerConfigService)
+	container.Provide(c.NewActionRegistry)
+	container.Provide(c.NewPresenterRegistry)
+	container.Provide(c.NewOpenApiService)
+	container.Provide(c.NewProblemPresenter)
+	container.Provide(c.NewMessageCatalogService)
+	container.Provide(c.NewReasonRegistry)
+	container.Provide(c.NewAlertAggregatorService)
+	container.Provide(c.NewRedactorService)
+	container.Provide(c.NewMetricsService)
+	container.Provide(c.NewSagaStateStore)
+	container.Provide(c.NewIdempotencyStore)
+	container.Provide(c.NewResponseCacheService)
+	container.Provide(c.NewJobStore)
+	container.Provide(c.NewJobQueueService)
+	container.Provide(c.NewSchedulerService)
+	container.Provide(c.NewEventBus)
+	container.Provide(c.NewPubSubService)
 
 	return container
 }
@@ -54,11 +76,17 @@ func (c *DI) NewServerConfigService(config *core.Config) (*server.Config, error)
 	return (&server.ConfigServiceImpl{Config: config}).LoadConfig()
 }
 
-func (c *DI) NewResponsePresenter() pipeline.IResponsePresenter {
-	return &pipeline.JSONResponsePresenterImpl{
-		ResponsePresenterImpl: pipeline.ResponsePresenterImpl{
-			ResponseModelProvider: &pipeline.ResponseModelProviderImpl{},
-		},
+func (c *DI) NewResponsePresenter(config *server.Config, reasonRegistry pipeline.IReasonRegistryService) pipeline.IResponsePresenter {
+	presenter := pipeline.ResponsePresenterImpl{
+		ResponseModelProvider: &pipeline.ResponseModelProviderImpl{},
+		ReasonRegistry:        reasonRegistry,
+	}
+	if config.Server == nil || !config.Server.EnableContentNegotiation {
+		return &pipeline.JSONResponsePresenterImpl{ResponsePresenterImpl: presenter}
+	}
+	return &pipeline.NegotiatingResponsePresenterImpl{
+		ResponsePresenterImpl: presenter,
+		Encoders:              pipeline.DefaultResponseEncoders(),
 	}
 }
 
@@ -68,30 +96,266 @@ func (c *DI) NewDefaultFilePresenter(jsonPresenter *pipeline.JSONResponsePresent
 	}
 }
 
-func (c *DI) NewJsonPresenter() *pipeline.JSONResponsePresenterImpl {
+func (c *DI) NewJsonPresenter(reasonRegistry pipeline.IReasonRegistryService) *pipeline.JSONResponsePresenterImpl {
 	return &pipeline.JSONResponsePresenterImpl{
 		ResponsePresenterImpl: pipeline.ResponsePresenterImpl{
 			ResponseModelProvider: &pipeline.ResponseModelProviderImpl{},
+			ReasonRegistry:        reasonRegistry,
 		},
 	}
 }
 
-func (c *DI) NewErrorProviderService(config *core.Config) *pipeline.ErrorProviderServiceImpl {
+func (c *DI) NewErrorProviderService(config *core.Config, messageCatalog i18n.IMessageCatalogService, reasonRegistry pipeline.IReasonRegistryService) *pipeline.ErrorProviderServiceImpl {
 	return &pipeline.ErrorProviderServiceImpl{
-		Config: config,
+		Config:         config,
+		MessageCatalog: messageCatalog,
+		ReasonRegistry: reasonRegistry,
 	}
 }
 
-func (c *DI) NewDefaultErrorProviderService(config *core.Config) pipeline.IErrorProviderService {
-	return c.NewErrorProviderService(config)
+func (c *DI) NewDefaultErrorProviderService(config *core.Config, messageCatalog i18n.IMessageCatalogService, reasonRegistry pipeline.IReasonRegistryService) pipeline.IErrorProviderService {
+	return c.NewErrorProviderService(config, messageCatalog, reasonRegistry)
+}
+
+func (c *DI) NewMessageCatalogService(config *core.Config, serverConfig *server.Config, reasonRegistry pipeline.IReasonRegistryService) (i18n.IMessageCatalogService, error) {
+	defaultLang := ""
+	if serverConfig.Server != nil {
+		defaultLang = serverConfig.Server.DefaultLang
+	}
+	r := &i18n.MessageCatalogServiceImpl{
+		Config:      config,
+		DefaultLang: defaultLang,
+		SourceLang:  "ru",
+	}
+	pipeline.AddReasonMessages(reasonRegistry, r)
+	return r, r.Load()
 }
 
-func (c *DI) NewActionRunner(loggerService logger.ILoggerService, errorHandler core.IErrorHandler, errorProviderService pipeline.IErrorProviderService) pipeline.IActionRunner {
-	return &pipeline.ActionRunnerImpl{
+func (c *DI) NewActionRunner(config *server.Config, loggerService logger.ILoggerService, errorHandler core.IErrorHandler, errorProviderService pipeline.IErrorProviderService, reasonRegistry pipeline.IReasonRegistryService, alertAggregator pipeline.IAlertAggregatorService, redactor pipeline.IRedactorService, metricsService pipeline.IMetricsService, idempotencyStore pipeline.IIdempotencyStore, responseCache pipeline.IResponseCacheService, jobQueue pipeline.IJobQueueService) (pipeline.IActionRunner, error) {
+	r := &pipeline.ActionRunnerImpl{
 		LoggerService:               loggerService,
 		ErrorHandler:                errorHandler,
 		DefaultErrorProviderService: errorProviderService,
+		ReasonRegistry:              reasonRegistry,
+		AlertAggregator:             alertAggregator,
+		Redactor:                    redactor,
+		MetricsService:              metricsService,
+		JobQueue:                    jobQueue,
+	}
+	idempotency, err := c.newIdempotencyService(config, idempotencyStore, reasonRegistry)
+	if err != nil {
+		return nil, err
+	}
+	if idempotency != nil {
+		r.Use(idempotency.GetInterceptor())
+	}
+	if config.Server == nil || config.Server.Cache == nil || !config.Server.Cache.Disabled {
+		r.Use(responseCache.GetInterceptor())
+	}
+	return r, nil
+}
+
+func (c *DI) NewJobStore(config *server.Config) pipeline.IJobStore {
+	if config.Server != nil && config.Server.Jobs != nil && len(config.Server.Jobs.Dir) > 0 {
+		return &pipeline.FileJobStoreImpl{Dir: config.Server.Jobs.Dir}
+	}
+	return &pipeline.FileJobStoreImpl{Dir: config.CoreConfig.GetDir("jobs")}
+}
+
+// Если фоновые задачи не настроены либо отключены - nil
+func (c *DI) NewJobQueueService(config *server.Config, store pipeline.IJobStore, actionRegistry pipeline.IActionRegistry, errorHandler core.IErrorHandler, reasonRegistry pipeline.IReasonRegistryService, redactor pipeline.IRedactorService) (pipeline.IJobQueueService, error) {
+	if config.Server == nil || config.Server.Jobs == nil || config.Server.Jobs.Disabled {
+		return nil, nil
+	}
+	jobs := config.Server.Jobs
+	r := &pipeline.JobQueueServiceImpl{
+		Store:          store,
+		ActionRegistry: actionRegistry,
+		ErrorHandler:   errorHandler,
+		ReasonRegistry: reasonRegistry,
+		Redactor:       redactor,
+		Workers:        jobs.Workers,
+		MaxAttempts:    jobs.MaxAttempts,
+	}
+	var err error
+	for _, d := range []struct {
+		value  string
+		target *time.Duration
+	}{{jobs.Backoff, &r.Backoff}, {jobs.MaxBackoff, &r.MaxBackoff}, {jobs.Retention, &r.Retention}} {
+		if len(d.value) > 0 {
+			if *d.target, err = time.ParseDuration(d.value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+func (c *DI) NewEventBus() EventBus.Bus {
+	return EventBus.New()
+}
+
+// Если подписки не настроены либо отключены - nil
+func (c *DI) NewPubSubService(config *server.Config, eventBus EventBus.Bus, sessionStorageService users.ISessionStorageService, errorProviderService pipeline.IErrorProviderService, metricsService pipeline.IMetricsService) (pipeline.IPubSubService, error) {
+	if config.Server == nil || config.Server.PubSub == nil || config.Server.PubSub.Disabled {
+		return nil, nil
+	}
+	cfg := config.Server.PubSub
+	r := &pipeline.PubSubServiceImpl{
+		EventBus:             eventBus,
+		SessionStorage:       sessionStorageService,
+		ErrorProviderService: errorProviderService,
+		MetricsService:       metricsService,
+		BufferSize:           cfg.BufferSize,
+		MaxWildcardTopics:    cfg.MaxWildcardTopics,
+	}
+	if config.Server.Streaming != nil {
+		r.AllowedOrigins = config.Server.Streaming.AllowedOrigins
+	}
+	for _, topic := range cfg.Topics {
+		r.Rules = append(r.Rules, &pipeline.TopicRule{Name: topic.Name, Roles: topic.Roles, Personal: topic.Personal})
+	}
+	var err error
+	for _, d := range []struct {
+		value  string
+		target *time.Duration
+	}{{cfg.Heartbeat, &r.Heartbeat}, {cfg.WriteTimeout, &r.WriteTimeout}} {
+		if len(d.value) > 0 {
+			if *d.target, err = time.ParseDuration(d.value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return r, nil
+}
+
+// Если планировщик отключен либо не настроен - nil
+func (c *DI) NewSchedulerService(config *server.Config, actionRegistry pipeline.IActionRegistry, metricsService pipeline.IMetricsService) (pipeline.ISchedulerService, error) {
+	if config.Server == nil || config.Server.Scheduler == nil || config.Server.Scheduler.Disabled {
+		return nil, nil
+	}
+	cfg := config.Server.Scheduler
+	r := &pipeline.SchedulerServiceImpl{
+		LockFile:       cfg.LockFile,
+		MetricsService: metricsService,
+	}
+	if len(cfg.Timezone) > 0 {
+		location, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		r.Location = location
+	}
+	for _, t := range cfg.Tasks {
+		task, err := pipeline.NewScheduledTask(t, actionRegistry)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.Schedule(task); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (c *DI) NewResponseCacheService(config *server.Config) pipeline.IResponseCacheService {
+	r := &pipeline.ResponseCacheServiceImpl{MaxEntries: 10000}
+	if config.Server != nil && config.Server.Cache != nil && config.Server.Cache.MaxEntries != 0 {
+		r.MaxEntries = config.Server.Cache.MaxEntries
 	}
+	return r
+}
+
+func (c *DI) NewIdempotencyStore(config *server.Config) pipeline.IIdempotencyStore {
+	r := &pipeline.MemoryIdempotencyStoreImpl{MaxEntries: 10000}
+	if config.Server != nil && config.Server.Idempotency != nil && config.Server.Idempotency.MaxEntries != 0 {
+		r.MaxEntries = config.Server.Idempotency.MaxEntries
+	}
+	return r
+}
+
+func (c *DI) newIdempotencyService(config *server.Config, store pipeline.IIdempotencyStore, reasonRegistry pipeline.IReasonRegistryService) (*pipeline.IdempotencyServiceImpl, error) {
+	r := &pipeline.IdempotencyServiceImpl{
+		Store:          store,
+		ReasonRegistry: reasonRegistry,
+		TTL:            24 * time.Hour,
+	}
+	if config.Server == nil || config.Server.Idempotency == nil {
+		return r, nil
+	}
+	idempotency := config.Server.Idempotency
+	if idempotency.Disabled {
+		return nil, nil
+	}
+	var err error
+	if len(idempotency.TTL) > 0 {
+		if r.TTL, err = time.ParseDuration(idempotency.TTL); err != nil {
+			return nil, err
+		}
+	}
+	if len(idempotency.WaitTimeout) > 0 {
+		if r.WaitTimeout, err = time.ParseDuration(idempotency.WaitTimeout); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (c *DI) NewMetricsService() pipeline.IMetricsService {
+	return &pipeline.MetricsServiceImpl{}
+}
+
+func (c *DI) NewSagaStateStore(config *server.Config) pipeline.ISagaStateStore {
+	if config.Server != nil && len(config.Server.SagaStateDir) > 0 {
+		return &pipeline.FileSagaStateStoreImpl{Dir: config.Server.SagaStateDir}
+	}
+	return &pipeline.FileSagaStateStoreImpl{Dir: config.CoreConfig.GetDir("sagas")}
+}
+
+func (c *DI) NewRedactorService(config *server.Config) (pipeline.IRedactorService, error) {
+	r := pipeline.NewDefaultRedactor()
+	if config.Server == nil || config.Server.Redaction == nil {
+		return r, nil
+	}
+	redaction := config.Server.Redaction
+	r.Disabled = redaction.Disabled
+	r.Fields = append(r.Fields, redaction.Fields...)
+	if len(redaction.Mask) > 0 {
+		r.Mask = redaction.Mask
+	}
+	for _, p := range redaction.Patterns {
+		expr, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		r.Patterns = append(r.Patterns, expr)
+	}
+	return r, nil
+}
+
+func (c *DI) NewAlertAggregatorService(errorHandler core.IErrorHandler, config *server.Config) (pipeline.IAlertAggregatorService, error) {
+	r := &pipeline.AlertAggregatorServiceImpl{
+		ErrorHandler: errorHandler,
+		Config:       config.CoreConfig,
+		Policies:     map[string]*pipeline.AlertPolicy{},
+	}
+	if config.Server != nil && config.Server.Alerts != nil {
+		alerts := config.Server.Alerts
+		r.DigestSchedule = alerts.DigestSchedule
+		defaultPolicy, err := pipeline.AlertPolicyFromConfig(&server.AlertPolicy{Window: alerts.Window, MaxPerWindow: alerts.MaxPerWindow}, nil)
+		if err != nil {
+			return nil, err
+		}
+		r.DefaultPolicy = defaultPolicy
+		for _, p := range alerts.Policies {
+			policy, err := pipeline.AlertPolicyFromConfig(p, defaultPolicy)
+			if err != nil {
+				return nil, err
+			}
+			r.Policies[p.Action] = policy
+		}
+	}
+	return r, nil
 }
 
 func (c *DI) NewEntityFromHTTPReaderService(config *server.Config) pipeline.IEntityFromHTTPReaderService {
@@ -180,12 +444,69 @@ func (c *DI) NewGetSessionAction() *pipeline.GetSessionAction {
 	return &pipeline.GetSessionAction{}
 }
 
-func (c *DI) NewHttpController(config *server.Config, getSessionAction *pipeline.GetSessionAction, responsePresenter pipeline.IResponsePresenter, filePresenter *pipeline.FileResponsePresenterImpl, getFileAction *pipeline.GetFileAction, registerAccountAction *pipeline.RegisterAccountAction, validateCallerAction *pipeline.ValidateCallerAction, getUserAction *pipeline.GetUserAction, actionRunner pipeline.IActionRunner, entityFromHTTPReaderService pipeline.IEntityFromHTTPReaderService) *pipeline.HttpControllerImpl {
+func (c *DI) NewValidateAdminAction() *pipeline.ValidateAdminAction {
+	return &pipeline.ValidateAdminAction{}
+}
+
+func (c *DI) NewActionRegistry(getSessionAction *pipeline.GetSessionAction, getFileAction *pipeline.GetFileAction, registerAccountAction *pipeline.RegisterAccountAction, validateCallerAction *pipeline.ValidateCallerAction, validateActiveUserAction *pipeline.ValidateActiveUserAction, validateAdminAction *pipeline.ValidateAdminAction, getUserAction *pipeline.GetUserAction) pipeline.IActionRegistry {
+	r := &pipeline.ActionRegistryImpl{}
+	r.Register("Nop", &pipeline.NopActionImpl{})
+	r.Register("ValidateCaller", validateCallerAction)
+	r.Register("GetUser", getUserAction)
+	r.Register("ValidateActiveUser", validateActiveUserAction)
+	r.Register("ValidateAdmin", validateAdminAction)
+	r.Register("GetSession", getSessionAction)
+	r.Register("RegisterAccount", registerAccountAction)
+	r.Register("GetFile", getFileAction)
+	return r
+}
+
+func (c *DI) NewPresenterRegistry(responsePresenter pipeline.IResponsePresenter, jsonPresenter *pipeline.JSONResponsePresenterImpl, filePresenter *pipeline.FileResponsePresenterImpl, problemPresenter *pipeline.ProblemResponsePresenterImpl) pipeline.IPresenterRegistry {
+	r := &pipeline.PresenterRegistryImpl{}
+	r.Register("default", responsePresenter)
+	r.Register("json", jsonPresenter)
+	r.Register("file", filePresenter)
+	r.Register("problem", problemPresenter)
+	return r
+}
+
+func (c *DI) NewProblemPresenter(config *server.Config, reasonRegistry pipeline.IReasonRegistryService) *pipeline.ProblemResponsePresenterImpl {
+	typeBaseUri := ""
+	if config.Server != nil {
+		typeBaseUri = config.Server.ProblemTypeBaseUri
+	}
+	return &pipeline.ProblemResponsePresenterImpl{
+		JSONResponsePresenterImpl: pipeline.JSONResponsePresenterImpl{
+			ResponsePresenterImpl: pipeline.ResponsePresenterImpl{
+				ResponseModelProvider: &pipeline.ProblemResponseModelProviderImpl{
+					TypeBaseUri:    typeBaseUri,
+					ReasonRegistry: reasonRegistry,
+				},
+				ReasonRegistry: reasonRegistry,
+			},
+		},
+	}
+}
+
+func (c *DI) NewOpenApiService(config *core.Config, reasonRegistry pipeline.IReasonRegistryService) pipeline.IOpenApiService {
+	return &pipeline.OpenApiServiceImpl{
+		Title:     config.App.Name,
+		Version:   config.App.Version,
+		Presenter: &pipeline.ResponsePresenterImpl{ReasonRegistry: reasonRegistry},
+	}
+}
+
+func (c *DI) NewReasonRegistry() pipeline.IReasonRegistryService {
+	return pipeline.NewReasonRegistry()
+}
+
+func (c *DI) NewHttpController(config *server.Config, getSessionAction *pipeline.GetSessionAction, responsePresenter pipeline.IResponsePresenter, filePresenter *pipeline.FileResponsePresenterImpl, getFileAction *pipeline.GetFileAction, registerAccountAction *pipeline.RegisterAccountAction, validateCallerAction *pipeline.ValidateCallerAction, getUserAction *pipeline.GetUserAction, validateAdminAction *pipeline.ValidateAdminAction, actionRunner pipeline.IActionRunner, entityFromHTTPReaderService pipeline.IEntityFromHTTPReaderService, actionRegistry pipeline.IActionRegistry, presenterRegistry pipeline.IPresenterRegistry, openApiService pipeline.IOpenApiService, reasonRegistry pipeline.IReasonRegistryService, metricsService pipeline.IMetricsService, jobQueue pipeline.IJobQueueService, scheduler pipeline.ISchedulerService, alertAggregator pipeline.IAlertAggregatorService, errorProviderService pipeline.IErrorProviderService, pubSub pipeline.IPubSubService, redactor pipeline.IRedactorService) *pipeline.HttpControllerImpl {
 	return &pipeline.HttpControllerImpl{
 		NopAction:                   &pipeline.NopActionImpl{},
 		GetSessionAction:            getSessionAction,
 		GetUserAction:               getUserAction,
 		ValidateCallerAction:        validateCallerAction,
+		ValidateAdminAction:         validateAdminAction,
 		RegisterAccountAction:       registerAccountAction,
 		GetFileAction:               getFileAction,
 		Config:                      config,
@@ -193,11 +514,26 @@ func (c *DI) NewHttpController(config *server.Config, getSessionAction *pipeline
 		EntityFromHTTPReaderService: entityFromHTTPReaderService,
 		DefaultResponsePresenter:    responsePresenter,
 		FileResponsePresenter:       filePresenter,
+		ActionRegistry:              actionRegistry,
+		PresenterRegistry:           presenterRegistry,
+		ReasonRegistry:              reasonRegistry,
+		MetricsService:              metricsService,
+		JobQueue:                    jobQueue,
+		Scheduler:                   scheduler,
+		AlertAggregator:             alertAggregator,
+		ErrorProviderService:        errorProviderService,
+		PubSub:                      pubSub,
+		Redactor:                    redactor,
+		OpenApiService:              openApiService,
 		EchoEngine:                  echo.New(),
 	}
 }
 
-func (c *DI) NewGrpcController(registerAccountAction *pipeline.RegisterAccountAction, validateCallerAction *pipeline.ValidateCallerAction, getUserAction *pipeline.GetUserAction, config *server.Config, actionRunner pipeline.IActionRunner, entityFromGRPCReaderService pipeline.IEntityFromGRPCReaderService) *pipeline.GrpcControllerImpl {
+func (c *DI) NewGrpcController(registerAccountAction *pipeline.RegisterAccountAction, validateCallerAction *pipeline.ValidateCallerAction, getUserAction *pipeline.GetUserAction, config *server.Config, actionRunner pipeline.IActionRunner, entityFromGRPCReaderService pipeline.IEntityFromGRPCReaderService, reasonRegistry pipeline.IReasonRegistryService, jobQueue pipeline.IJobQueueService, scheduler pipeline.ISchedulerService, alertAggregator pipeline.IAlertAggregatorService, loggerService logger.ILoggerService, redactor pipeline.IRedactorService) *pipeline.GrpcControllerImpl {
+	streamLogEvery := 0
+	if config.Server != nil {
+		streamLogEvery = config.Server.GrpcStreamLogEvery
+	}
 	return &pipeline.GrpcControllerImpl{
 		GetUserAction:               getUserAction,
 		ValidateCallerAction:        validateCallerAction,
@@ -205,5 +541,12 @@ func (c *DI) NewGrpcController(registerAccountAction *pipeline.RegisterAccountAc
 		Config:                      config,
 		ActionRunner:                actionRunner,
 		EntityFromGRPCReaderService: entityFromGRPCReaderService,
+		ReasonRegistry:              reasonRegistry,
+		JobQueue:                    jobQueue,
+		Scheduler:                   scheduler,
+		AlertAggregator:             alertAggregator,
+		LoggerService:               loggerService,
+		Redactor:                    redactor,
+		StreamLogEvery:              streamLogEvery,
 	}
 }
@@ -0,0 +1,64 @@
+package entities
+
+import (
+	"sort"
+	"sync"
+)
+
+// Данные одного запроса, которыми обмениваются шаги цепочки экшенов
+type Bag struct {
+	lock   sync.RWMutex
+	values map[string]interface{}
+}
+
+func NewBag() *Bag {
+	return &Bag{values: map[string]interface{}{}}
+}
+
+// Аргумент, несущий Bag
+type IBagHolder interface {
+	GetBag() *Bag
+}
+
+func (c *Bag) Get(key string) (interface{}, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	v, ok := c.values[key]
+	return v, ok
+}
+
+func (c *Bag) Set(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.values == nil {
+		c.values = map[string]interface{}{}
+	}
+	c.values[key] = value
+}
+
+// Атомарно изменяет значение по ключу
+func (c *Bag) Update(key string, f func(value interface{}) interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.values == nil {
+		c.values = map[string]interface{}{}
+	}
+	c.values[key] = f(c.values[key])
+}
+
+func (c *Bag) Delete(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.values, key)
+}
+
+func (c *Bag) Keys() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	var r []string
+	for k := range c.values {
+		r = append(r, k)
+	}
+	sort.Strings(r)
+	return r
+}
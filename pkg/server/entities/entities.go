@@ -3,6 +3,8 @@ package entities
 import (
 	"github.com/itskovichanton/core/pkg/core/validation"
 	"github.com/spf13/cast"
+	"net/http"
+	"strings"
 )
 
 type Caller struct {
@@ -48,9 +50,30 @@ type Account struct {
 type CallParams struct {
 	Request    interface{} `json:"-"`
 	Parameters map[string][]interface{}
+	Headers    map[string][]string `json:"-"`
 	URL        string
 	Caller     *Caller
 	Raw        string
+
+	// Тело запроса (json, xml, msgpack, protobuf) - исходное и декодированное. Поля тела также разложены в Parameters
+	Body        []byte      `json:"-"`
+	DecodedBody interface{} `json:"-"`
+
+	// Данные запроса для шагов цепочки. Создается при чтении запроса
+	Bag *Bag `json:"-"`
+}
+
+// Возвращает заголовок http-запроса (или grpc-метаданные) без учета регистра
+func (c *CallParams) GetHeader(name string) string {
+	if c.Headers == nil {
+		return ""
+	}
+	for _, key := range []string{name, http.CanonicalHeaderKey(name), strings.ToLower(name)} {
+		if v := c.Headers[key]; len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
 }
 
 func (c *CallParams) GetParamFloat32(key string, failValue float32) float32 {
@@ -124,3 +147,11 @@ func (c *CallParams) GetParamsUsingFirstValue() map[string]interface{} {
 	}
 	return r
 }
+
+// Создает Bag при первом обращении, если он не был создан при чтении запроса
+func (c *CallParams) GetBag() *Bag {
+	if c.Bag == nil {
+		c.Bag = NewBag()
+	}
+	return c.Bag
+}
@@ -0,0 +1,286 @@
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/spf13/cast"
+	"gopkg.in/yaml.v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Каталог сообщений по языкам. Сообщение - строка с параметрами {name} либо набор форм множественного числа
+// (zero, one, few, many, other), форма выбирается по параметру count
+type IMessageCatalogService interface {
+
+	// Ищет сообщение по цепочке языков GetFallbackChain(lang). Если цепочка дошла до исходного языка (SourceLang),
+	// а перевода нет - возвращает false, т.е. исходный текст сообщения нужно оставить
+	Translate(lang string, key string, params map[string]interface{}) (string, bool)
+	AddBundle(lang string, messages map[string]interface{})
+	GetFallbackChain(lang string) []string
+	Load() error
+}
+
+type MessageCatalogServiceImpl struct {
+	IMessageCatalogService
+
+	Config *core.Config
+
+	// Язык по умолчанию - последнее звено цепочки
+	DefaultLang string
+
+	// Язык, на котором написаны исходные сообщения ошибок
+	SourceLang string
+
+	lock    sync.RWMutex
+	bundles map[string]map[string]interface{}
+}
+
+// Загружает встроенные сообщения и файлы settings/i18n/<lang>.yml|yaml|json
+func (c *MessageCatalogServiceImpl) Load() error {
+
+	for lang, messages := range defaultBundles {
+		c.AddBundle(lang, messages)
+	}
+
+	if c.Config == nil {
+		return nil
+	}
+
+	dir := filepath.Join(c.Config.GetSettingsDir(), "i18n")
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(f.Name()))
+		lang := strings.TrimSuffix(f.Name(), filepath.Ext(f.Name()))
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		var messages map[string]interface{}
+		switch ext {
+		case ".yml", ".yaml":
+			var raw map[interface{}]interface{}
+			err = yaml.Unmarshal(data, &raw)
+			messages = cast.ToStringMap(normalizeYaml(raw))
+		case ".json":
+			err = json.Unmarshal(data, &messages)
+		default:
+			continue
+		}
+		if err != nil {
+			return errs.NewBaseErrorFromCauseMsg(err, fmt.Sprintf("Не удалось загрузить каталог сообщений %v", f.Name()))
+		}
+		c.AddBundle(lang, messages)
+	}
+
+	return nil
+}
+
+func (c *MessageCatalogServiceImpl) AddBundle(lang string, messages map[string]interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.bundles == nil {
+		c.bundles = map[string]map[string]interface{}{}
+	}
+	lang = NormalizeLang(lang)
+	b := c.bundles[lang]
+	if b == nil {
+		b = map[string]interface{}{}
+		c.bundles[lang] = b
+	}
+	flattenMessages("", messages, b)
+}
+
+func (c *MessageCatalogServiceImpl) GetFallbackChain(lang string) []string {
+	var r []string
+	add := func(l string) {
+		l = NormalizeLang(l)
+		if len(l) == 0 {
+			return
+		}
+		for _, x := range r {
+			if x == l {
+				return
+			}
+		}
+		r = append(r, l)
+	}
+	for _, l := range []string{lang, c.DefaultLang} {
+		l = NormalizeLang(l)
+		add(l)
+		if i := strings.Index(l, "-"); i > 0 {
+			add(l[:i])
+		}
+	}
+	return r
+}
+
+func (c *MessageCatalogServiceImpl) Translate(lang string, key string, params map[string]interface{}) (string, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, l := range c.GetFallbackChain(lang) {
+		if m, ok := c.bundles[l][key]; ok {
+			return format(selectPluralForm(l, m, params), params), true
+		}
+		if l == NormalizeLang(c.SourceLang) {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func selectPluralForm(lang string, m interface{}, params map[string]interface{}) string {
+	forms, ok := m.(map[string]interface{})
+	if !ok {
+		return cast.ToString(m)
+	}
+	count, hasCount := params["count"]
+	if !hasCount {
+		return cast.ToString(forms["other"])
+	}
+	n := cast.ToInt64(count)
+	if v, ok := forms["zero"]; ok && n == 0 {
+		return cast.ToString(v)
+	}
+	if v, ok := forms[PluralCategory(lang, n)]; ok {
+		return cast.ToString(v)
+	}
+	return cast.ToString(forms["other"])
+}
+
+// Категория множественного числа по правилам CLDR (упрощенно для славянских языков и остальных)
+func PluralCategory(lang string, n int64) string {
+	if n < 0 {
+		n = -n
+	}
+	switch strings.Split(lang, "-")[0] {
+	case "ru", "uk", "be":
+		switch {
+		case n%10 == 1 && n%100 != 11:
+			return "one"
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 12 || n%100 > 14):
+			return "few"
+		}
+		return "many"
+	case "ja", "zh", "ko", "tr", "kk", "ky", "uz":
+		return "other"
+	}
+	if n == 1 {
+		return "one"
+	}
+	return "other"
+}
+
+// Подставляет параметры вида {name}
+func format(msg string, params map[string]interface{}) string {
+	if len(params) == 0 || !strings.Contains(msg, "{") {
+		return msg
+	}
+	var pairs []string
+	for k, v := range params {
+		pairs = append(pairs, "{"+k+"}", cast.ToString(v))
+	}
+	return strings.NewReplacer(pairs...).Replace(msg)
+}
+
+var pluralForms = map[string]bool{"zero": true, "one": true, "two": true, "few": true, "many": true, "other": true}
+
+// Вложенные ключи склеиваются через точку, кроме наборов форм множественного числа
+func flattenMessages(prefix string, messages map[string]interface{}, out map[string]interface{}) {
+	for k, v := range messages {
+		key := k
+		if len(prefix) > 0 {
+			key = prefix + "." + k
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			out[key] = v
+			continue
+		}
+		isPlural := len(m) > 0
+		for form := range m {
+			if !pluralForms[form] {
+				isPlural = false
+				break
+			}
+		}
+		if isPlural {
+			out[key] = m
+		} else {
+			flattenMessages(key, m, out)
+		}
+	}
+}
+
+func normalizeYaml(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		r := map[string]interface{}{}
+		for k, child := range x {
+			r[cast.ToString(k)] = normalizeYaml(child)
+		}
+		return r
+	case []interface{}:
+		for i, child := range x {
+			x[i] = normalizeYaml(child)
+		}
+	}
+	return v
+}
+
+func NormalizeLang(lang string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(lang), "_", "-"))
+}
+
+// Разбирает Accept-Language и возвращает языки по убыванию q
+func ParseAcceptLanguage(header string) []string {
+	type tag struct {
+		lang string
+		q    float64
+	}
+	var tags []tag
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		lang := NormalizeLang(fields[0])
+		if len(lang) == 0 || lang == "*" {
+			continue
+		}
+		q := 1.0
+		for _, p := range fields[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(p, "q=") {
+				if x, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = x
+				}
+			}
+		}
+		if q > 0 {
+			tags = append(tags, tag{lang: lang, q: q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+	var r []string
+	for _, t := range tags {
+		r = append(r, t.lang)
+	}
+	return r
+}
@@ -0,0 +1,40 @@
+package i18n
+
+import (
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/core/pkg/core/validation"
+	"github.com/itskovichanton/server/pkg/server/filestorage"
+	"github.com/itskovichanton/server/pkg/server/users"
+)
+
+// Встроенные переводы. Исходные сообщения написаны на русском, поэтому здесь только английский.
+// Переводы причин пакета pipeline заданы рядом с причинами - в ReasonInfo.Messages
+var defaultBundles = map[string]map[string]interface{}{
+	"en": {
+		frmclient.ReasonValidation:                                   "Invalid parameter {param}",
+		frmclient.ReasonValidation + "." + validation.Empty:          "Parameter {param} must not be empty",
+		frmclient.ReasonValidation + "." + validation.InvalidInt:     "Parameter {param} must be an integer",
+		frmclient.ReasonValidation + "." + validation.InvalidInt64:   "Parameter {param} must be an integer",
+		frmclient.ReasonValidation + "." + validation.InvalidFloat:   "Parameter {param} must be a number",
+		frmclient.ReasonValidation + "." + validation.InvalidBoolean: "Parameter {param} must be true/false",
+		frmclient.ReasonValidation + "." + validation.InvalidDate:    "Parameter {param} must be a date",
+		frmclient.ReasonValidation + "." + validation.InvalidEmail:   "Parameter {param} must be a valid e-mail",
+		frmclient.ReasonValidation + "." + validation.InvalidLength:  "Parameter {param} has invalid length",
+		frmclient.ReasonValidation + "." + validation.ViolatesRegexp: "Parameter {param} has invalid format",
+		frmclient.ReasonValidation + "." + validation.Unexpectable:   "Parameter {param} has unexpected value",
+		frmclient.ReasonValidation + ".OUT_OF_RANGE":                 "Parameter {param} is out of range",
+		frmclient.ReasonAuthorizationRequired:                        "User is not authorized",
+		frmclient.ReasonInactiveUser:                                 "User is inactive",
+		frmclient.ReasonInternal:                                     "An internal error occurred. We are already working on it.",
+		frmclient.ReasonServerRespondedWithErrorNotFound:             "Not found",
+		frmclient.ReasonServerUnavailable:                            "Service is temporarily unavailable",
+		frmclient.ReasonCallerUpdateRequired:                         "Client version is outdated, please update to {requiredVersion}",
+		frmclient.ReasonAccessDenied:                                 "Access denied",
+		frmclient.ReasonTooManyRequests:                              "Too many requests",
+		users.ReasonAlreadyExist:                                     "User already exists",
+		users.ReasonAuthorizationFailedInvalidPassword:               "Invalid password",
+		users.ReasonAuthorizationFailedUserNotExist:                  "User does not exist",
+		filestorage.ReasonNotFound:                                   "File not found",
+		filestorage.ReasonNoUpdateNeeded:                             "File does not need to be updated",
+	},
+}
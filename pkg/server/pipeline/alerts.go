@@ -0,0 +1,288 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/goava/pkg/goava/utils"
+	"github.com/itskovichanton/server/pkg/server"
+	"github.com/robfig/cron/v3"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Политика алертов экшена
+type AlertPolicy struct {
+	// Не отправлять алерты вовсе
+	Disabled bool
+
+	// Окно, в пределах которого одинаковые ошибки (один отпечаток) ограничиваются MaxPerWindow
+	Window time.Duration
+
+	// Сколько алертов с одним отпечатком отправить за окно. 0 и меньше - без ограничения
+	MaxPerWindow int
+
+	// Уровень алерта. 0 - не менять
+	Level int
+
+	// Не включать подавленные алерты в сводку
+	NoDigest bool
+}
+
+// Экшен, задающий собственную политику алертов. nil - использовать политику из конфига
+type IAlertPolicyProvider interface {
+	GetAlertPolicy(err *Err) *AlertPolicy
+}
+
+// Слой между раннером и ErrorHandler: склеивает одинаковые ошибки, ограничивает частоту и рассылает сводки
+type IAlertAggregatorService interface {
+	Alert(action IAction, err *Err, prepare func(alertParams *core.AlertParams))
+	SendDigest()
+	Start() error
+	Stop()
+}
+
+type AlertAggregatorServiceImpl struct {
+	IAlertAggregatorService
+
+	ErrorHandler  core.IErrorHandler
+	Config        *core.Config
+	DefaultPolicy *AlertPolicy
+
+	// Политики по имени экшена
+	Policies map[string]*AlertPolicy
+
+	// Расписание сводок в формате cron, по умолчанию - каждые 15 минут
+	DigestSchedule string
+
+	lock    sync.Mutex
+	entries map[string]*alertEntry
+	cron    *cron.Cron
+}
+
+type alertEntry struct {
+	action       string
+	reason       string
+	lastMessage  string
+	windowStart  time.Time
+	lastSeen     time.Time
+	sentInWindow int
+	suppressed   int
+}
+
+// Запускается контроллером вместе с планировщиком. Повторный запуск ничего не делает
+func (c *AlertAggregatorServiceImpl) Start() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.cron != nil {
+		return nil
+	}
+	schedule := c.DigestSchedule
+	if len(schedule) == 0 {
+		schedule = "@every 15m"
+	}
+	r := cron.New()
+	if _, err := r.AddFunc(schedule, c.SendDigest); err != nil {
+		return errs.NewBaseErrorFromCauseMsg(err, fmt.Sprintf("Неверное расписание сводок алертов %v", schedule))
+	}
+	c.cron = r
+	c.cron.Start()
+	return nil
+}
+
+func (c *AlertAggregatorServiceImpl) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.cron != nil {
+		c.cron.Stop()
+	}
+}
+
+func (c *AlertAggregatorServiceImpl) Alert(action IAction, e *Err, prepare func(alertParams *core.AlertParams)) {
+
+	policy := c.getPolicy(action, e)
+	if policy.Disabled {
+		return
+	}
+
+	fingerprint := AlertFingerprint(action.GetName(), e)
+	c.ErrorHandler.HandleWithCustomParams(e.Error, func(alertParams *core.AlertParams) {
+		prepare(alertParams)
+		if !alertParams.Send {
+			return
+		}
+		if !c.register(fingerprint, action.GetName(), e, policy) {
+			alertParams.Send = false
+			return
+		}
+		if policy.Level > 0 {
+			alertParams.Level = policy.Level
+		}
+		alertParams.Message = fmt.Sprintf("Отпечаток: %v\n%v", fingerprint, alertParams.Message)
+	})
+}
+
+// Учитывает ошибку и возвращает false, если лимит алертов в окне исчерпан
+func (c *AlertAggregatorServiceImpl) register(fingerprint string, action string, e *Err, policy *AlertPolicy) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.entries == nil {
+		c.entries = map[string]*alertEntry{}
+	}
+	now := time.Now()
+	entry := c.entries[fingerprint]
+	if entry == nil {
+		entry = &alertEntry{action: action, reason: e.Reason, windowStart: now}
+		c.entries[fingerprint] = entry
+	}
+	entry.lastSeen = now
+	entry.lastMessage = e.Message
+	if now.Sub(entry.windowStart) >= policy.Window {
+		entry.windowStart = now
+		entry.sentInWindow = 0
+	}
+
+	if policy.MaxPerWindow > 0 && entry.sentInWindow >= policy.MaxPerWindow {
+		if !policy.NoDigest {
+			entry.suppressed++
+		}
+		return false
+	}
+	entry.sentInWindow++
+	return true
+}
+
+// Отправляет сводку по подавленным алертам и забывает давно не повторявшиеся ошибки
+func (c *AlertAggregatorServiceImpl) SendDigest() {
+
+	c.lock.Lock()
+	var lines []string
+	total := 0
+	now := time.Now()
+	for fingerprint, entry := range c.entries {
+		if entry.suppressed > 0 {
+			lines = append(lines, fmt.Sprintf("%v x %v / %v (%v), последняя в %v: %v",
+				entry.suppressed, entry.action, entry.reason, fingerprint, entry.lastSeen.Format(time.RFC3339), entry.lastMessage))
+			total += entry.suppressed
+			entry.suppressed = 0
+		} else if now.Sub(entry.lastSeen) > time.Hour && now.Sub(entry.lastSeen) > 2*c.getDefaultPolicy().Window {
+			delete(c.entries, fingerprint)
+		}
+	}
+	c.lock.Unlock()
+
+	if len(lines) == 0 {
+		return
+	}
+	sort.Strings(lines)
+
+	subject := ""
+	if c.Config != nil {
+		subject = c.Config.App.GetFullName() + "-[" + c.Config.Profile + "]-digest"
+	}
+	c.ErrorHandler.SendAlert(&core.AlertParams{
+		Subject: subject,
+		Message: fmt.Sprintf("Подавлено повторяющихся алертов: %v\n%v", total, strings.Join(lines, "\n")),
+		ByEmail: true,
+		ByFR:    true,
+		Level:   1,
+		Send:    true,
+	})
+}
+
+func (c *AlertAggregatorServiceImpl) getPolicy(action IAction, e *Err) *AlertPolicy {
+	if provider, ok := action.(IAlertPolicyProvider); ok {
+		if p := provider.GetAlertPolicy(e); p != nil {
+			return p
+		}
+	}
+	if p, ok := c.Policies[action.GetName()]; ok {
+		return p
+	}
+	return c.getDefaultPolicy()
+}
+
+// Политика из конфига. Незаданные окно и лимит берутся из defaultPolicy
+func AlertPolicyFromConfig(p *server.AlertPolicy, defaultPolicy *AlertPolicy) (*AlertPolicy, error) {
+	if defaultPolicy == nil {
+		defaultPolicy = defaultAlertPolicy
+	}
+	r := &AlertPolicy{
+		Disabled:     p.Disabled,
+		Window:       defaultPolicy.Window,
+		MaxPerWindow: p.MaxPerWindow,
+		Level:        p.Level,
+		NoDigest:     p.NoDigest,
+	}
+	if r.MaxPerWindow == 0 {
+		r.MaxPerWindow = defaultPolicy.MaxPerWindow
+	}
+	if len(p.Window) > 0 {
+		window, err := time.ParseDuration(p.Window)
+		if err != nil {
+			return nil, errs.NewBaseErrorFromCauseMsg(err, fmt.Sprintf("Неверное окно алертов %v", p.Window))
+		}
+		r.Window = window
+	}
+	return r, nil
+}
+
+var defaultAlertPolicy = &AlertPolicy{Window: 5 * time.Minute, MaxPerWindow: 1}
+
+func (c *AlertAggregatorServiceImpl) getDefaultPolicy() *AlertPolicy {
+	if c.DefaultPolicy == nil {
+		return defaultAlertPolicy
+	}
+	return c.DefaultPolicy
+}
+
+// Отпечаток ошибки: экшен + причина + стек (без текста сообщения, т.к. он часто содержит переменные данные).
+// Для паники берется стек места паники, а не места перехвата: иначе все паники экшена склеились бы в одну
+func AlertFingerprint(action string, e *Err) string {
+	return utils.MD5(action + "|" + e.Reason + "|" + stackOf(e.Error))
+}
+
+func stackOf(err error) string {
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		return panicFrames(panicErr.Stack)
+	}
+	be := errs.FindBaseError(err)
+	if be == nil || be.Stack == nil {
+		return fmt.Sprintf("%T", err)
+	}
+	var frames []string
+	for _, line := range strings.Split(be.Stack.Error(), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "at ") {
+			frames = append(frames, strings.TrimSpace(line))
+		}
+	}
+	return strings.Join(frames, "\n")
+}
+
+// Функции стека горутины (runtime/debug.Stack) ниже вызова panic, без адресов и значений аргументов
+func panicFrames(stack string) string {
+	var frames []string
+	for _, line := range strings.Split(stack, "\n") {
+		switch {
+		case strings.HasPrefix(line, "panic("):
+			frames = nil
+		case strings.HasPrefix(line, "\t"):
+			if i := strings.LastIndex(line, " +0x"); i >= 0 {
+				line = line[:i]
+			}
+			frames = append(frames, strings.TrimSpace(line))
+		case strings.HasPrefix(line, "goroutine "):
+		default:
+			if i := strings.LastIndex(line, "("); i >= 0 {
+				line = line[:i]
+			}
+			frames = append(frames, line)
+		}
+	}
+	return strings.Join(frames, "\n")
+}
@@ -47,10 +47,23 @@ func (c *GetUserAction) Run(arg interface{}) (interface{}, error) {
 	if p.Caller.Session == nil {
 		return nil, errs.NewBaseErrorWithReason("Пользователь не существует", users.ReasonAuthorizationFailedUserNotExist)
 	}
+	if bag := bagOf(p); bag != nil {
+		bag.Set(bagKeyAuthenticatedSession, session)
+	}
 
 	return p, nil
 }
 
+func (c *GetUserAction) GetApiDoc() *ApiDoc {
+	return &ApiDoc{
+		Summary: "Авторизация",
+		Params: []*ApiParam{
+			{Name: "sessionToken", In: ApiParamInHeader, Type: "string", Description: "Токен сессии (либо Basic-авторизация)"},
+		},
+		Result: &entities.CallParams{},
+	}
+}
+
 func (c *GetUserAction) GetName() string {
 	return "GetUser"
 }
@@ -65,6 +78,23 @@ func (c *RegisterAccountAction) GetName() string {
 	return "AccountRegistration"
 }
 
+func (c *RegisterAccountAction) GetApiDoc() *ApiDoc {
+	return &ApiDoc{
+		Summary: "Регистрация пользователя",
+		Params: []*ApiParam{
+			{Name: "username", Type: "string", Required: true},
+			{Name: "password", Type: "string", Required: true},
+			{Name: "role", Type: "string"},
+			{Name: "lang", Type: "string"},
+			{Name: "fullName", Type: "string"},
+			{Name: "token", Type: "string"},
+			{Name: "c_id", Type: "int64"},
+			{Name: "mcl_id", Type: "int64"},
+		},
+		Result: &entities.Session{},
+	}
+}
+
 func (c *RegisterAccountAction) Run(arg interface{}) (interface{}, error) {
 	p := arg.(*entities.CallParams)
 	return c.AuthService.Register(ReadAccount(p))
@@ -102,6 +132,13 @@ type GetSessionAction struct {
 	BaseActionImpl
 }
 
+func (c *GetSessionAction) GetApiDoc() *ApiDoc {
+	return &ApiDoc{
+		Summary: "Текущая сессия",
+		Result:  &entities.Session{},
+	}
+}
+
 func (c *GetSessionAction) Run(arg interface{}) (interface{}, error) {
 	p := arg.(*entities.CallParams)
 	if p.Caller != nil && p.Caller.Session != nil {
@@ -109,3 +146,72 @@ func (c *GetSessionAction) Run(arg interface{}) (interface{}, error) {
 	}
 	return nil, nil
 }
+
+// Пропускает только администраторов. Ставится после GetUserAction
+type ValidateAdminAction struct {
+	BaseActionImpl
+}
+
+func (c *ValidateAdminAction) GetName() string {
+	return "ValidateAdmin"
+}
+
+func (c *ValidateAdminAction) Run(arg interface{}) (interface{}, error) {
+	p := arg.(*entities.CallParams)
+	if p.Caller.Session == nil || p.Caller.Session.Account == nil {
+		return nil, errs.NewBaseErrorWithReason("Пользователь не авторизован", frmclient.ReasonAuthorizationRequired)
+	}
+	if p.Caller.Session.Account.Role != entities.RoleAdmin {
+		return nil, errs.NewBaseErrorWithReason("Доступно только администратору", frmclient.ReasonAccessDenied)
+	}
+	return p, nil
+}
+
+const bagKeyAuthenticatedSession = "auth.session"
+
+// Сессия, проверенная GetUserAction в рамках этого вызова. nil - вызывающий не авторизован.
+// Caller.Session до GetUserAction заполняется из заголовков и ничем не подтвержден
+func AuthenticatedSession(arg interface{}) *entities.Session {
+	bag := bagOf(arg)
+	if bag == nil {
+		return nil
+	}
+	session, _ := bag.Get(bagKeyAuthenticatedSession)
+	r, _ := session.(*entities.Session)
+	return r
+}
+
+// Экшен, начинающийся с шагов авторизации. Интерсепторы и очередь задач, которым нужен проверенный пользователь,
+// выполняют auth до своей логики, а rest - после. auth == nil, если шагов авторизации нет
+type IAuthSplittableAction interface {
+	SplitAuth() (auth IAction, rest IAction)
+}
+
+func isAuthAction(action IAction) bool {
+	switch action.(type) {
+	case *ValidateCallerAction, *GetUserAction, *ValidateActiveUserAction, *ValidateAdminAction:
+		return true
+	}
+	return false
+}
+
+// Выполняет шаги авторизации экшена вызова и оставляет в вызове остальные шаги
+func authenticateCall(call *ActionCall) error {
+	splittable, ok := call.Action.(IAuthSplittableAction)
+	if !ok {
+		return nil
+	}
+	auth, rest := splittable.SplitAuth()
+	if auth == nil {
+		return nil
+	}
+	r, err := auth.Run(call.Arg)
+	if err != nil {
+		return err
+	}
+	if p, ok := r.(*entities.CallParams); ok {
+		call.Arg = p
+	}
+	call.Action = rest
+	return nil
+}
@@ -0,0 +1,490 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/echo-http"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Подзапрос пакета не выполнялся, т.к. запрос, на результат которого он ссылается, завершился ошибкой
+const ReasonBatchDependencyFailed = "REASON_BATCH_DEPENDENCY_FAILED"
+
+const (
+	defaultBatchMaxItems    = 20
+	defaultBatchMaxParallel = 4
+)
+
+// Ссылка на результат предыдущего подзапроса: ${<id>.<путь в его body через точку>}, например ${acc.result.username}
+var batchRefPattern = regexp.MustCompile(`\$\{([^.}]+)((?:\.[^}]*)?)\}`)
+
+type BatchRequest struct {
+	// Выполнять подзапросы параллельно. Подзапрос со ссылками все равно ждет запросы, на которые ссылается
+	Parallel bool               `json:"parallel"`
+	Requests []*BatchSubRequest `json:"requests"`
+}
+
+type BatchSubRequest struct {
+	// По умолчанию - порядковый номер
+	ID string `json:"id"`
+
+	// По умолчанию GET
+	Method string `json:"method"`
+
+	// Путь маршрута, может содержать query: /api/jobs/42?lang=en
+	Path   string                 `json:"path"`
+	Params map[string]interface{} `json:"params"`
+}
+
+// Body - тот же Result, что вернул бы маршрут, Status - его http-код
+type BatchSubResult struct {
+	ID     string      `json:"id"`
+	Status int         `json:"status"`
+	Body   interface{} `json:"body"`
+}
+
+// Выполняет несколько маршрутов за один http-запрос. Ставится в цепочку после ValidateCallerAction и GetUserAction:
+// вызывающий авторизуется один раз, подзапросы выполняются раннером с его копией
+type BatchAction struct {
+	BaseActionImpl
+
+	Runner               IActionRunner
+	Routes               func() []*RouteInfo
+	ReasonRegistry       IReasonRegistryService
+	ErrorProviderService IErrorProviderService
+	MaxItems             int
+	MaxParallel          int
+}
+
+func (c *BatchAction) GetName() string {
+	return "Batch"
+}
+
+func (c *BatchAction) GetApiDoc() *ApiDoc {
+	return &ApiDoc{
+		Summary: "Пакетное выполнение запросов",
+		Description: "Тело: {\"parallel\": false, \"requests\": [{\"id\": \"acc\", \"method\": \"GET\", \"path\": \"/api/admin/getAccount\", \"params\": {}}]}. " +
+			"Строки в path и params могут ссылаться на результаты предыдущих подзапросов: ${acc.result.username}",
+		Result: []*BatchSubResult{},
+	}
+}
+
+type batchItem struct {
+	req    *BatchSubRequest
+	deps   []int
+	res    *BatchSubResult
+	failed bool
+
+	// body в виде JSON-значения, если на подзапрос ссылаются
+	view       interface{}
+	referenced bool
+	done       chan struct{}
+}
+
+func (c *BatchAction) Run(arg interface{}) (interface{}, error) {
+
+	p := arg.(*entities.CallParams)
+	request, items, err := c.parse(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !request.Parallel || len(items) == 1 {
+		for _, item := range items {
+			c.runItem(p, items, item)
+		}
+	} else {
+		maxParallel := c.MaxParallel
+		if maxParallel <= 0 {
+			maxParallel = defaultBatchMaxParallel
+		}
+		slots := make(chan struct{}, maxParallel)
+		var wg sync.WaitGroup
+		for _, item := range items {
+			wg.Add(1)
+			go func(item *batchItem) {
+				defer wg.Done()
+				// Слот занимается после ожидания зависимостей: они раньше в списке и ничего не ждут от этого подзапроса
+				for _, dep := range item.deps {
+					<-items[dep].done
+				}
+				slots <- struct{}{}
+				defer func() { <-slots }()
+				c.runItem(p, items, item)
+			}(item)
+		}
+		wg.Wait()
+	}
+
+	r := make([]*BatchSubResult, len(items))
+	for i, item := range items {
+		r[i] = item.res
+	}
+	return r, nil
+}
+
+func (c *BatchAction) parse(p *entities.CallParams) (*BatchRequest, []*batchItem, error) {
+
+	request := &BatchRequest{}
+	d := json.NewDecoder(bytes.NewReader(p.Body))
+	d.UseNumber()
+	if len(p.Body) == 0 || d.Decode(request) != nil {
+		return nil, nil, errs.NewBaseErrorWithReason("Тело запроса должно быть JSON вида {\"requests\": [...]}", frmclient.ReasonValidation)
+	}
+	maxItems := c.MaxItems
+	if maxItems <= 0 {
+		maxItems = defaultBatchMaxItems
+	}
+	if len(request.Requests) == 0 || len(request.Requests) > maxItems {
+		return nil, nil, errs.NewBaseErrorWithReason(fmt.Sprintf("Пакет должен содержать от 1 до %v запросов", maxItems), frmclient.ReasonValidation)
+	}
+
+	index := map[string]int{}
+	items := make([]*batchItem, len(request.Requests))
+	for i, req := range request.Requests {
+		if req == nil || !strings.HasPrefix(req.Path, "/") {
+			return nil, nil, errs.NewBaseErrorWithReason(fmt.Sprintf("requests[%v]: path должен начинаться с /", i), frmclient.ReasonValidation)
+		}
+		if len(req.ID) == 0 {
+			req.ID = strconv.Itoa(i)
+		}
+		if _, ok := index[req.ID]; ok || strings.ContainsAny(req.ID, ".{}") {
+			return nil, nil, errs.NewBaseErrorWithReason(fmt.Sprintf("requests[%v]: id %v повторяется либо содержит . { }", i, req.ID), frmclient.ReasonValidation)
+		}
+		req.Method = strings.ToUpper(req.Method)
+		if len(req.Method) == 0 {
+			req.Method = http.MethodGet
+		}
+		item := &batchItem{req: req, done: make(chan struct{})}
+		for _, id := range batchRefs(req) {
+			dep, ok := index[id]
+			if !ok {
+				return nil, nil, errs.NewBaseErrorWithReason(fmt.Sprintf("requests[%v]: ссылка на %v - можно ссылаться только на предыдущие запросы", i, id), frmclient.ReasonValidation)
+			}
+			items[dep].referenced = true
+			item.deps = append(item.deps, dep)
+		}
+		index[req.ID] = i
+		items[i] = item
+	}
+	return request, items, nil
+}
+
+func (c *BatchAction) runItem(p *entities.CallParams, items []*batchItem, item *batchItem) {
+
+	defer close(item.done)
+	started := time.Now()
+	result, action := c.execute(p, items, item)
+	result.ExecutionTimeMs = time.Since(started).Milliseconds()
+
+	item.failed = result.Err != nil
+	item.res = &BatchSubResult{ID: item.req.ID, Status: c.getStatus(result), Body: (&ResponseModelProviderImpl{}).ToModel(result)}
+	if _, async := action.(*EnqueueActionImpl); async && !item.failed {
+		item.res.Status = http.StatusAccepted
+	}
+	if item.referenced {
+		if data, err := json.Marshal(item.res.Body); err == nil {
+			item.view, _ = (&JSONBodyDecoderImpl{}).Decode(data)
+		}
+	}
+}
+
+// Возвращает результат и экшен маршрута подзапроса (nil, если до вызова маршрута не дошло)
+func (c *BatchAction) execute(p *entities.CallParams, items []*batchItem, item *batchItem) (*Result, IAction) {
+
+	for _, dep := range item.deps {
+		if items[dep].failed {
+			return c.errorResult(errs.NewBaseErrorWithReason(fmt.Sprintf("Запрос %v завершился ошибкой", items[dep].req.ID), ReasonBatchDependencyFailed), p), nil
+		}
+	}
+
+	path, err := resolveBatchRefs(item.req.Path, items)
+	if err != nil {
+		return c.errorResult(err, p), nil
+	}
+	var params interface{}
+	if len(item.req.Params) > 0 {
+		if params, err = resolveBatchRefs(item.req.Params, items); err != nil {
+			return c.errorResult(err, p), nil
+		}
+	}
+
+	u, err := url.Parse(path.(string))
+	if err != nil {
+		return c.errorResult(errs.NewBaseErrorFromCauseMsgReason(err, "Некорректный path "+item.req.Path, frmclient.ReasonValidation), p), nil
+	}
+	route, pathParams := matchBatchRoute(c.Routes(), item.req.Method, u.Path)
+	if route == nil {
+		return c.errorResult(errs.NewBaseErrorWithReason(fmt.Sprintf("Маршрут %v %v не найден", item.req.Method, u.Path), frmclient.ReasonServerRespondedWithErrorNotFound), p), nil
+	}
+
+	result := c.Runner.Run(route.Action, func() (interface{}, error) {
+		return c.newCallParams(p, item.req.ID, item.req.Method, u, pathParams, params)
+	}, c.ErrorProviderService)
+	if stream, ok := result.Res.(*Stream); ok {
+		stream.cancel()
+		return c.errorResult(errs.NewBaseErrorWithReason(fmt.Sprintf("Потоковый маршрут %v не выполняется в пакете", u.Path), frmclient.ReasonValidation), p), route.Action
+	}
+	return result, route.Action
+}
+
+// Вызывающий - копия уже авторизованного вызывающего пакета, заголовки - заголовки пакета.
+// Idempotency-Key пакета у подзапроса дополняется его id: иначе подзапросы одного маршрута
+// получили бы один ключ и второй из них - ответ первого либо ошибку несовпадения запроса.
+// У подзапроса свой echo.Context: то, что интерсепторы и экшены пишут в контекст (например, заголовки кэширования),
+// не попадает в ответ всего пакета
+func (c *BatchAction) newCallParams(p *entities.CallParams, id string, method string, u *url.URL, pathParams map[string]string, params interface{}) (*entities.CallParams, error) {
+
+	headers := p.Headers
+	idempotencyKey := p.GetHeader(HeaderIdempotencyKey)
+	if len(idempotencyKey) > 0 {
+		idempotencyKey += "/" + id
+		headers = map[string][]string{}
+		for k, v := range p.Headers {
+			if !strings.EqualFold(k, HeaderIdempotencyKey) {
+				headers[k] = v
+			}
+		}
+		headers[HeaderIdempotencyKey] = []string{idempotencyKey}
+	}
+
+	caller := *p.Caller
+	r := &entities.CallParams{
+		Parameters: map[string][]interface{}{},
+		Headers:    headers,
+		URL:        u.RequestURI(),
+		Caller:     &caller,
+		Raw:        u.RawQuery,
+		Bag:        entities.NewBag(),
+	}
+	if context, ok := p.Request.(echo.Context); ok {
+		r.URL = context.Request().Host + r.URL
+		request := context.Request().Clone(context.Request().Context())
+		request.Method = method
+		request.URL = u
+		request.RequestURI = u.RequestURI()
+		request.Body = http.NoBody
+		request.ContentLength = 0
+		if len(idempotencyKey) > 0 {
+			request.Header.Set(HeaderIdempotencyKey, idempotencyKey)
+		}
+		r.Request = context.Echo().NewContext(request, &batchResponseWriter{header: http.Header{}})
+	}
+	for k, values := range u.Query() {
+		for _, v := range values {
+			r.Parameters[k] = append(r.Parameters[k], v)
+		}
+	}
+	if params != nil {
+		body, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+		r.DecodedBody = params
+		flattenBody("", params, r.Parameters)
+	}
+	for k, v := range pathParams {
+		r.Parameters["path__"+k] = []interface{}{v}
+	}
+	return r, nil
+}
+
+func (c *BatchAction) errorResult(err error, p *entities.CallParams) *Result {
+	return &Result{Err: provideError(c.ErrorProviderService, err, p)}
+}
+
+func (c *BatchAction) getStatus(result *Result) int {
+	if result.Err == nil {
+		return http.StatusOK
+	}
+	if info := reasonRegistryOrDefault(c.ReasonRegistry).Get(result.Err.Reason); info != nil && info.HttpStatus > 0 {
+		return info.HttpStatus
+	}
+	return http.StatusInternalServerError
+}
+
+// Id подзапросов, на которые ссылаются path и params
+func batchRefs(req *BatchSubRequest) []string {
+	seen := map[string]bool{}
+	var r []string
+	var walk func(v interface{})
+	walk = func(v interface{}) {
+		switch x := v.(type) {
+		case string:
+			for _, m := range batchRefPattern.FindAllStringSubmatch(x, -1) {
+				if !seen[m[1]] {
+					seen[m[1]] = true
+					r = append(r, m[1])
+				}
+			}
+		case map[string]interface{}:
+			for _, child := range x {
+				walk(child)
+			}
+		case []interface{}:
+			for _, child := range x {
+				walk(child)
+			}
+		}
+	}
+	walk(req.Path)
+	walk(req.Params)
+	return r
+}
+
+// Подставляет результаты предыдущих подзапросов. Строка, целиком состоящая из одной ссылки, заменяется значением как есть
+func resolveBatchRefs(v interface{}, items []*batchItem) (interface{}, error) {
+	switch x := v.(type) {
+	case string:
+		if m := batchRefPattern.FindStringSubmatch(x); m != nil && m[0] == x {
+			return lookupBatchRef(m[1], m[2], items)
+		}
+		var err error
+		r := batchRefPattern.ReplaceAllStringFunc(x, func(ref string) string {
+			m := batchRefPattern.FindStringSubmatch(ref)
+			value, e := lookupBatchRef(m[1], m[2], items)
+			if e != nil {
+				err = e
+			}
+			return fmt.Sprintf("%v", value)
+		})
+		return r, err
+	case map[string]interface{}:
+		r := make(map[string]interface{}, len(x))
+		for k, child := range x {
+			value, err := resolveBatchRefs(child, items)
+			if err != nil {
+				return nil, err
+			}
+			r[k] = value
+		}
+		return r, nil
+	case []interface{}:
+		r := make([]interface{}, len(x))
+		for i, child := range x {
+			value, err := resolveBatchRefs(child, items)
+			if err != nil {
+				return nil, err
+			}
+			r[i] = value
+		}
+		return r, nil
+	}
+	return v, nil
+}
+
+func lookupBatchRef(id, path string, items []*batchItem) (interface{}, error) {
+	var value interface{}
+	for _, item := range items {
+		if item.req.ID == id {
+			value = item.view
+			break
+		}
+	}
+	for _, key := range strings.Split(strings.TrimPrefix(path, "."), ".") {
+		if len(key) == 0 {
+			continue
+		}
+		switch x := value.(type) {
+		case map[string]interface{}:
+			value = x[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(x) {
+				value = nil
+			} else {
+				value = x[i]
+			}
+		default:
+			value = nil
+		}
+		if value == nil {
+			return nil, errs.NewBaseErrorWithReason(fmt.Sprintf("В результате запроса %v нет значения %v", id, path), frmclient.ReasonValidation)
+		}
+	}
+	return value, nil
+}
+
+// Маршрут с наименьшим числом параметров пути, как у роутера echo статичный сегмент важнее параметра
+func matchBatchRoute(routes []*RouteInfo, method, path string) (*RouteInfo, map[string]string) {
+	var best *RouteInfo
+	var bestParams map[string]string
+	for _, route := range routes {
+		if !routeHasMethod(route, method) || isBatchAction(route.Action) {
+			continue
+		}
+		params, ok := matchRoutePath(route.Path, path)
+		if ok && (best == nil || len(params) < len(bestParams)) {
+			best, bestParams = route, params
+		}
+	}
+	return best, bestParams
+}
+
+func matchRoutePath(pattern, path string) (map[string]string, bool) {
+	patternSegments := strings.Split(strings.Trim(pattern, "/"), "/")
+	pathSegments := strings.Split(strings.Trim(path, "/"), "/")
+	params := map[string]string{}
+	for i, segment := range patternSegments {
+		if segment == "*" {
+			params["*"] = strings.Join(pathSegments[i:], "/")
+			return params, true
+		}
+		if i >= len(pathSegments) {
+			return nil, false
+		}
+		if strings.HasPrefix(segment, ":") {
+			params[segment[1:]] = pathSegments[i]
+		} else if segment != pathSegments[i] {
+			return nil, false
+		}
+	}
+	return params, len(patternSegments) == len(pathSegments)
+}
+
+func routeHasMethod(route *RouteInfo, method string) bool {
+	for _, m := range route.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Пакет не может содержать пакет
+func isBatchAction(action IAction) bool {
+	if _, ok := action.(*BatchAction); ok {
+		return true
+	}
+	if chain, ok := action.(*ChainedActionImpl); ok && len(chain.Actions) > 0 {
+		return isBatchAction(chain.Actions[len(chain.Actions)-1])
+	}
+	return false
+}
+
+// Ответ подзапроса пакета никуда не пишется - результат собирается из Result
+type batchResponseWriter struct {
+	header http.Header
+}
+
+func (c *batchResponseWriter) Header() http.Header {
+	return c.header
+}
+
+func (c *batchResponseWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (c *batchResponseWriter) WriteHeader(int) {
+}
@@ -0,0 +1,79 @@
+package pipeline
+
+import (
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"net/http"
+	"testing"
+)
+
+type testUserAction struct {
+	BaseActionImpl
+}
+
+func (c *testUserAction) GetName() string {
+	return "testUser"
+}
+
+func (c *testUserAction) Run(arg interface{}) (interface{}, error) {
+	p := arg.(*entities.CallParams)
+	return map[string]interface{}{
+		"id":   p.GetParamStr("path__id"),
+		"name": p.GetParamStr("name"),
+		"key":  p.GetHeader(HeaderIdempotencyKey),
+	}, nil
+}
+
+func runTestBatch(t *testing.T, body string) map[string]*Result {
+	t.Helper()
+	runner, _, _ := newTestRunner()
+	routes := []*RouteInfo{{Methods: []string{http.MethodGet, http.MethodPost}, Path: "/api/users/:id", Action: &testUserAction{}}}
+	action := &BatchAction{Runner: runner, ErrorProviderService: runner.DefaultErrorProviderService, Routes: func() []*RouteInfo { return routes }}
+	r, err := action.Run(&entities.CallParams{
+		Body:    []byte(body),
+		Headers: map[string][]string{"idempotency-key": {"k1"}},
+		Caller:  &entities.Caller{},
+		Bag:     entities.NewBag(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := map[string]*Result{}
+	for _, item := range r.([]*BatchSubResult) {
+		results[item.ID] = item.Body.(*Result)
+	}
+	return results
+}
+
+func TestBatchRefs(t *testing.T) {
+	results := runTestBatch(t, `{"requests": [
+		{"id": "acc", "path": "/api/users/7?name=bob"},
+		{"id": "next", "method": "POST", "path": "/api/users/${acc.result.id}", "params": {"name": "${acc.result.name}-2"}},
+		{"id": "bad", "path": "/api/users/${acc.result.missing}"},
+		{"id": "dep", "path": "/api/users/${bad.result.id}"}
+	]}`)
+
+	next := results["next"]
+	if next.Err != nil {
+		t.Fatal(next.Err.Message)
+	}
+	if res := next.Res.(map[string]interface{}); res["id"] != "7" || res["name"] != "bob-2" {
+		t.Errorf("ссылки не подставлены: %v", res)
+	}
+	if err := results["bad"].Err; err == nil || err.Reason != frmclient.ReasonValidation {
+		t.Errorf("ссылка на отсутствующее значение: %v", err)
+	}
+	if err := results["dep"].Err; err == nil || err.Reason != ReasonBatchDependencyFailed {
+		t.Errorf("подзапрос, зависящий от ошибки: %v", err)
+	}
+}
+
+// Подзапросы одного маршрута получают разные ключи идемпотентности
+func TestBatchIdempotencyKeyPerItem(t *testing.T) {
+	results := runTestBatch(t, `{"requests": [{"id": "a", "path": "/api/users/1"}, {"id": "b", "path": "/api/users/2"}]}`)
+	for id, want := range map[string]string{"a": "k1/a", "b": "k1/b"} {
+		if key := results[id].Res.(map[string]interface{})["key"]; key != want {
+			t.Errorf("%v: ключ %v, ожидался %v", id, key, want)
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core/validation"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"github.com/spf13/cast"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ValidationReasonOutOfRange = "OUT_OF_RANGE"
+)
+
+var (
+	callParamsType = reflect.TypeOf(&entities.CallParams{})
+	callerType     = reflect.TypeOf(&entities.Caller{})
+	timeType       = reflect.TypeOf(time.Time{})
+
+	// Разобранные теги структур: reflect.Type -> []*fieldBinding
+	fieldBindings sync.Map
+)
+
+// Поле структуры и его проверки, разобранные из тегов один раз на тип
+type fieldBinding struct {
+	index int
+	key   string
+	tag   string
+	rules []*fieldRule
+}
+
+type fieldRule struct {
+	name  string
+	arg   string
+	bound float64
+}
+
+// Несколько ошибок валидации параметров, собранных за один проход
+type ValidationErrors struct {
+	errs.BaseError
+
+	Errors []*validation.ValidationError
+}
+
+func newValidationErrors(errors []*validation.ValidationError) *ValidationErrors {
+	var msgs []string
+	for _, e := range errors {
+		msgs = append(msgs, e.Param+": "+e.Message)
+	}
+	return &ValidationErrors{
+		BaseError: *errs.NewBaseError(strings.Join(msgs, "; ")),
+		Errors:    errors,
+	}
+}
+
+// Заполняет структуру out (указатель) из CallParams.
+// Источник значения задается тегом:
+//
+//	param:"key"   - параметр запроса (query, form, multipart, тело запроса)
+//	path:"name"   - параметр пути (path__name)
+//	header:"Name" - заголовок запроса
+//
+// Проверки задаются тегом validate:"required,min=1,max=10,len=3,email,regexp=^[a-z]+$,oneof=a b c"
+// (а также check:"notempty,email"). Нарушения собираются все сразу и возвращаются как *ValidationErrors.
+// Поля типа *entities.CallParams и *entities.Caller заполняются самим вызовом
+func BindCallParams(p *entities.CallParams, out interface{}) error {
+
+	v := reflect.ValueOf(out)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return errs.NewBaseError(fmt.Sprintf("BindCallParams: ожидается указатель на структуру, получен %T", out))
+	}
+	v = v.Elem()
+	bindings, err := getFieldBindings(v.Type())
+	if err != nil {
+		return err
+	}
+
+	var violations []*validation.ValidationError
+	addViolation := func(err error) error {
+		if ve, ok := err.(*validation.ValidationError); ok {
+			violations = append(violations, ve)
+			return nil
+		}
+		return err
+	}
+
+	for _, b := range bindings {
+		fv := v.Field(b.index)
+
+		switch fv.Type() {
+		case callParamsType:
+			fv.Set(reflect.ValueOf(p))
+			continue
+		case callerType:
+			fv.Set(reflect.ValueOf(p.Caller))
+			continue
+		}
+
+		values := readFieldValues(p, b)
+		if len(values) > 0 {
+			if err := setField(fv, b.key, values); err != nil {
+				if err = addViolation(err); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		for _, err := range validateField(b, fv, len(values) > 0) {
+			if err = addViolation(err); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return newValidationErrors(violations)
+	}
+	return nil
+}
+
+// Проверяет теги структуры t (или указателя на нее), чтобы ошибка в них обнаружилась при запуске, а не на первом запросе.
+// Adapt вызывает ее для входной структуры типизированного экшена
+func CheckBindingTags(t reflect.Type) error {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	_, err := getFieldBindings(t)
+	return err
+}
+
+func getFieldBindings(t reflect.Type) ([]*fieldBinding, error) {
+	if r, ok := fieldBindings.Load(t); ok {
+		return r.([]*fieldBinding), nil
+	}
+	r, err := parseFieldBindings(t)
+	if err != nil {
+		return nil, err
+	}
+	fieldBindings.Store(t, r)
+	return r, nil
+}
+
+func parseFieldBindings(t reflect.Type) ([]*fieldBinding, error) {
+	var r []*fieldBinding
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		if f.Type == callParamsType || f.Type == callerType {
+			r = append(r, &fieldBinding{index: i})
+			continue
+		}
+
+		b := &fieldBinding{index: i}
+		for _, tag := range []string{"param", "path", "header"} {
+			if key := f.Tag.Get(tag); len(key) > 0 && key != "-" {
+				b.key, b.tag = key, tag
+				break
+			}
+		}
+		if len(b.key) == 0 {
+			continue
+		}
+		rules, err := parseFieldRules(f)
+		if err != nil {
+			return nil, errs.NewBaseErrorFromCauseMsg(err, fmt.Sprintf("BindCallParams: неверный тег поля %v.%v: %v", t.Name(), f.Name, err))
+		}
+		b.rules = rules
+		r = append(r, b)
+	}
+	return r, nil
+}
+
+func parseFieldRules(f reflect.StructField) ([]*fieldRule, error) {
+
+	var r []*fieldRule
+	if checks := f.Tag.Get("check"); len(checks) > 0 {
+		// check - формат validation.Check из core: неизвестные проверки в нем пропускаются
+		for _, check := range strings.Split(checks, ",") {
+			switch strings.ToLower(strings.TrimSpace(check)) {
+			case "notempty":
+				r = append(r, &fieldRule{name: "required"})
+			case "email":
+				r = append(r, &fieldRule{name: "email"})
+			}
+		}
+	}
+
+	validate := f.Tag.Get("validate")
+	if len(validate) == 0 {
+		return r, nil
+	}
+	for _, s := range strings.Split(validate, ",") {
+		rule := &fieldRule{name: strings.TrimSpace(s)}
+		if i := strings.Index(rule.name, "="); i >= 0 {
+			rule.name, rule.arg = rule.name[:i], rule.name[i+1:]
+		}
+		switch rule.name {
+		case "":
+			continue
+		case "required", "email":
+		case "len":
+			n, err := strconv.Atoi(rule.arg)
+			if err != nil {
+				return nil, err
+			}
+			rule.bound = float64(n)
+		case "min", "max":
+			bound, err := strconv.ParseFloat(rule.arg, 64)
+			if err != nil {
+				return nil, err
+			}
+			rule.bound = bound
+		case "regexp":
+			if _, err := regexp.Compile(rule.arg); err != nil {
+				return nil, err
+			}
+		case "oneof":
+			if len(strings.Fields(rule.arg)) == 0 {
+				return nil, errs.NewBaseError("у правила oneof нет значений")
+			}
+		default:
+			return nil, errs.NewBaseError(fmt.Sprintf("неизвестное правило валидации %v", rule.name))
+		}
+		r = append(r, rule)
+	}
+	return r, nil
+}
+
+func readFieldValues(p *entities.CallParams, b *fieldBinding) []interface{} {
+	switch b.tag {
+	case "param":
+		return p.GetParam(b.key)
+	case "path":
+		return p.GetParam("path__" + b.key)
+	case "header":
+		h := p.GetHeader(b.key)
+		if len(h) == 0 {
+			return nil
+		}
+		return []interface{}{h}
+	}
+	return nil
+}
+
+func setField(fv reflect.Value, key string, values []interface{}) error {
+
+	if values[0] != nil && reflect.TypeOf(values[0]) == fv.Type() {
+		fv.Set(reflect.ValueOf(values[0]))
+		return nil
+	}
+
+	if fv.Kind() == reflect.Ptr {
+		x := reflect.New(fv.Type().Elem())
+		if err := setField(x.Elem(), key, values); err != nil {
+			return err
+		}
+		fv.Set(x)
+		return nil
+	}
+
+	if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 {
+		r := reflect.MakeSlice(fv.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setField(r.Index(i), key, []interface{}{value}); err != nil {
+				return err
+			}
+		}
+		fv.Set(r)
+		return nil
+	}
+
+	value := values[0]
+	str := cast.ToString(value)
+	if fv.Type() == timeType {
+		t, err := validation.CheckDate(key, str)
+		if err != nil {
+			return err
+		}
+		fv.Set(reflect.ValueOf(*t))
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(str)
+	case reflect.Bool:
+		b, err := validation.CheckBool(key, str)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		x, err := validation.CheckInt(key, str)
+		if err != nil {
+			return err
+		}
+		if fv.OverflowInt(int64(x)) {
+			return outOfRange(key, str, fv)
+		}
+		fv.SetInt(int64(x))
+	case reflect.Int64:
+		x, err := validation.CheckInt64(key, str)
+		if err != nil {
+			return err
+		}
+		fv.SetInt(x)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		x, err := validation.CheckInt64(key, str)
+		if err != nil {
+			return err
+		}
+		if x < 0 || fv.OverflowUint(uint64(x)) {
+			return outOfRange(key, str, fv)
+		}
+		fv.SetUint(uint64(x))
+	case reflect.Float32, reflect.Float64:
+		x, err := validation.CheckFloat64(key, str)
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(x)
+	case reflect.Interface:
+		if value != nil {
+			fv.Set(reflect.ValueOf(value))
+		}
+	default:
+		return errs.NewBaseError(fmt.Sprintf("BindCallParams: неподдерживаемый тип поля %v для параметра %v", fv.Type(), key))
+	}
+
+	return nil
+}
+
+// Значение вне диапазона типа поля, например отрицательное для uint
+func outOfRange(key string, str string, fv reflect.Value) error {
+	_, err := validation.CheckCondition(func() (interface{}, bool) {
+		return str, false
+	}, key, ValidationReasonOutOfRange, str, func() string {
+		return fmt.Sprintf("Значение вне допустимого диапазона для %v", fv.Type())
+	})
+	return err
+}
+
+func validateField(b *fieldBinding, fv reflect.Value, provided bool) []error {
+
+	var r []error
+	if len(b.rules) == 0 {
+		return r
+	}
+
+	if !provided || (fv.Kind() == reflect.String && fv.Len() == 0) {
+		for _, rule := range b.rules {
+			if rule.name == "required" {
+				_, err := validation.CheckNotEmpty(b.key, nil)
+				r = append(r, err)
+			}
+		}
+		return r
+	}
+
+	value := reflect.Indirect(fv)
+	for _, rule := range b.rules {
+		if err := applyRule(b.key, rule, value); err != nil {
+			r = append(r, err)
+		}
+	}
+	return r
+}
+
+// Правила разобраны и проверены в parseFieldRules
+func applyRule(key string, rule *fieldRule, v reflect.Value) error {
+
+	var err error
+	name, arg := rule.name, rule.arg
+	switch name {
+	case "required":
+	case "email":
+		_, err = validation.CheckEmail(key, cast.ToString(v.Interface()))
+	case "regexp":
+		_, err = validation.CheckMatchRegexp(key, cast.ToString(v.Interface()), arg)
+	case "len":
+		_, err = validation.CheckCondition(func() (interface{}, bool) {
+			return v.Interface(), sizeOf(v) == rule.bound
+		}, key, validation.InvalidLength, v.Interface(), func() string {
+			return fmt.Sprintf("Длина должна быть равна %v", arg)
+		})
+	case "min", "max":
+		bound := rule.bound
+		reason := validation.InvalidLength
+		if isNumber(v) {
+			reason = ValidationReasonOutOfRange
+		}
+		_, err = validation.CheckCondition(func() (interface{}, bool) {
+			if name == "min" {
+				return v.Interface(), sizeOf(v) >= bound
+			}
+			return v.Interface(), sizeOf(v) <= bound
+		}, key, reason, v.Interface(), func() string {
+			if name == "min" {
+				return fmt.Sprintf("Значение меньше допустимого (%v)", arg)
+			}
+			return fmt.Sprintf("Значение больше допустимого (%v)", arg)
+		})
+	case "oneof":
+		_, err = validation.CheckCondition(func() (interface{}, bool) {
+			s := cast.ToString(v.Interface())
+			for _, x := range strings.Fields(arg) {
+				if x == s {
+					return s, true
+				}
+			}
+			return s, false
+		}, key, validation.Unexpectable, v.Interface(), func() string {
+			return fmt.Sprintf("Значение должно быть одним из: %v", arg)
+		})
+	}
+	return err
+}
+
+func isNumber(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// Для чисел - значение, для строк, срезов и карт - длина
+func sizeOf(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.String:
+		return float64(len([]rune(v.String())))
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	}
+	return 0
+}
@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"errors"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"reflect"
+	"testing"
+)
+
+type testBindIn struct {
+	Count uint8  `param:"count" validate:"max=100"`
+	Name  string `param:"name" validate:"required,min=2"`
+}
+
+func TestBindRejectsOutOfRangeUint(t *testing.T) {
+	for _, count := range []string{"-1", "300"} {
+		var in testBindIn
+		err := BindCallParams(&entities.CallParams{Parameters: map[string][]interface{}{"count": {count}, "name": {"bob"}}}, &in)
+		var violations *ValidationErrors
+		if !errors.As(err, &violations) || len(violations.Errors) != 1 || violations.Errors[0].Reason != ValidationReasonOutOfRange {
+			t.Errorf("count=%v: ожидалось нарушение %v, получено %v (значение %v)", count, ValidationReasonOutOfRange, err, in.Count)
+		}
+	}
+}
+
+func TestCheckBindingTags(t *testing.T) {
+	if err := CheckBindingTags(reflect.TypeOf(&testBindIn{})); err != nil {
+		t.Fatal(err)
+	}
+	for _, in := range []interface{}{
+		struct {
+			A string `param:"a" validate:"requred"`
+		}{},
+		struct {
+			A string `param:"a" validate:"min=two"`
+		}{},
+		struct {
+			A string `param:"a" validate:"regexp=["`
+		}{},
+	} {
+		if err := CheckBindingTags(reflect.TypeOf(in)); err == nil {
+			t.Errorf("%v: ожидалась ошибка в теге", reflect.TypeOf(in).Field(0).Tag)
+		}
+	}
+}
+
+func TestAdaptPanicsOnInvalidTags(t *testing.T) {
+	type in struct {
+		A string `param:"a" validate:"unknown"`
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("Adapt принял неизвестное правило")
+		}
+	}()
+	Adapt(NewAction("bad", func(in *in) (string, error) { return in.A, nil }))
+}
@@ -0,0 +1,210 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/itskovichanton/echo-http"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Декодирует тело запроса определенного content-type в значение (обычно map[string]interface{})
+type IBodyDecoder interface {
+	Decode(body []byte) (interface{}, error)
+}
+
+type JSONBodyDecoderImpl struct {
+	IBodyDecoder
+}
+
+func (c *JSONBodyDecoderImpl) Decode(body []byte) (interface{}, error) {
+	var r interface{}
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+type MsgpackBodyDecoderImpl struct {
+	IBodyDecoder
+}
+
+func (c *MsgpackBodyDecoderImpl) Decode(body []byte) (interface{}, error) {
+	var r interface{}
+	d := msgpack.NewDecoder(bytes.NewReader(body))
+	d.SetMapDecoder(func(d *msgpack.Decoder) (interface{}, error) {
+		return d.DecodeUntypedMap()
+	})
+	if err := d.Decode(&r); err != nil {
+		return nil, err
+	}
+	return normalizeDecoded(r), nil
+}
+
+// Тело - сериализованный google.protobuf.Struct
+type ProtobufBodyDecoderImpl struct {
+	IBodyDecoder
+}
+
+func (c *ProtobufBodyDecoderImpl) Decode(body []byte) (interface{}, error) {
+	var s structpb.Struct
+	if err := proto.Unmarshal(body, &s); err != nil {
+		return nil, err
+	}
+	return s.AsMap(), nil
+}
+
+// XML декодируется в map: элементы - ключи, повторяющиеся элементы - срезы, атрибуты - ключи с префиксом @,
+// текст элемента с атрибутами - ключ #text.
+// Корневой элемент отбрасывается
+type XMLBodyDecoderImpl struct {
+	IBodyDecoder
+}
+
+func (c *XMLBodyDecoderImpl) Decode(body []byte) (interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := t.(xml.StartElement); ok {
+			return c.decodeElement(d, start)
+		}
+	}
+}
+
+func (c *XMLBodyDecoderImpl) decodeElement(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	children := map[string]interface{}{}
+	for _, a := range start.Attr {
+		children["@"+a.Name.Local] = a.Value
+	}
+	var text strings.Builder
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch e := t.(type) {
+		case xml.StartElement:
+			v, err := c.decodeElement(d, e)
+			if err != nil {
+				return nil, err
+			}
+			name := e.Name.Local
+			switch prev := children[name].(type) {
+			case nil:
+				children[name] = v
+			case []interface{}:
+				children[name] = append(prev, v)
+			default:
+				children[name] = []interface{}{prev, v}
+			}
+		case xml.CharData:
+			text.Write(e)
+		case xml.EndElement:
+			s := strings.TrimSpace(text.String())
+			if len(children) == 0 {
+				return s, nil
+			}
+			if len(s) > 0 {
+				children["#text"] = s
+			}
+			return children, nil
+		}
+	}
+}
+
+func DefaultBodyDecoders() map[string]IBodyDecoder {
+	xmlDecoder := &XMLBodyDecoderImpl{}
+	protobufDecoder := &ProtobufBodyDecoderImpl{}
+	msgpackDecoder := &MsgpackBodyDecoderImpl{}
+	return map[string]IBodyDecoder{
+		echo.MIMEApplicationJSON:     &JSONBodyDecoderImpl{},
+		echo.MIMEApplicationXML:      xmlDecoder,
+		echo.MIMETextXML:             xmlDecoder,
+		echo.MIMEApplicationMsgpack:  msgpackDecoder,
+		"application/x-msgpack":      msgpackDecoder,
+		echo.MIMEApplicationProtobuf: protobufDecoder,
+		"application/x-protobuf":     protobufDecoder,
+	}
+}
+
+const ReasonRequestTooLarge = "REASON_REQUEST_TOO_LARGE"
+
+func readBody(r io.Reader) ([]byte, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, errs.NewBaseErrorFromCauseMsgReason(err, "Превышен допустимый размер запроса", ReasonRequestTooLarge)
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+// Раскладывает декодированное тело в параметры: вложенные поля - через точку, массивы скаляров - в несколько значений
+func flattenBody(prefix string, v interface{}, res map[string][]interface{}) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if len(prefix) > 0 {
+			res[prefix] = append(res[prefix], x)
+			prefix += "."
+		}
+		for k, child := range x {
+			flattenBody(prefix+k, child, res)
+		}
+	case []interface{}:
+		for i, child := range x {
+			switch child.(type) {
+			case map[string]interface{}, []interface{}:
+				flattenBody(joinKey(prefix, fmt.Sprintf("%v", i)), child, res)
+			default:
+				res[prefix] = append(res[prefix], child)
+			}
+		}
+	default:
+		res[prefix] = append(res[prefix], x)
+	}
+}
+
+func joinKey(prefix, key string) string {
+	if len(prefix) == 0 {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// msgpack декодирует вложенные карты как map[interface{}]interface{}
+func normalizeDecoded(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[interface{}]interface{}:
+		r := map[string]interface{}{}
+		for k, child := range x {
+			r[fmt.Sprintf("%v", k)] = normalizeDecoded(child)
+		}
+		return r
+	case map[string]interface{}:
+		for k, child := range x {
+			x[k] = normalizeDecoded(child)
+		}
+		return x
+	case []interface{}:
+		for i, child := range x {
+			x[i] = normalizeDecoded(child)
+		}
+		return x
+	}
+	return v
+}
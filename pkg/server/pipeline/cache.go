@@ -0,0 +1,362 @@
+package pipeline
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"github.com/itskovichanton/echo-http"
+	"github.com/itskovichanton/goava/pkg/goava/utils"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	InterceptorCache = "cache"
+
+	ctxKeyCacheInfo = "cache.info"
+)
+
+type CacheScope string
+
+const (
+	// Отдельная запись для каждого пользователя. Вызовы без авторизации не кэшируются
+	CacheScopeAccount CacheScope = "account"
+
+	// Общая запись для всех пользователей с одной ролью. Шаги авторизации экшена выполняются и при попадании в кэш,
+	// остальные шаги - нет
+	CacheScopeShared CacheScope = "shared"
+)
+
+// Политика кэширования результата экшена
+type CachePolicy struct {
+	TTL time.Duration
+
+	// Параметры запроса, входящие в ключ. Если не заданы - все параметры
+	Params []string
+
+	// По умолчанию CacheScopeAccount
+	Scope CacheScope
+
+	// Теги записи для инвалидации
+	Tags []string
+}
+
+// Экшен, результат которого можно кэшировать
+type ICacheableAction interface {
+	GetCachePolicy() *CachePolicy
+}
+
+// Экшен, после успешного выполнения которого сбрасываются записи кэша с указанными тегами
+type ICacheInvalidatingAction interface {
+	GetInvalidatedCacheTags() []string
+}
+
+// Заголовки кэширования ответа, выставляемые презентером
+type CacheInfo struct {
+	ETag   string
+	MaxAge time.Duration
+	Scope  CacheScope
+
+	// Ответ можно хранить в общих кэшах (Cache-Control: public): запись общая и вызов без авторизации
+	Public bool
+}
+
+type CacheEntry struct {
+	Key       string
+	Res       interface{}
+	ETag      string
+	Tags      []string
+	Scope     CacheScope
+	ExpiresAt time.Time
+}
+
+type IResponseCacheService interface {
+	Get(key string) *CacheEntry
+	Put(entry *CacheEntry)
+	InvalidateTags(tags ...string)
+	GetInterceptor() *Interceptor
+}
+
+// LRU-кэш результатов экшенов. MaxEntries <= 0 - без ограничения размера
+type ResponseCacheServiceImpl struct {
+	IResponseCacheService
+
+	MaxEntries int
+
+	lock  sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+	tags  map[string]map[string]bool
+}
+
+func (c *ResponseCacheServiceImpl) Get(key string) *CacheEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*CacheEntry)
+	if !entry.ExpiresAt.After(time.Now()) {
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return entry
+}
+
+func (c *ResponseCacheServiceImpl) Put(entry *CacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.items == nil {
+		c.lru = list.New()
+		c.items = map[string]*list.Element{}
+		c.tags = map[string]map[string]bool{}
+	}
+	if e, ok := c.items[entry.Key]; ok {
+		c.remove(e)
+	}
+	c.items[entry.Key] = c.lru.PushFront(entry)
+	for _, tag := range entry.Tags {
+		if c.tags[tag] == nil {
+			c.tags[tag] = map[string]bool{}
+		}
+		c.tags[tag][entry.Key] = true
+	}
+	for c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *ResponseCacheServiceImpl) InvalidateTags(tags ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, tag := range tags {
+		for key := range c.tags[tag] {
+			if e, ok := c.items[key]; ok {
+				c.remove(e)
+			}
+		}
+		delete(c.tags, tag)
+	}
+}
+
+func (c *ResponseCacheServiceImpl) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*CacheEntry)
+	delete(c.items, entry.Key)
+	for _, tag := range entry.Tags {
+		delete(c.tags[tag], entry.Key)
+		if len(c.tags[tag]) == 0 {
+			delete(c.tags, tag)
+		}
+	}
+}
+
+func (c *ResponseCacheServiceImpl) GetInterceptor() *Interceptor {
+	return &Interceptor{
+		Name:       InterceptorCache,
+		Middleware: c.middleware,
+	}
+}
+
+func (c *ResponseCacheServiceImpl) middleware(next ActionHandler) ActionHandler {
+	return func(call *ActionCall) {
+
+		p, _ := call.Arg.(*entities.CallParams)
+
+		var policy *CachePolicy
+		if cacheable, ok := call.Action.(ICacheableAction); ok && p != nil {
+			policy = cacheable.GetCachePolicy()
+		}
+		if policy == nil || policy.TTL <= 0 {
+			next(call)
+			c.invalidate(call)
+			return
+		}
+
+		// Ключ строится по проверенному пользователю, поэтому авторизация выполняется до поиска в кэше
+		if err := authenticateCall(call); err != nil {
+			call.Fail(err)
+			return
+		}
+		p, _ = call.Arg.(*entities.CallParams)
+		if p == nil || policy.getScope() == CacheScopeAccount && AuthenticatedSession(p) == nil {
+			next(call)
+			return
+		}
+
+		key := cacheKey(call.Action.GetName(), policy, p)
+		if entry := c.Get(key); entry != nil {
+			// Каждое попадание получает свою копию: экшены и презентеры после кэша могут менять результат
+			call.Result.Res = cloneValue(entry.Res)
+			setCacheInfo(p, entry)
+			return
+		}
+
+		next(call)
+		if call.Result.Err != nil {
+			return
+		}
+		entry := &CacheEntry{
+			Key:       key,
+			Res:       cloneValue(call.Result.Res),
+			ETag:      `W/"` + utils.MD5(utils.ToJson(call.Result.Res)) + `"`,
+			Tags:      policy.Tags,
+			Scope:     policy.getScope(),
+			ExpiresAt: time.Now().Add(policy.TTL),
+		}
+		c.Put(entry)
+		setCacheInfo(p, entry)
+	}
+}
+
+func (c *ResponseCacheServiceImpl) invalidate(call *ActionCall) {
+	if call.Result.Err != nil {
+		return
+	}
+	if invalidating, ok := call.Action.(ICacheInvalidatingAction); ok {
+		if tags := invalidating.GetInvalidatedCacheTags(); len(tags) > 0 {
+			c.InvalidateTags(tags...)
+		}
+	}
+}
+
+func (c *CachePolicy) getScope() CacheScope {
+	if len(c.Scope) == 0 {
+		return CacheScopeAccount
+	}
+	return c.Scope
+}
+
+func cacheKey(action string, policy *CachePolicy, p *entities.CallParams) string {
+
+	params := map[string]interface{}{}
+	if len(policy.Params) == 0 {
+		for k, v := range p.Parameters {
+			params[k] = v
+		}
+	} else {
+		for _, name := range policy.Params {
+			params[name] = p.GetParam(name)
+		}
+	}
+	paramsJson, _ := json.Marshal(params)
+
+	role := ""
+	caller := ""
+	if session := AuthenticatedSession(p); session != nil {
+		if session.Account != nil {
+			role = session.Account.Role
+		}
+		if policy.getScope() == CacheScopeAccount {
+			caller = session.Token
+			if session.Account != nil && len(session.Account.Username) > 0 {
+				caller = session.Account.Username
+			}
+		}
+	}
+
+	return utils.MD5(fmt.Sprintf("%v|%v|%v|%v", action, role, caller, paramsJson))
+}
+
+func setCacheInfo(p *entities.CallParams, entry *CacheEntry) {
+	if context, ok := p.Request.(echo.Context); ok {
+		context.Set(ctxKeyCacheInfo, &CacheInfo{
+			ETag:   entry.ETag,
+			MaxAge: time.Until(entry.ExpiresAt),
+			Scope:  entry.Scope,
+			Public: entry.Scope == CacheScopeShared && AuthenticatedSession(p) == nil,
+		})
+	}
+}
+
+// Выставляет Cache-Control и ETag для закэшированного результата.
+// Если ETag совпадает с If-None-Match - отвечает 304 и возвращает true
+func (c *ResponsePresenterImpl) WriteCacheHeaders(context echo.Context, result *Result) (bool, error) {
+	info, ok := context.Get(ctxKeyCacheInfo).(*CacheInfo)
+	if !ok || result.Err != nil {
+		return false, nil
+	}
+	visibility := "private"
+	if info.Public {
+		visibility = "public"
+	}
+	header := context.Response().Header()
+	header.Set("Cache-Control", fmt.Sprintf("%v, max-age=%v", visibility, int64(info.MaxAge.Seconds())))
+	header.Set("ETag", info.ETag)
+	for _, tag := range strings.Split(context.Request().Header.Get("If-None-Match"), ",") {
+		if tag = strings.TrimSpace(tag); tag == info.ETag || tag == "*" {
+			return true, context.NoContent(http.StatusNotModified)
+		}
+	}
+	return false, nil
+}
+
+// Глубокая копия значения. Неэкспортируемые поля структур копируются как есть
+func cloneValue(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	return cloneReflectValue(reflect.ValueOf(v), map[uintptr]reflect.Value{}).Interface()
+}
+
+func cloneReflectValue(v reflect.Value, visited map[uintptr]reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		if r, ok := visited[v.Pointer()]; ok {
+			return r
+		}
+		r := reflect.New(v.Type().Elem())
+		visited[v.Pointer()] = r
+		r.Elem().Set(cloneReflectValue(v.Elem(), visited))
+		return r
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		r := reflect.New(v.Type()).Elem()
+		r.Set(cloneReflectValue(v.Elem(), visited))
+		return r
+	case reflect.Struct:
+		r := reflect.New(v.Type()).Elem()
+		r.Set(v)
+		for i := 0; i < r.NumField(); i++ {
+			if f := r.Field(i); f.CanSet() {
+				f.Set(cloneReflectValue(v.Field(i), visited))
+			}
+		}
+		return r
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		r := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			r.Index(i).Set(cloneReflectValue(v.Index(i), visited))
+		}
+		return r
+	case reflect.Array:
+		r := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			r.Index(i).Set(cloneReflectValue(v.Index(i), visited))
+		}
+		return r
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		r := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for it := v.MapRange(); it.Next(); {
+			r.SetMapIndex(it.Key(), cloneReflectValue(it.Value(), visited))
+		}
+		return r
+	}
+	return v
+}
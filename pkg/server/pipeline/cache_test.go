@@ -0,0 +1,57 @@
+package pipeline
+
+import (
+	"testing"
+	"time"
+)
+
+type testCatalogItem struct {
+	Name string
+	Tags []string
+}
+
+type testCatalogAction struct {
+	BaseActionImpl
+
+	calls int
+}
+
+func (c *testCatalogAction) GetName() string {
+	return "testCatalog"
+}
+
+func (c *testCatalogAction) GetCachePolicy() *CachePolicy {
+	return &CachePolicy{TTL: time.Hour}
+}
+
+func (c *testCatalogAction) Run(arg interface{}) (interface{}, error) {
+	c.calls++
+	return []*testCatalogItem{{Name: "a", Tags: []string{"new"}}}, nil
+}
+
+// Изменение результата одним вызовом не попадает в кэш и в результаты других вызовов
+func TestCachedResultIsNotShared(t *testing.T) {
+	runner, _, _ := newTestRunner()
+	runner.Use((&ResponseCacheServiceImpl{}).GetInterceptor())
+	action := &testCatalogAction{}
+	run := func() []*testCatalogItem {
+		result := runner.Run(action, func() (interface{}, error) { return newTestJobArg(nil), nil }, nil)
+		if result.Err != nil {
+			t.Fatal(result.Err.Message)
+		}
+		return result.Res.([]*testCatalogItem)
+	}
+
+	first := run()
+	first[0].Name = "изменен"
+	second := run()
+	second[0].Tags[0] = "изменен"
+	third := run()
+
+	if action.calls != 1 {
+		t.Fatalf("экшен выполнен %v раз, ожидалось попадание в кэш", action.calls)
+	}
+	if third[0].Name != "a" || third[0].Tags[0] != "new" {
+		t.Errorf("в кэш попали изменения предыдущих вызовов: %+v", third[0])
+	}
+}
@@ -12,6 +12,15 @@ func (c *ValidateCallerAction) GetName() string {
 	return "Сервис:ВалидацияВызова"
 }
 
+func (c *ValidateCallerAction) GetApiDoc() *ApiDoc {
+	return &ApiDoc{
+		Params: []*ApiParam{
+			{Name: "Caller-Version-Code", In: ApiParamInHeader, Type: "integer", Required: true, Description: "Код версии клиента"},
+			{Name: "Caller-Version-Name", In: ApiParamInHeader, Type: "string", Description: "Название версии клиента"},
+		},
+	}
+}
+
 func (c *ValidateCallerAction) Run(arg interface{}) (interface{}, error) {
 	p := arg.(*entities.CallParams)
 	err := c.CallerValidatorService.Check(p, "")
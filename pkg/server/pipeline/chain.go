@@ -0,0 +1,278 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/goava/pkg/goava/utils"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"strconv"
+	"strings"
+)
+
+type ChainMode string
+
+const (
+	// Аргумент следующего шага - результат предыдущего (даже nil)
+	ChainModeReplace ChainMode = "replace"
+
+	// Все шаги получают исходный аргумент, результаты доступны через ChainResult
+	ChainModePassThrough ChainMode = "passThrough"
+)
+
+const (
+	bagKeyChainResultPrefix = "chain.result."
+	bagKeyChainFailedPrefix = "chain.failed."
+	bagKeyChainSteps        = "chain.steps"
+)
+
+// Экшен, составленный из других экшенов (цепочка, комбинаторы)
+type ICompositeAction interface {
+	GetSteps() []IAction
+}
+
+// Хронометраж шага цепочки, выводится в лог полем steps
+type StepTiming struct {
+	Name   string `json:"name"`
+	TimeMs int64  `json:"ms"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Цепочка экшенов. Для каждого шага: OnBeforeRun, Run, затем OnSuccess либо OnError, затем OnFinished.
+// Первая ошибка прерывает цепочку.
+// Результат каждого шага кладется в Bag аргумента (если аргумент - entities.IBagHolder) и доступен через ChainResult,
+// а по номеру шага - через ChainResultAt
+type ChainedActionImpl struct {
+	BaseActionImpl
+
+	Name    string
+	Actions []IAction
+
+	// По умолчанию ChainModeReplace
+	Mode ChainMode
+
+	// Интерсепторы раннера для цепочки. Если не задан - все, кроме OptIn
+	Interceptors *InterceptorFilter
+
+	// Кэширование результата цепочки. Если не задано - не кэшируется
+	Cache *CachePolicy
+
+	// Теги кэша, сбрасываемые после успешного выполнения (вместе с тегами шагов, реализующих ICacheInvalidatingAction)
+	InvalidatesCacheTags []string
+
+	// Номер первого шага в исходной цепочке (для частей, полученных через SplitAuth)
+	stepOffset int
+}
+
+// Шаг, результат которого не заменяет аргумент следующего шага даже в режиме ChainModeReplace
+type PassThroughActionImpl struct {
+	IAction
+}
+
+func PassThrough(action IAction) *PassThroughActionImpl {
+	return &PassThroughActionImpl{IAction: action}
+}
+
+func (c *PassThroughActionImpl) GetSteps() []IAction {
+	return []IAction{c.IAction}
+}
+
+// Результат шага stepName, выполненного ранее в рамках того же запроса.
+// Если шаг с таким именем выполнялся несколько раз - результат последнего, остальные доступны через ChainResultAt
+func ChainResult(arg interface{}, stepName string) (interface{}, bool) {
+	bag := bagOf(arg)
+	if bag == nil {
+		return nil, false
+	}
+	return bag.Get(bagKeyChainResultPrefix + stepName)
+}
+
+// Результат шага с номером index (с 0) цепочки chainName, выполненного ранее в рамках того же запроса
+func ChainResultAt(arg interface{}, chainName string, index int) (interface{}, bool) {
+	bag := bagOf(arg)
+	if bag == nil {
+		return nil, false
+	}
+	return bag.Get(chainStepResultKey(chainName, index))
+}
+
+func chainStepResultKey(chainName string, index int) string {
+	return bagKeyChainResultPrefix + chainName + "#" + strconv.Itoa(index)
+}
+
+func (c *ChainedActionImpl) setStepResult(bag *entities.Bag, index int, step IAction, result interface{}) {
+	bag.Set(bagKeyChainResultPrefix+step.GetName(), result)
+	bag.Set(chainStepResultKey(c.GetName(), c.stepOffset+index), result)
+}
+
+// Шаги находятся по имени (результаты в Bag, компенсация саги), поэтому одинаковые имена недопустимы
+func checkUniqueStepNames(name string, actions []IAction) error {
+	seen := map[string]bool{}
+	for _, a := range actions {
+		if seen[a.GetName()] {
+			return errs.NewBaseErrorWithReason(fmt.Sprintf("Шаг %v встречается в %v несколько раз", a.GetName(), name), frmclient.ReasonInternal)
+		}
+		seen[a.GetName()] = true
+	}
+	return nil
+}
+
+func bagOf(arg interface{}) *entities.Bag {
+	if holder, ok := arg.(entities.IBagHolder); ok {
+		return holder.GetBag()
+	}
+	return nil
+}
+
+func (c *ChainedActionImpl) GetName() string {
+	if len(c.Name) > 0 {
+		return c.Name
+	}
+	var names []string
+	for _, a := range c.Actions {
+		names = append(names, a.GetName())
+	}
+	return strings.Join(names, "-")
+}
+
+func (c *ChainedActionImpl) GetInterceptorFilter() *InterceptorFilter {
+	return c.Interceptors
+}
+
+func (c *ChainedActionImpl) GetCachePolicy() *CachePolicy {
+	return c.Cache
+}
+
+func (c *ChainedActionImpl) GetInvalidatedCacheTags() []string {
+	r := c.InvalidatesCacheTags
+	for _, step := range c.Actions {
+		if invalidating, ok := step.(ICacheInvalidatingAction); ok {
+			r = append(r, invalidating.GetInvalidatedCacheTags()...)
+		}
+	}
+	return r
+}
+
+func (c *ChainedActionImpl) GetSteps() []IAction {
+	return c.Actions
+}
+
+// Шаги до последнего шага авторизации включительно и остальные шаги. Обе части - цепочки с тем же именем и настройками
+func (c *ChainedActionImpl) SplitAuth() (IAction, IAction) {
+	last := -1
+	for i, step := range c.Actions {
+		if isAuthAction(step) {
+			last = i
+		}
+	}
+	if last < 0 || last == len(c.Actions)-1 {
+		return nil, c
+	}
+	return c.withSteps(c.Actions[:last+1], 0), c.withSteps(c.Actions[last+1:], last+1)
+}
+
+func (c *ChainedActionImpl) withSteps(actions []IAction, offset int) *ChainedActionImpl {
+	return &ChainedActionImpl{
+		Name:                 c.GetName(),
+		Actions:              actions,
+		Mode:                 c.Mode,
+		Interceptors:         c.Interceptors,
+		Cache:                c.Cache,
+		InvalidatesCacheTags: c.InvalidatesCacheTags,
+		stepOffset:           c.stepOffset + offset,
+	}
+}
+
+func (c *ChainedActionImpl) Run(arg interface{}) (interface{}, error) {
+
+	bag := bagOf(arg)
+	if bag == nil {
+		bag = entities.NewBag()
+	}
+	bag.Delete(bagKeyChainFailedPrefix + c.GetName())
+
+	stepArg := arg
+	var lastResult interface{}
+	for i, step := range c.Actions {
+
+		startTime := utils.CurrentTimeMillis()
+		r, errObj := runStep(step, stepArg)
+		timing := &StepTiming{Name: step.GetName(), TimeMs: utils.CurrentTimeMillis() - startTime}
+
+		if errObj != nil {
+			timing.Reason = errObj.Reason
+			addStepTiming(bag, timing)
+			bag.Set(bagKeyChainFailedPrefix+c.GetName(), step)
+			return nil, errObj.Error
+		}
+		addStepTiming(bag, timing)
+
+		c.setStepResult(bag, i, step, r)
+		lastResult = r
+		if _, passThrough := step.(*PassThroughActionImpl); !passThrough && c.Mode != ChainModePassThrough {
+			stepArg = r
+		}
+	}
+
+	return lastResult, nil
+}
+
+// Выполняет экшен с хуками: OnBeforeRun, Run, OnSuccess либо OnError, OnFinished
+func runStep(step IAction, arg interface{}) (interface{}, *Err) {
+
+	step.OnBeforeRun(arg)
+	r, err := step.Run(arg)
+
+	var errObj *Err
+	if err != nil {
+		r = nil
+		errObj = &Err{
+			Error:   err,
+			Message: err.Error(),
+			Details: utils.GetErrorFullInfo(err),
+		}
+		if be := errs.FindBaseError(err); be != nil {
+			errObj.Reason = be.Reason
+		}
+		step.OnError(arg, errObj)
+	} else {
+		step.OnSuccess(arg, r)
+	}
+
+	step.OnFinished(arg, &Result{
+		Res: r,
+		Err: errObj,
+	})
+	return r, errObj
+}
+
+// Алерт готовит шаг, на котором цепочка прервалась
+func (c *ChainedActionImpl) PrepareErrorAlert(alertParams *core.AlertParams, err *Err, arg interface{}) {
+	bag := bagOf(arg)
+	if bag == nil {
+		return
+	}
+	if failed, ok := bag.Get(bagKeyChainFailedPrefix + c.GetName()); ok {
+		failed.(IAction).PrepareErrorAlert(alertParams, err, arg)
+	}
+}
+
+func (c *ChainedActionImpl) GetLogFields(arg interface{}) map[string]interface{} {
+	bag := bagOf(arg)
+	if bag == nil {
+		return nil
+	}
+	steps, ok := bag.Get(bagKeyChainSteps)
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{"steps": steps}
+}
+
+func addStepTiming(bag *entities.Bag, timing *StepTiming) {
+	bag.Update(bagKeyChainSteps, func(value interface{}) interface{} {
+		steps, _ := value.([]*StepTiming)
+		return append(steps, timing)
+	})
+}
@@ -0,0 +1,60 @@
+package pipeline
+
+import (
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"testing"
+)
+
+// Шаг с одним и тем же именем для разных значений
+type testValueStep struct {
+	BaseActionImpl
+
+	value string
+}
+
+func (c *testValueStep) GetName() string {
+	return "value"
+}
+
+func (c *testValueStep) Run(arg interface{}) (interface{}, error) {
+	if s, ok := arg.(string); ok {
+		return s + c.value, nil
+	}
+	return c.value, nil
+}
+
+func TestChainModes(t *testing.T) {
+	steps := []IAction{&testValueStep{value: "a"}, &testValueStep{value: "b"}}
+	for _, test := range []struct {
+		mode ChainMode
+		want string
+	}{{ChainModeReplace, "ab"}, {ChainModePassThrough, "b"}} {
+		r, err := (&ChainedActionImpl{Name: "chain", Actions: steps, Mode: test.mode}).Run(&entities.CallParams{Bag: entities.NewBag()})
+		if err != nil || r != test.want {
+			t.Errorf("%v: результат %v, ожидался %v (%v)", test.mode, r, test.want, err)
+		}
+	}
+}
+
+// Повторяющийся шаг не затирает результат предыдущего, в том числе после SplitAuth
+func TestChainResultAt(t *testing.T) {
+	chain := &ChainedActionImpl{Name: "chain", Mode: ChainModePassThrough, Actions: []IAction{
+		&ValidateCallerAction{CallerValidatorService: &testCallerValidator{}},
+		&testValueStep{value: "a"},
+		&testValueStep{value: "b"},
+	}}
+	_, rest := chain.SplitAuth()
+	p := &entities.CallParams{Bag: entities.NewBag()}
+	if _, err := rest.Run(p); err != nil {
+		t.Fatal(err)
+	}
+
+	for index, want := range map[int]string{1: "a", 2: "b"} {
+		if r, _ := ChainResultAt(p, "chain", index); r != want {
+			t.Errorf("шаг %v: результат %v, ожидался %v", index, r, want)
+		}
+	}
+	if r, _ := ChainResult(p, "value"); r != "b" {
+		t.Errorf("по имени: результат %v, ожидался результат последнего шага", r)
+	}
+}
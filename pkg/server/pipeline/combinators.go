@@ -0,0 +1,440 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/echo-http"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+const ReasonTimeout = "REASON_TIMEOUT"
+
+// Общая часть комбинаторов. Каждая ветка выполняется через Runner (отдельная строка лога, интерсепторы, обработка ошибок),
+// поэтому он обязателен: конструкторы комбинаторов принимают его первым аргументом. Алерты по веткам не отправляются:
+// неудачная попытка Retry или ветка Fallback может закончиться успехом, а итоговую ошибку отправит в алерт внешний вызов
+type CombinatorActionImpl struct {
+	BaseActionImpl
+
+	Name   string
+	Runner IActionRunner
+}
+
+func (c *CombinatorActionImpl) runBranch(action IAction, arg interface{}) (interface{}, error) {
+	if c.Runner == nil {
+		return nil, errs.NewBaseErrorWithReason(fmt.Sprintf("Не задан Runner комбинатора для ветки %v", action.GetName()), frmclient.ReasonInternal)
+	}
+	result := c.Runner.RunWithoutAlerts(action, func() (interface{}, error) {
+		return arg, nil
+	}, nil)
+	if result.Err != nil {
+		return nil, result.Err.Error
+	}
+	return result.Res, nil
+}
+
+// Ветка в отдельной горутине: паника превращается в PanicError, а не роняет процесс
+func (c *CombinatorActionImpl) runBranchAsync(action IAction, arg interface{}, done func(r interface{}, err error)) {
+	go func() {
+		var r interface{}
+		var err error
+		defer func() {
+			if p := recover(); p != nil {
+				err = NewPanicError(action.GetName(), p)
+			}
+			done(r, err)
+		}()
+		r, err = c.runBranch(action, arg)
+	}()
+}
+
+func (c *CombinatorActionImpl) nameOr(kind string, actions ...IAction) string {
+	if len(c.Name) > 0 {
+		return c.Name
+	}
+	var names []string
+	for _, a := range actions {
+		if a != nil {
+			names = append(names, a.GetName())
+		}
+	}
+	return kind + "(" + strings.Join(names, ",") + ")"
+}
+
+func callParamsOf(arg interface{}) *entities.CallParams {
+	p, _ := arg.(*entities.CallParams)
+	return p
+}
+
+// Копия аргумента для ветки в отдельной горутине: шаги (например, GetUserAction) меняют Caller и параметры.
+// Bag остается общим
+func branchArg(arg interface{}) interface{} {
+	p, ok := arg.(*entities.CallParams)
+	if !ok || p == nil {
+		return arg
+	}
+	r := *p
+	if p.Caller != nil {
+		caller := *p.Caller
+		r.Caller = &caller
+	}
+	if p.Parameters != nil {
+		r.Parameters = make(map[string][]interface{}, len(p.Parameters))
+		for k, v := range p.Parameters {
+			r.Parameters[k] = v
+		}
+	}
+	return &r
+}
+
+// Контекст http-запроса либо grpc-вызова. Для прочих аргументов - context.Background()
+func callContext(arg interface{}) context.Context {
+	if p := callParamsOf(arg); p != nil {
+		switch r := p.Request.(type) {
+		case echo.Context:
+			return r.Request().Context()
+		case context.Context:
+			return r
+		}
+	}
+	return context.Background()
+}
+
+// Ошибки веток Parallel в режиме CollectAll. Причина - причина первой ошибки
+type ParallelError struct {
+	errs.BaseError
+
+	Errors []error
+}
+
+// Запускает ветки параллельно с одним аргументом. Результат - Merge(результаты в порядке веток),
+// по умолчанию []interface{}.
+// Без CollectAll возвращается первая ошибка (оставшиеся ветки доработают в фоне),
+// с CollectAll - ждет все ветки и возвращает ParallelError
+type ParallelActionImpl struct {
+	CombinatorActionImpl
+
+	Actions    []IAction
+	CollectAll bool
+	Merge      func(results []interface{}) (interface{}, error)
+}
+
+func Parallel(runner IActionRunner, actions ...IAction) *ParallelActionImpl {
+	return &ParallelActionImpl{CombinatorActionImpl: CombinatorActionImpl{Runner: runner}, Actions: actions}
+}
+
+func (c *ParallelActionImpl) GetName() string {
+	return c.nameOr("Parallel", c.Actions...)
+}
+
+func (c *ParallelActionImpl) GetSteps() []IAction {
+	return c.Actions
+}
+
+func (c *ParallelActionImpl) Run(arg interface{}) (interface{}, error) {
+
+	type branchResult struct {
+		index int
+		r     interface{}
+		err   error
+	}
+	done := make(chan *branchResult, len(c.Actions))
+	for i, a := range c.Actions {
+		index := i
+		c.runBranchAsync(a, branchArg(arg), func(r interface{}, err error) {
+			done <- &branchResult{index: index, r: r, err: err}
+		})
+	}
+
+	results := make([]interface{}, len(c.Actions))
+	var failures []error
+	for range c.Actions {
+		br := <-done
+		if br.err != nil {
+			if !c.CollectAll {
+				return nil, br.err
+			}
+			failures = append(failures, br.err)
+			continue
+		}
+		results[br.index] = br.r
+	}
+
+	if len(failures) > 0 {
+		reason := frmclient.ReasonInternal
+		if be := errs.FindBaseError(failures[0]); be != nil {
+			reason = be.Reason
+		}
+		var msgs []string
+		for _, e := range failures {
+			msgs = append(msgs, e.Error())
+		}
+		return nil, &ParallelError{
+			BaseError: *errs.NewBaseErrorWithReason(strings.Join(msgs, "; "), reason),
+			Errors:    failures,
+		}
+	}
+
+	if c.Merge != nil {
+		return c.Merge(results)
+	}
+	return results, nil
+}
+
+// Условие над параметрами вызова. Если аргумент - не *entities.CallParams, получает nil
+type Predicate func(p *entities.CallParams) bool
+
+// Выполняет Then либо Else. Если Else не задан - возвращает аргумент без изменений
+type IfActionImpl struct {
+	CombinatorActionImpl
+
+	Predicate Predicate
+	Then      IAction
+	Else      IAction
+}
+
+func If(runner IActionRunner, predicate Predicate, then IAction, otherwise IAction) *IfActionImpl {
+	return &IfActionImpl{CombinatorActionImpl: CombinatorActionImpl{Runner: runner}, Predicate: predicate, Then: then, Else: otherwise}
+}
+
+func (c *IfActionImpl) GetName() string {
+	return c.nameOr("If", c.Then, c.Else)
+}
+
+func (c *IfActionImpl) GetSteps() []IAction {
+	return nonNilActions(c.Then, c.Else)
+}
+
+func (c *IfActionImpl) Run(arg interface{}) (interface{}, error) {
+	branch := c.Else
+	if c.Predicate(callParamsOf(arg)) {
+		branch = c.Then
+	}
+	if branch == nil {
+		return arg, nil
+	}
+	return c.runBranch(branch, arg)
+}
+
+// Выбирает ветку по значению Selector. Если ветки нет и Default не задан - возвращает аргумент без изменений
+type SwitchActionImpl struct {
+	CombinatorActionImpl
+
+	Selector func(p *entities.CallParams) string
+	Cases    map[string]IAction
+	Default  IAction
+}
+
+func Switch(runner IActionRunner, selector func(p *entities.CallParams) string, cases map[string]IAction, defaultAction IAction) *SwitchActionImpl {
+	return &SwitchActionImpl{CombinatorActionImpl: CombinatorActionImpl{Runner: runner}, Selector: selector, Cases: cases, Default: defaultAction}
+}
+
+func (c *SwitchActionImpl) GetName() string {
+	return c.nameOr("Switch", c.GetSteps()...)
+}
+
+func (c *SwitchActionImpl) GetSteps() []IAction {
+	var keys []string
+	for k := range c.Cases {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var r []IAction
+	for _, k := range keys {
+		r = append(r, c.Cases[k])
+	}
+	return nonNilActions(append(r, c.Default)...)
+}
+
+func (c *SwitchActionImpl) Run(arg interface{}) (interface{}, error) {
+	branch, ok := c.Cases[c.Selector(callParamsOf(arg))]
+	if !ok {
+		branch = c.Default
+	}
+	if branch == nil {
+		return arg, nil
+	}
+	return c.runBranch(branch, arg)
+}
+
+// Пробует экшены по очереди, пока один не выполнится успешно. Возвращает ошибку последнего.
+// ShouldFallback решает, переходить ли к следующему экшену (по умолчанию - при любой ошибке)
+type FallbackActionImpl struct {
+	CombinatorActionImpl
+
+	Actions        []IAction
+	ShouldFallback func(err error) bool
+}
+
+func Fallback(runner IActionRunner, actions ...IAction) *FallbackActionImpl {
+	return &FallbackActionImpl{CombinatorActionImpl: CombinatorActionImpl{Runner: runner}, Actions: actions}
+}
+
+func (c *FallbackActionImpl) GetName() string {
+	return c.nameOr("Fallback", c.Actions...)
+}
+
+func (c *FallbackActionImpl) GetSteps() []IAction {
+	return c.Actions
+}
+
+func (c *FallbackActionImpl) Run(arg interface{}) (interface{}, error) {
+	var err error
+	for _, a := range c.Actions {
+		var r interface{}
+		r, err = c.runBranch(a, arg)
+		if err == nil {
+			return r, nil
+		}
+		if c.ShouldFallback != nil && !c.ShouldFallback(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// Повторяет экшен при временных ошибках с экспоненциальной задержкой и джиттером.
+// Временная ошибка - причина из RetryableReasons, а если он пуст - причина с Retryable=true в реестре
+// либо из GetRetryableReasons экшена (IRetryableReasonsProvider).
+// Если запрос отменен во время ожидания, возвращает ReasonCanceled
+type RetryActionImpl struct {
+	CombinatorActionImpl
+
+	Action      IAction
+	MaxAttempts int
+
+	// Задержка перед второй попыткой, далее умножается на Multiplier (по умолчанию 2) до MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Multiplier float64
+
+	// Доля задержки (0..1), на которую она случайно уменьшается
+	Jitter float64
+
+	RetryableReasons []string
+	ReasonRegistry   IReasonRegistryService
+}
+
+func Retry(runner IActionRunner, action IAction, maxAttempts int, backoff time.Duration) *RetryActionImpl {
+	return &RetryActionImpl{CombinatorActionImpl: CombinatorActionImpl{Runner: runner}, Action: action, MaxAttempts: maxAttempts, Backoff: backoff, Jitter: 0.2}
+}
+
+func (c *RetryActionImpl) GetName() string {
+	return c.nameOr("Retry", c.Action)
+}
+
+func (c *RetryActionImpl) GetSteps() []IAction {
+	return []IAction{c.Action}
+}
+
+func (c *RetryActionImpl) Run(arg interface{}) (interface{}, error) {
+	ctx := callContext(arg)
+	delay := c.Backoff
+	for attempt := 1; ; attempt++ {
+		r, err := c.runBranch(c.Action, arg)
+		if err == nil || attempt >= c.MaxAttempts || !c.isRetryable(err) {
+			return r, err
+		}
+		timer := time.NewTimer(c.withJitter(delay))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, errs.NewBaseErrorFromCauseMsgReason(ctx.Err(), "Вызов отменен клиентом", ReasonCanceled)
+		}
+		delay = c.nextDelay(delay)
+	}
+}
+
+func (c *RetryActionImpl) isRetryable(err error) bool {
+	be := errs.FindBaseError(err)
+	if be == nil {
+		return false
+	}
+	if len(c.RetryableReasons) > 0 {
+		for _, reason := range c.RetryableReasons {
+			if reason == be.Reason {
+				return true
+			}
+		}
+		return false
+	}
+	return isRetryableErrFor(c.ReasonRegistry, c.Action, &Err{Reason: be.Reason})
+}
+
+func (c *RetryActionImpl) nextDelay(delay time.Duration) time.Duration {
+	multiplier := c.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	delay = time.Duration(float64(delay) * multiplier)
+	if c.MaxBackoff > 0 && delay > c.MaxBackoff {
+		delay = c.MaxBackoff
+	}
+	return delay
+}
+
+func (c *RetryActionImpl) withJitter(delay time.Duration) time.Duration {
+	if c.Jitter <= 0 || delay <= 0 {
+		return delay
+	}
+	return delay - time.Duration(rand.Float64()*c.Jitter*float64(delay))
+}
+
+// Ограничивает время выполнения экшена. По истечении возвращает ошибку ReasonTimeout,
+// сам экшен при этом доработает в фоне
+type TimeoutActionImpl struct {
+	CombinatorActionImpl
+
+	Action  IAction
+	Timeout time.Duration
+}
+
+func Timeout(runner IActionRunner, action IAction, timeout time.Duration) *TimeoutActionImpl {
+	return &TimeoutActionImpl{CombinatorActionImpl: CombinatorActionImpl{Runner: runner}, Action: action, Timeout: timeout}
+}
+
+func (c *TimeoutActionImpl) GetName() string {
+	return c.nameOr("Timeout", c.Action)
+}
+
+func (c *TimeoutActionImpl) GetSteps() []IAction {
+	return []IAction{c.Action}
+}
+
+func (c *TimeoutActionImpl) Run(arg interface{}) (interface{}, error) {
+
+	type branchResult struct {
+		r   interface{}
+		err error
+	}
+	done := make(chan *branchResult, 1)
+	// Ветка может доработать в фоне после таймаута, поэтому получает свою копию аргумента
+	c.runBranchAsync(c.Action, branchArg(arg), func(r interface{}, err error) {
+		done <- &branchResult{r: r, err: err}
+	})
+
+	timer := time.NewTimer(c.Timeout)
+	defer timer.Stop()
+	select {
+	case br := <-done:
+		return br.r, br.err
+	case <-timer.C:
+		return nil, errs.NewBaseErrorWithReason(fmt.Sprintf("Превышено время выполнения %v (%v)", c.Action.GetName(), c.Timeout), ReasonTimeout)
+	}
+}
+
+func nonNilActions(actions ...IAction) []IAction {
+	var r []IAction
+	for _, a := range actions {
+		if a != nil {
+			r = append(r, a)
+		}
+	}
+	return r
+}
@@ -0,0 +1,88 @@
+package pipeline
+
+import (
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Первые failures вызовов завершаются временной ошибкой
+type testFlakyAction struct {
+	BaseActionImpl
+
+	name     string
+	failures int32
+	calls    int32
+}
+
+func (c *testFlakyAction) GetName() string {
+	return c.name
+}
+
+func (c *testFlakyAction) Run(arg interface{}) (interface{}, error) {
+	if atomic.AddInt32(&c.calls, 1) <= c.failures {
+		return nil, errs.NewBaseErrorWithReason(c.name+" недоступен", frmclient.ReasonServerUnavailable)
+	}
+	return c.name, nil
+}
+
+func runTestCall(runner IActionRunner, action IAction) *Result {
+	return runner.Run(action, func() (interface{}, error) {
+		return &entities.CallParams{Parameters: map[string][]interface{}{}, Bag: entities.NewBag()}, nil
+	}, nil)
+}
+
+func TestRetryDoesNotAlertRecoveredAttempts(t *testing.T) {
+	runner, _, errorHandler := newTestRunner()
+	action := &testFlakyAction{name: "flaky", failures: 2}
+
+	result := runTestCall(runner, Retry(runner, action, 3, time.Millisecond))
+	if result.Err != nil || result.Res != "flaky" {
+		t.Fatalf("ожидался успех третьей попытки, получено %v", result.Err)
+	}
+	if errorHandler.count() != 0 {
+		t.Errorf("отправлено %v алертов по неудачным попыткам", errorHandler.count())
+	}
+}
+
+func TestRetryAlertsFinalFailureOnce(t *testing.T) {
+	runner, _, errorHandler := newTestRunner()
+	action := &testFlakyAction{name: "down", failures: 10}
+
+	if result := runTestCall(runner, Retry(runner, action, 3, time.Millisecond)); result.Err == nil {
+		t.Fatal("ожидалась ошибка")
+	}
+	if atomic.LoadInt32(&action.calls) != 3 {
+		t.Errorf("выполнено %v попыток, ожидалось 3", action.calls)
+	}
+	if errorHandler.count() != 1 {
+		t.Errorf("отправлено %v алертов, ожидался 1", errorHandler.count())
+	}
+}
+
+func TestFallbackDoesNotAlertRecoveredBranch(t *testing.T) {
+	runner, _, errorHandler := newTestRunner()
+
+	result := runTestCall(runner, Fallback(runner, &testFlakyAction{name: "a", failures: 1}, &testFlakyAction{name: "b"}))
+	if result.Err != nil || result.Res != "b" {
+		t.Fatalf("ожидался результат b, получено %v, %v", result.Res, result.Err)
+	}
+	if errorHandler.count() != 0 {
+		t.Errorf("отправлено %v алертов по ветке a", errorHandler.count())
+	}
+}
+
+func TestParallelAlertsFailedBranchOnce(t *testing.T) {
+	runner, _, errorHandler := newTestRunner()
+
+	result := runTestCall(runner, Parallel(runner, &testFlakyAction{name: "a"}, &testFlakyAction{name: "b", failures: 1}))
+	if result.Err == nil {
+		t.Fatal("ожидалась ошибка ветки b")
+	}
+	if errorHandler.count() != 1 {
+		t.Errorf("отправлено %v алертов, ожидался 1", errorHandler.count())
+	}
+}
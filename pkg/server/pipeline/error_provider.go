@@ -8,26 +8,51 @@ import (
 	"github.com/itskovichanton/goava/pkg/goava/errs"
 	"github.com/itskovichanton/goava/pkg/goava/utils"
 	"github.com/itskovichanton/server/pkg/server/filestorage"
+	"github.com/itskovichanton/server/pkg/server/i18n"
+	"strings"
 )
 
 type ErrorProviderServiceImpl struct {
 	IErrorProviderService
 
-	Config *core.Config
+	Config         *core.Config
+	MessageCatalog i18n.IMessageCatalogService
+	ReasonRegistry IReasonRegistryService
 }
 
 type IErrorProviderService interface {
 	ProvideError(err error) *Err
 }
 
+// Провайдер ошибок, умеющий переводить сообщение на язык вызывающего
+type ILocalizedErrorProviderService interface {
+	ProvideLocalizedError(err error, lang string) *Err
+}
+
 type Err struct {
 	Error   error  `json:"-"`
 	Reason  string `json:"reason"`
 	Message string `json:"message"`
 	Details string `json:"details,omitempty"`
+
+	// Шаги саги, компенсация которых не удалась
+	CompensationFailures []*CompensationFailure `json:"compensationFailures,omitempty"`
 }
 
 func (c *ErrorProviderServiceImpl) ProvideError(err error) *Err {
+	return c.ProvideLocalizedError(err, "")
+}
+
+// Сообщение ищется в каталоге по Err.Reason (для ошибок валидации - VALIDATION.<причина>), язык - lang либо язык по умолчанию
+func (c *ErrorProviderServiceImpl) ProvideLocalizedError(err error, lang string) *Err {
+	var sagaErr *SagaError
+	if errors.As(err, &sagaErr) && sagaErr.Cause != nil {
+		// Причина и сообщение - от ошибки шага, на котором прервалась сага
+		r := c.ProvideLocalizedError(sagaErr.Cause, lang)
+		r.Error = err
+		r.CompensationFailures = sagaErr.CompensationFailures
+		return r
+	}
 	r := &Err{
 		Error:   err,
 		Reason:  c.getErrReason(err),
@@ -36,21 +61,91 @@ func (c *ErrorProviderServiceImpl) ProvideError(err error) *Err {
 	}
 	if len(r.Message) == 0 {
 		r.Message = frmclient.InternalErrorMessage
+		if info := reasonRegistryOrDefault(c.ReasonRegistry).Get(r.Reason); info != nil && len(info.DefaultMessage) > 0 {
+			r.Message = info.DefaultMessage
+		}
+	}
+	if c.MessageCatalog != nil {
+		c.localize(r, lang)
 	}
 	return r
 }
 
+func (c *ErrorProviderServiceImpl) localize(r *Err, lang string) {
+
+	switch ex := r.Error.(type) {
+	case *validation.ValidationError:
+		if msg, ok := c.translateValidationError(ex, lang); ok {
+			r.Message = msg
+		}
+		return
+	case *ValidationErrors:
+		// Исходная ошибка может попасть в несколько ответов на разных языках (например, повтор по ключу идемпотентности),
+		// поэтому переводится копия
+		localized := &ValidationErrors{BaseError: ex.BaseError, Errors: make([]*validation.ValidationError, len(ex.Errors))}
+		var msgs []string
+		for i, v := range ex.Errors {
+			e := *v
+			if msg, ok := c.translateValidationError(v, lang); ok {
+				e.Message = msg
+			}
+			localized.Errors[i] = &e
+			msgs = append(msgs, e.Param+": "+e.Message)
+		}
+		r.Error = localized
+		r.Message = strings.Join(msgs, "; ")
+		return
+	}
+
+	params := map[string]interface{}{"reason": r.Reason}
+	keys := []string{r.Reason}
+	var cure *CallerUpdateRequiredError
+	if errors.As(r.Error, &cure) {
+		keys = []string{frmclient.ReasonCallerUpdateRequired, r.Reason}
+		params["updateUrl"] = cure.UpdateUrl
+		if cure.RequiredVersion != nil {
+			params["requiredVersion"] = cure.RequiredVersion.Name
+		}
+	} else if be := errs.FindBaseError(r.Error); be != nil && len(be.Reason) > 0 && be.Reason != r.Reason {
+		keys = []string{be.Reason, r.Reason}
+	}
+
+	for _, key := range keys {
+		if msg, ok := c.MessageCatalog.Translate(lang, key, params); ok {
+			r.Message = msg
+			return
+		}
+	}
+}
+
+func (c *ErrorProviderServiceImpl) translateValidationError(e *validation.ValidationError, lang string) (string, bool) {
+	params := map[string]interface{}{
+		"param":        e.Param,
+		"invalidValue": e.InvalidValue,
+		"reason":       e.Reason,
+	}
+	msg, ok := c.MessageCatalog.Translate(lang, frmclient.ReasonValidation+"."+e.Reason, params)
+	if !ok {
+		msg, ok = c.MessageCatalog.Translate(lang, frmclient.ReasonValidation, params)
+	}
+	return msg, ok
+}
+
 func (c *ErrorProviderServiceImpl) getErrDetails(err error) string {
 	if c.Config.IsProfileProd() {
 		return ""
 	}
+	var panicErr *PanicError
+	if errors.As(err, &panicErr) {
+		return panicErr.GetDetails()
+	}
 	return utils.GetErrorFullInfo(err)
 }
 
 func (c *ErrorProviderServiceImpl) getErrReason(err error) string {
 
 	switch err.(type) {
-	case *validation.ValidationError:
+	case *validation.ValidationError, *ValidationErrors:
 		return frmclient.ReasonValidation
 	case *CallerUpdateRequiredError:
 		return frmclient.ReasonAccessDenied
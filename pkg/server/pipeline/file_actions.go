@@ -18,6 +18,17 @@ func (c *GetFileAction) GetName() string {
 	return "GetFile"
 }
 
+func (c *GetFileAction) GetApiDoc() *ApiDoc {
+	return &ApiDoc{
+		Summary: "Возвращает файл из файлового хранилища",
+		Params: []*ApiParam{
+			{Name: "key", Type: "string", Required: true, Description: "Ключ файла"},
+			{Name: "lastModifiedTimeStampUTC", Type: "int64", Description: "Время последней загрузки файла клиентом (unix, UTC)"},
+			{Name: "if-modified-since", In: ApiParamInHeader, Type: "int64"},
+		},
+	}
+}
+
 func (c *GetFileAction) Run(arg interface{}) (interface{}, error) {
 	p := arg.(*entities.CallParams)
 	key, err := validation.CheckNotEmptyStr("key", p.GetParamStr("key"))
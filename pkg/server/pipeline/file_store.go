@@ -0,0 +1,52 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Общие функции файловых хранилищ (задачи, саги): каждая запись - отдельный JSON-файл в dir.
+// В записях бывают параметры вызовов, поэтому каталог и файлы доступны только владельцу процесса.
+// Блокировки - на стороне хранилища
+
+func saveJsonFile(dir string, id string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	// Запись через временный файл, чтобы падение не оставило обрезанный JSON
+	tmp := jsonFileName(dir, id) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, jsonFileName(dir, id))
+}
+
+func loadJsonFile(fileName string, v interface{}) error {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func listJsonFiles(dir string) ([]string, error) {
+	return filepath.Glob(filepath.Join(dir, "*.json"))
+}
+
+func deleteJsonFile(dir string, id string) error {
+	err := os.Remove(jsonFileName(dir, id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func jsonFileName(dir string, id string) string {
+	return filepath.Join(dir, strings.ReplaceAll(id, string(filepath.Separator), "_")+".json")
+}
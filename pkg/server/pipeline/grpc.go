@@ -6,6 +6,7 @@ import (
 	"github.com/itskovichanton/goava/pkg/goava/utils"
 	"github.com/itskovichanton/server/pkg/server"
 	"github.com/itskovichanton/server/pkg/server/entities"
+	"github.com/itskovichanton/server/pkg/server/i18n"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"strconv"
@@ -74,6 +75,9 @@ type EntityFromGRPCReaderServiceImpl struct {
 
 func (c *EntityFromGRPCReaderServiceImpl) readLanguage(r metadata.MD) string {
 	lang := utils.GetFirstElementStr(r.Get("lang"))
+	if len(lang) == 0 {
+		lang = utils.GetFirstElementStr(i18n.ParseAcceptLanguage(utils.GetFirstElementStr(r.Get("accept-language"))))
+	}
 	if len(lang) == 0 {
 		lang = c.Config.Server.DefaultLang
 	}
@@ -105,7 +109,9 @@ func (c *EntityFromGRPCReaderServiceImpl) ReadCallParams(ctx context.Context) (*
 
 	return &entities.CallParams{
 		Request: ctx,
+		Headers: md,
 		URL:     peerInfo.Addr.String(),
 		Caller:  c.ReadCaller(md, peerInfo),
+		Bag:     entities.NewBag(),
 	}, nil
 }
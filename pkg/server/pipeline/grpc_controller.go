@@ -3,6 +3,7 @@ package pipeline
 import (
 	"context"
 	"fmt"
+	"github.com/itskovichanton/core/pkg/core/logger"
 	"github.com/itskovichanton/server/pkg/server"
 	"github.com/itskovichanton/server/pkg/server/entities"
 	"google.golang.org/grpc"
@@ -24,7 +25,16 @@ type GrpcControllerImpl struct {
 	Config                      *server.Config
 	ActionRunner                IActionRunner
 	EntityFromGRPCReaderService IEntityFromGRPCReaderService
-	routerModifiers             []func(s *grpc.Server)
+	ReasonRegistry              IReasonRegistryService
+	JobQueue                    IJobQueueService
+	Scheduler                   ISchedulerService
+	AlertAggregator             IAlertAggregatorService
+	LoggerService               logger.ILoggerService
+	Redactor                    IRedactorService
+
+	// Каждое N-е сообщение потока пишется в лог экшенов. 0 - сообщения потоков не логируются
+	StreamLogEvery  int
+	routerModifiers []func(s *grpc.Server)
 }
 
 func (c *GrpcControllerImpl) AddRouterModifier(modifier func(e *grpc.Server)) {
@@ -46,6 +56,21 @@ func (c *GrpcControllerImpl) Start() error {
 	for _, modifier := range c.routerModifiers {
 		modifier(s)
 	}
+	if c.JobQueue != nil {
+		if err := c.JobQueue.Start(c.ActionRunner); err != nil {
+			return err
+		}
+	}
+	if c.Scheduler != nil {
+		if err := c.Scheduler.Start(c.ActionRunner); err != nil {
+			return err
+		}
+	}
+	if c.AlertAggregator != nil {
+		if err := c.AlertAggregator.Start(); err != nil {
+			return err
+		}
+	}
 
 	println(fmt.Sprintf("%v grpc server started on port %v", c.Config.CoreConfig.App.Name, c.Config.Server.GrpcPort))
 	if err := s.Serve(lis); err != nil {
@@ -84,3 +109,8 @@ func (c *GrpcControllerImpl) RunByActionAndErrorProvider(ctx context.Context, ac
 func (c *GrpcControllerImpl) RunByActionProvider(ctx context.Context, action func(args *entities.CallParams) IAction) *Result {
 	return c.RunByActionAndErrorProvider(ctx, action, nil)
 }
+
+// Переводит ошибку результата в статус gRPC с кодом из реестра причин
+func (c *GrpcControllerImpl) GetGrpcError(result *Result) error {
+	return GetGrpcError(c.ReasonRegistry, result.Err)
+}
@@ -0,0 +1,232 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core/logger"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"google.golang.org/grpc"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Клиент отменил вызов либо разорвал соединение
+const ReasonCanceled = "REASON_CANCELED"
+
+// Экшен потокового RPC. Run выполняется при открытии потока (в цепочке перед ним обычно ValidateCallerAction и GetUserAction),
+// затем вызываются хуки потока. Экшен может быть последним шагом ChainedActionImpl
+type IGrpcStreamAction interface {
+	IAction
+
+	// Поток открыт. Для server-streaming здесь отправляются сообщения клиенту
+	OnStreamStart(stream *GrpcStream) error
+
+	// Очередное сообщение клиента (client-streaming и bidi)
+	OnStreamMessage(stream *GrpcStream, msg interface{}) error
+
+	// Поток завершен с ошибкой err либо успешно (nil). Вызывается и при ошибке открытия
+	OnStreamEnd(stream *GrpcStream, err error)
+}
+
+type BaseGrpcStreamActionImpl struct {
+	BaseActionImpl
+}
+
+func (c *BaseGrpcStreamActionImpl) Run(arg interface{}) (interface{}, error) {
+	return arg, nil
+}
+
+func (c *BaseGrpcStreamActionImpl) OnStreamStart(stream *GrpcStream) error {
+	return nil
+}
+
+func (c *BaseGrpcStreamActionImpl) OnStreamMessage(stream *GrpcStream, msg interface{}) error {
+	return nil
+}
+
+func (c *BaseGrpcStreamActionImpl) OnStreamEnd(stream *GrpcStream, err error) {}
+
+// Итог потока, попадает в Result и лог экшена
+type GrpcStreamStats struct {
+	Received int64 `json:"received"`
+	Sent     int64 `json:"sent"`
+}
+
+// Открытый поток. CallParams читаются из метаданных один раз на весь поток
+type GrpcStream struct {
+	Params *entities.CallParams
+
+	// Запрос server-streaming вызова, для client-streaming и bidi - nil
+	Request interface{}
+
+	// Результат Run экшена
+	Opened interface{}
+
+	stream     grpc.ServerStream
+	action     IAction
+	controller *GrpcControllerImpl
+	sendLock   sync.Mutex
+	received   int64
+	sent       int64
+}
+
+func (c *GrpcStream) Context() context.Context {
+	return c.stream.Context()
+}
+
+// Отправляет сообщение клиенту. Безопасно вызывать из нескольких горутин
+func (c *GrpcStream) Send(msg interface{}) error {
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	if err := c.stream.SendMsg(msg); err != nil {
+		return err
+	}
+	c.controller.logStreamMessage(c.action, "out", atomic.AddInt64(&c.sent, 1), msg)
+	return nil
+}
+
+func (c *GrpcStream) GetStats() *GrpcStreamStats {
+	return &GrpcStreamStats{
+		Received: atomic.LoadInt64(&c.received),
+		Sent:     atomic.LoadInt64(&c.sent),
+	}
+}
+
+// Server-streaming: req - запрос клиента, он же DecodedBody в CallParams потока.
+// Весь поток выполняется раннером как один экшен: лог, алерты и интерсепторы как у unary-вызова. Возвращает статус gRPC
+func (c *GrpcControllerImpl) RunServerStream(req interface{}, stream grpc.ServerStream, action IAction) error {
+	return c.runStream(stream, action, req, nil)
+}
+
+// Client-streaming и bidi: newMessage создает пустое сообщение для чтения очередного запроса клиента
+func (c *GrpcControllerImpl) RunBidiStream(stream grpc.ServerStream, action IAction, newMessage func() interface{}) error {
+	return c.runStream(stream, action, nil, newMessage)
+}
+
+func (c *GrpcControllerImpl) runStream(stream grpc.ServerStream, action IAction, req interface{}, newMessage func() interface{}) error {
+	result := c.ActionRunner.Run(
+		&grpcStreamActionImpl{
+			IAction:    action,
+			stream:     &GrpcStream{Request: req, stream: stream, action: action, controller: c},
+			newMessage: newMessage,
+		},
+		func() (interface{}, error) {
+			p, err := c.EntityFromGRPCReaderService.ReadCallParams(stream.Context())
+			if err == nil && req != nil {
+				p.DecodedBody = req
+			}
+			return p, err
+		},
+		nil,
+	)
+	return GetGrpcError(c.ReasonRegistry, result.Err)
+}
+
+// Выполняет открытие потока и его хуки внутри одного вызова раннера
+type grpcStreamActionImpl struct {
+	IAction
+
+	stream     *GrpcStream
+	newMessage func() interface{}
+}
+
+func (c *grpcStreamActionImpl) Run(arg interface{}) (r interface{}, err error) {
+
+	s := c.stream
+	s.Params, _ = arg.(*entities.CallParams)
+	handler := findGrpcStreamAction(c.IAction)
+	if handler == nil {
+		return nil, errs.NewBaseError(fmt.Sprintf("Экшен %v не реализует IGrpcStreamAction", c.GetName()))
+	}
+	defer func() {
+		err = c.mapContextError(err)
+		handler.OnStreamEnd(s, err)
+		r = s.GetStats()
+	}()
+
+	if s.Opened, err = c.IAction.Run(arg); err != nil {
+		return nil, err
+	}
+	if err = handler.OnStreamStart(s); err != nil {
+		return nil, err
+	}
+	if c.newMessage == nil {
+		return nil, nil
+	}
+	for {
+		msg := c.newMessage()
+		if err = s.stream.RecvMsg(msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		s.controller.logStreamMessage(c.IAction, "in", atomic.AddInt64(&s.received, 1), msg)
+		if err = handler.OnStreamMessage(s, msg); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Ошибки из-за отмены вызова клиентом либо дедлайна не считаются внутренними
+func (c *grpcStreamActionImpl) mapContextError(err error) error {
+	if err == nil {
+		return nil
+	}
+	switch c.stream.Context().Err() {
+	case context.Canceled:
+		return errs.NewBaseErrorFromCauseMsgReason(err, "Вызов отменен клиентом", ReasonCanceled)
+	case context.DeadlineExceeded:
+		return errs.NewBaseErrorFromCauseMsgReason(err, "Превышено время выполнения", ReasonTimeout)
+	}
+	return err
+}
+
+func (c *grpcStreamActionImpl) GetInterceptorFilter() *InterceptorFilter {
+	if provider, ok := c.IAction.(IInterceptorFilterProvider); ok {
+		return provider.GetInterceptorFilter()
+	}
+	return nil
+}
+
+func (c *grpcStreamActionImpl) GetLogFields(arg interface{}) map[string]interface{} {
+	fields := map[string]interface{}{}
+	if provider, ok := c.IAction.(ILogFieldsProvider); ok {
+		for k, v := range provider.GetLogFields(arg) {
+			fields[k] = v
+		}
+	}
+	fields["stream"] = c.stream.GetStats()
+	return fields
+}
+
+func findGrpcStreamAction(action IAction) IGrpcStreamAction {
+	if r, ok := action.(IGrpcStreamAction); ok {
+		return r
+	}
+	if chain, ok := action.(*ChainedActionImpl); ok && len(chain.Actions) > 0 {
+		return findGrpcStreamAction(chain.Actions[len(chain.Actions)-1])
+	}
+	return nil
+}
+
+// В лог экшенов пишется каждое StreamLogEvery-е сообщение потока в каждом направлении
+func (c *GrpcControllerImpl) logStreamMessage(action IAction, direction string, seq int64, msg interface{}) {
+	if c.StreamLogEvery <= 0 || c.LoggerService == nil || (seq-1)%int64(c.StreamLogEvery) != 0 {
+		return
+	}
+	redactor := c.Redactor
+	if redactor == nil {
+		redactor = defaultRedactor
+	}
+	ld := logger.NewLD()
+	logger.Action(ld, action.GetName())
+	logger.Field(ld, "dir", direction)
+	logger.Field(ld, "seq", seq)
+	// logger.Print пишет только записи с результатом, поэтому сообщение пишется в r
+	logger.Result(ld, redactor.Redact(msg))
+	logger.Print(c.LoggerService.GetDefaultActionsLogger(), ld)
+}
@@ -1,12 +1,16 @@
 package pipeline
 
 import (
+	"errors"
 	"github.com/itskovichanton/core/pkg/core/validation"
 	"github.com/itskovichanton/echo-http"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
 	"github.com/itskovichanton/goava/pkg/goava/httputils"
 	"github.com/itskovichanton/goava/pkg/goava/utils"
 	"github.com/itskovichanton/server/pkg/server"
 	"github.com/itskovichanton/server/pkg/server/entities"
+	"github.com/itskovichanton/server/pkg/server/i18n"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
@@ -81,6 +85,9 @@ type IEntityFromHTTPReaderService interface {
 type EntityFromHTTPReaderServiceImpl struct {
 	IEntityFromHTTPReaderService
 	Config *server.Config
+
+	// Декодеры тела запроса по content-type. Если не заданы - DefaultBodyDecoders()
+	BodyDecoders map[string]IBodyDecoder
 }
 
 func (c *EntityFromHTTPReaderServiceImpl) ReadLanguage(r echo.Context) string {
@@ -88,6 +95,9 @@ func (c *EntityFromHTTPReaderServiceImpl) ReadLanguage(r echo.Context) string {
 	if len(lang) == 0 {
 		lang = r.Request().Header.Get("lang")
 	}
+	if len(lang) == 0 {
+		lang = utils.GetFirstElementStr(i18n.ParseAcceptLanguage(r.Request().Header.Get("Accept-Language")))
+	}
 	if len(lang) == 0 {
 		lang = c.Config.Server.DefaultLang
 	}
@@ -113,52 +123,65 @@ func (c *EntityFromHTTPReaderServiceImpl) ReadCallParams(r echo.Context) (*entit
 		return nil, err
 	}
 	return &entities.CallParams{
-		Request:    r,
-		Parameters: params,
-		URL:        httputils.GetUrl(r.Request()),
-		Caller:     c.ReadCaller(r),
-		Raw:        r.Request().URL.RawQuery,
+		Request:     r,
+		Parameters:  params,
+		Headers:     r.Request().Header,
+		URL:         httputils.GetUrl(r.Request()),
+		Caller:      c.ReadCaller(r),
+		Raw:         r.Request().URL.RawQuery,
+		Body:        bodyFromContext(r),
+		DecodedBody: r.Get(ctxKeyDecodedBody),
+		Bag:         entities.NewBag(),
 	}, nil
 }
 
+const (
+	ctxKeyBody        = "callParams.body"
+	ctxKeyDecodedBody = "callParams.decodedBody"
+)
+
 func (c *EntityFromHTTPReaderServiceImpl) GetParameters(r echo.Context) (map[string][]interface{}, error) {
 	var res map[string][]interface{}
 	if strings.EqualFold("get", r.Request().Method) {
 		res = utils.UpcastMapOfSlicesStr(r.Request().URL.Query())
 	} else {
 
-		// Parse multipart
-		maxMem, err := c.Config.Server.Http.Multipart.GetMaxRequestSizeBytes()
+		maxMem, err := c.getMaxRequestSizeBytes()
 		if err != nil {
 			return nil, err
 		}
+		if maxMem > 0 && r.Request().Body != nil {
+			r.Request().Body = http.MaxBytesReader(r.Response(), r.Request().Body, int64(maxMem))
+		}
+
+		decoder := c.getBodyDecoder(r.Request().Header.Get(echo.HeaderContentType))
+		if decoder != nil {
+			res, err = c.decodeBody(r, decoder)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+
+			// Parse multipart
+			if maxMem == 0 {
+				maxMem = defaultMultipartMemory
+			}
+			err = r.Request().ParseMultipartForm(int64(maxMem))
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return nil, errs.NewBaseErrorFromCauseMsgReason(err, "Превышен допустимый размер запроса", ReasonRequestTooLarge)
+			}
+			if err == nil {
+				res = utils.UpcastMapOfSlicesStr(r.Request().MultipartForm.Value)
 
-		err = r.Request().ParseMultipartForm(int64(maxMem))
-		if err == nil {
-			res = utils.UpcastMapOfSlicesStr(r.Request().MultipartForm.Value)
-
-			// Parse multipart files
-			for field, fileHeaders := range r.Request().MultipartForm.File {
-				v := []interface{}{}
-				for _, fileHeader := range fileHeaders {
-					//file, err := fileHeader.Open()
-					//if err != nil {
-					//	return nil, err
-					//}
-
-					//savedMultipartFormFilePath, err := c.Config.GetTempFile("multipart_" + fileHeader.Filename + "_*")
-					//buf, err := ioutil.ReadAll(file)
-					//if err != nil {
-					//	return nil, err
-					//}
-
-					//err = ioutil.WriteFile(savedMultipartFormFilePath.Name(), buf, os.ModePerm)
-					//if err != nil {
-					//	return nil, err
-					//}
-					v = append(v, fileHeader)
+				// Parse multipart files
+				for field, fileHeaders := range r.Request().MultipartForm.File {
+					v := []interface{}{}
+					for _, fileHeader := range fileHeaders {
+						v = append(v, fileHeader)
+					}
+					res[field] = v
 				}
-				res[field] = v
 			}
 		}
 	}
@@ -180,6 +203,76 @@ func (c *EntityFromHTTPReaderServiceImpl) GetParameters(r echo.Context) (map[str
 	return res, nil
 }
 
+const defaultMultipartMemory = 32 << 20
+
+func (c *EntityFromHTTPReaderServiceImpl) getMaxRequestSizeBytes() (uint64, error) {
+	return getMaxRequestSizeBytes(c.Config)
+}
+
+// Ограничение размера тела запроса из server.http.multipart. 0 - без ограничения
+func getMaxRequestSizeBytes(config *server.Config) (uint64, error) {
+	if config.Server.Http == nil || config.Server.Http.Multipart == nil || len(config.Server.Http.Multipart.MaxRequestSizeBytes) == 0 {
+		return 0, nil
+	}
+	return config.Server.Http.Multipart.GetMaxRequestSizeBytes()
+}
+
+func (c *EntityFromHTTPReaderServiceImpl) getBodyDecoder(contentType string) IBodyDecoder {
+	if len(contentType) == 0 {
+		return nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+	decoders := c.BodyDecoders
+	if decoders == nil {
+		decoders = DefaultBodyDecoders()
+	}
+	return decoders[strings.ToLower(mediaType)]
+}
+
+// Декодирует тело запроса; query-параметры тоже попадают в результат, поля тела имеют приоритет
+func (c *EntityFromHTTPReaderServiceImpl) decodeBody(r echo.Context, decoder IBodyDecoder) (map[string][]interface{}, error) {
+
+	res := utils.UpcastMapOfSlicesStr(r.Request().URL.Query())
+	if r.Request().Body == nil {
+		return res, nil
+	}
+
+	body, err := readBody(r.Request().Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Set(ctxKeyBody, body)
+	if len(body) == 0 {
+		return res, nil
+	}
+
+	decoded, err := decoder.Decode(body)
+	if err != nil {
+		return nil, &validation.ValidationError{
+			BaseError:    *errs.NewBaseErrorFromCauseMsg(err, "Не удалось разобрать тело запроса"),
+			Reason:       validation.Unexpectable,
+			Param:        "body",
+			InvalidValue: utils.ChopOffString(string(body), 200),
+		}
+	}
+	r.Set(ctxKeyDecodedBody, decoded)
+
+	fromBody := map[string][]interface{}{}
+	flattenBody("", decoded, fromBody)
+	for k, v := range fromBody {
+		res[k] = v
+	}
+	return res, nil
+}
+
+func bodyFromContext(r echo.Context) []byte {
+	body, _ := r.Get(ctxKeyBody).([]byte)
+	return body
+}
+
 func (c *EntityFromHTTPReaderServiceImpl) ReadSession(r *http.Request) *entities.Session {
 	return &entities.Session{
 		//Token:         "",
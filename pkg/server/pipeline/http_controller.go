@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"github.com/itskovichanton/echo-http"
 	"github.com/itskovichanton/echo-http/middleware"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
 	"github.com/itskovichanton/server/pkg/server"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"net/http"
+	"os"
 	"strings"
 )
 
@@ -19,6 +23,7 @@ type HttpControllerImpl struct {
 	GetUserAction         *GetUserAction
 	NopAction             *NopActionImpl
 	ValidateCallerAction  *ValidateCallerAction
+	ValidateAdminAction   *ValidateAdminAction
 	RegisterAccountAction *RegisterAccountAction
 	GetFileAction         *GetFileAction
 	GetSessionAction      *GetSessionAction
@@ -28,10 +33,31 @@ type HttpControllerImpl struct {
 	EntityFromHTTPReaderService IEntityFromHTTPReaderService
 	DefaultResponsePresenter    IResponsePresenter
 	FileResponsePresenter       IResponsePresenter
+	ActionRegistry              IActionRegistry
+	PresenterRegistry           IPresenterRegistry
+	OpenApiService              IOpenApiService
+	ReasonRegistry              IReasonRegistryService
+	MetricsService              IMetricsService
+	JobQueue                    IJobQueueService
+	Scheduler                   ISchedulerService
+	AlertAggregator             IAlertAggregatorService
+	ErrorProviderService        IErrorProviderService
+	PubSub                      IPubSubService
+	Redactor                    IRedactorService
+	routes                      []*RouteInfo
+	rpcMethods                  map[string]IAction
 	routerModifiers             []func(e *HttpControllerImpl)
+	streamSettings              *streamSettings
 	EchoEngine                  *echo.Echo
 }
 
+func (c *HttpControllerImpl) getRedactor() IRedactorService {
+	if c.Redactor == nil {
+		return defaultRedactor
+	}
+	return c.Redactor
+}
+
 func (c *HttpControllerImpl) AddRouterModifier(modifier func(e *HttpControllerImpl)) {
 	c.routerModifiers = append(c.routerModifiers, modifier)
 }
@@ -42,9 +68,24 @@ func (c *HttpControllerImpl) Start() error {
 		return nil
 	}
 
+	var err error
+	c.streamSettings, err = parseStreamSettings(c.Config.Server.Streaming)
+	if err != nil {
+		return err
+	}
 	c.init()
-
-	c.EchoEngine.Use(middleware.Logger())
+	err = c.initConfiguredRoutes()
+	if err != nil {
+		return err
+	}
+	err = c.initConfiguredRpcMethods()
+	if err != nil {
+		return err
+	}
+	// В URI бывают секреты (?sessionToken= потоковых маршрутов), поэтому лог запросов проходит через редактор
+	c.EchoEngine.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
+		Output: &redactingWriter{writer: os.Stdout, redactor: c.getRedactor()},
+	}))
 	c.EchoEngine.Use(middleware.Recover())
 	if c.Config.Server.EnableCORS {
 		c.EchoEngine.Use(middleware.CORS())
@@ -56,13 +97,34 @@ func (c *HttpControllerImpl) Start() error {
 		modifier(c)
 	}
 
+	// Прерванные саги откатываются до запуска очереди: возобновленные задачи начинают их заново
+	if err := RecoverSagas(c.getActions()); err != nil {
+		c.EchoEngine.Logger.Error(err)
+	}
+
+	// Очередь и планировщик запускаются после модификаторов: в них регистрируются экшены возобновляемых задач
+	if c.JobQueue != nil {
+		if err := c.JobQueue.Start(c.ActionRunner); err != nil {
+			return err
+		}
+	}
+	if c.Scheduler != nil {
+		if err := c.Scheduler.Start(c.ActionRunner); err != nil {
+			return err
+		}
+	}
+	if c.AlertAggregator != nil {
+		if err := c.AlertAggregator.Start(); err != nil {
+			return err
+		}
+	}
+
 	ssl := c.Config.Server.Http.Ssl
 	protocol := "https"
 	if ssl == nil || !ssl.Enabled {
 		protocol = "http"
 	}
 
-	var err error
 	if ssl != nil && strings.EqualFold(protocol, "https") {
 		err = c.EchoEngine.StartTLS(fmt.Sprintf(":%v", c.Config.Server.Port), ssl.CertFile, ssl.KeyFile)
 	} else {
@@ -73,6 +135,69 @@ func (c *HttpControllerImpl) Start() error {
 	return err
 }
 
+// Регистрирует маршрут в echo и запоминает его экшен для OpenAPI-спецификации
+func (c *HttpControllerImpl) Handle(methods []string, path string, action IAction, presenter IResponsePresenter) {
+	c.routes = append(c.routes, &RouteInfo{
+		Methods:   methods,
+		Path:      path,
+		Action:    action,
+		Presenter: presenter,
+	})
+	c.EchoEngine.Match(methods, path, c.GetHandlerByActionPresenter(action, presenter))
+}
+
+// Регистрирует маршрут, экшен которого выполняется фоновой задачей. Клиент сразу получает 202 и задачу.
+// Паникует, если фоновые задачи не настроены (server.jobs)
+func (c *HttpControllerImpl) HandleAsync(methods []string, path string, action IAction, presenter IResponsePresenter) {
+	if c.JobQueue == nil {
+		panic(errs.NewBaseError(fmt.Sprintf("Маршрут %v: фоновые задачи не настроены либо отключены (server.jobs)", path)))
+	}
+	enqueueAction := NewEnqueueAction(action, c.ActionRunner)
+	c.JobQueue.RegisterAction(enqueueAction.Action)
+	c.routes = append(c.routes, &RouteInfo{
+		Methods:   methods,
+		Path:      path,
+		Action:    enqueueAction,
+		Presenter: presenter,
+	})
+	c.EchoEngine.Match(methods, path, func(context echo.Context) error {
+		result := c.ActionRunner.Run(enqueueAction, func() (interface{}, error) {
+			return c.EntityFromHTTPReaderService.ReadCallParams(context)
+		}, nil)
+		if presenter == nil {
+			presenter = c.DefaultResponsePresenter
+		}
+		httpStatus := 0
+		if result.Err == nil {
+			httpStatus = http.StatusAccepted
+		}
+		return presenter.Write(context, result, httpStatus)
+	})
+}
+
+func (c *HttpControllerImpl) GetRoutes() []*RouteInfo {
+	return c.routes
+}
+
+// Экшены маршрутов, методов JSON-RPC и реестра
+func (c *HttpControllerImpl) getActions() []IAction {
+	var r []IAction
+	for _, route := range c.routes {
+		r = append(r, route.Action)
+	}
+	for _, action := range c.rpcMethods {
+		r = append(r, action)
+	}
+	if c.ActionRegistry != nil {
+		for _, name := range c.ActionRegistry.Names() {
+			if action, err := c.ActionRegistry.Get(name); err == nil {
+				r = append(r, action)
+			}
+		}
+	}
+	return r
+}
+
 func (c *HttpControllerImpl) GetDefaultHandler(action IAction) func(context echo.Context) error {
 	return c.GetDefaultHandlerByFunc(func() IAction {
 		return action
@@ -113,16 +238,119 @@ func (c *HttpControllerImpl) GetHandlerByFuncPresenterErrorProvider(action func(
 	}
 }
 
+func (c *HttpControllerImpl) schedulerAdminAction(command string) IAction {
+	return &ChainedActionImpl{
+		Actions: []IAction{c.ValidateCallerAction, c.GetUserAction, c.ValidateAdminAction, &SchedulerAdminAction{Scheduler: c.Scheduler, Command: command}},
+	}
+}
+
+// WebSocket подписок на топики EventBus. Сессия проверяется GetUserAction до апгрейда соединения
+func (c *HttpControllerImpl) getPubSubHandler() func(context echo.Context) error {
+	action := &ChainedActionImpl{Name: "PubSub", Actions: []IAction{c.ValidateCallerAction, c.GetUserAction}}
+	return func(context echo.Context) error {
+		var p *entities.CallParams
+		result := c.ActionRunner.Run(action, func() (interface{}, error) {
+			var err error
+			p, err = c.readStreamCallParams(context)
+			return p, err
+		}, nil)
+		if result.Err != nil {
+			return c.DefaultResponsePresenter.Write(context, result, 0)
+		}
+		return c.PubSub.Serve(context, p)
+	}
+}
+
+func (c *HttpControllerImpl) getPubSubPath() string {
+	if c.Config.Server.PubSub != nil && len(c.Config.Server.PubSub.Path) > 0 {
+		return c.Config.Server.PubSub.Path
+	}
+	return "/api/pubsub"
+}
+
+func (c *HttpControllerImpl) getBatchPath() string {
+	if c.Config.Server.Batch != nil && len(c.Config.Server.Batch.Path) > 0 {
+		return c.Config.Server.Batch.Path
+	}
+	return "/api/batch"
+}
+
+func (c *HttpControllerImpl) newBatchAction() *BatchAction {
+	r := &BatchAction{
+		Runner:               c.ActionRunner,
+		Routes:               c.GetRoutes,
+		ReasonRegistry:       c.ReasonRegistry,
+		ErrorProviderService: c.ErrorProviderService,
+	}
+	if r.ErrorProviderService == nil {
+		r.ErrorProviderService = &ErrorProviderServiceImpl{Config: c.Config.CoreConfig}
+	}
+	if cfg := c.Config.Server.Batch; cfg != nil {
+		r.MaxItems = cfg.MaxItems
+		r.MaxParallel = cfg.MaxParallel
+	}
+	return r
+}
+
 func (c *HttpControllerImpl) init() {
 	c.AddRouterModifier(func(e *HttpControllerImpl) {
 		//c.GETPOST("/error", c.GetDefaultHandler(&ChainedActionImpl{Actions: []IAction{c.ValidateCallerAction, &ImmediateFailedAction{}}}))
 		//r.GET("/setServerStateAction", c.GetDefaultHandler(c.SetServerStateAction))
-		c.EchoEngine.GET("/api/admin/registerAccount", c.GetDefaultHandler(&ChainedActionImpl{
+		c.Handle([]string{http.MethodGet}, "/api/admin/registerAccount", &ChainedActionImpl{
 			Actions: []IAction{c.ValidateCallerAction, c.GetUserAction /*c.CheckSecurityAction.WithActionName("AccountRegistration"),*/, c.RegisterAccountAction},
-		}))
-		c.EchoEngine.GET("/api/admin/getAccount", c.GetDefaultHandler(&ChainedActionImpl{
+		}, nil)
+		c.Handle([]string{http.MethodGet}, "/api/admin/getAccount", &ChainedActionImpl{
 			Actions: []IAction{c.ValidateCallerAction, c.GetUserAction},
-		}))
+		}, nil)
+		if c.JobQueue != nil {
+			c.Handle([]string{http.MethodGet}, "/api/jobs/:id", &ChainedActionImpl{
+				Actions: []IAction{c.ValidateCallerAction, c.GetUserAction, &GetJobAction{JobQueue: c.JobQueue}},
+			}, nil)
+		}
+		if c.Scheduler != nil {
+			c.Handle([]string{http.MethodGet}, "/api/admin/scheduler", c.schedulerAdminAction(SchedulerCommandList), nil)
+			for _, command := range []string{SchedulerCommandPause, SchedulerCommandResume, SchedulerCommandTrigger} {
+				c.Handle([]string{http.MethodPost}, "/api/admin/scheduler/:name/"+command, c.schedulerAdminAction(command), nil)
+			}
+		}
+		if c.PubSub != nil {
+			c.EchoEngine.GET(c.getPubSubPath(), c.getPubSubHandler())
+			c.Handle([]string{http.MethodGet}, "/api/admin/pubsub/presence", &ChainedActionImpl{
+				Actions: []IAction{c.ValidateCallerAction, c.GetUserAction, c.ValidateAdminAction, &GetPresenceAction{PubSub: c.PubSub}},
+			}, nil)
+		}
+		if c.Config.Server.Batch != nil && !c.Config.Server.Batch.Disabled {
+			c.Handle([]string{http.MethodPost}, c.getBatchPath(), &ChainedActionImpl{
+				Actions: []IAction{c.ValidateCallerAction, c.GetUserAction, c.newBatchAction()},
+			}, nil)
+		}
+		if c.Config.Server.JsonRpc != nil && !c.Config.Server.JsonRpc.Disabled {
+			c.EchoEngine.POST(c.getRpcPath(), c.handleRpc)
+		}
+		if c.Config.Server.EnableMetrics && c.MetricsService != nil {
+			c.EchoEngine.GET("/api/metrics", func(context echo.Context) error {
+				return context.String(http.StatusOK, c.MetricsService.ExportPrometheus())
+			})
+		}
+		if c.Config.Server.EnableApiDocs {
+			c.EchoEngine.GET("/api/openapi.json", func(context echo.Context) error {
+				return context.JSON(http.StatusOK, c.OpenApiService.Generate(c.routes, c.EchoEngine.Routes()))
+			})
+			c.EchoEngine.GET("/api/docs", func(context echo.Context) error {
+				return writeSwaggerUIPage(context, c.Config.CoreConfig.App.Name, "/api/openapi.json")
+			})
+			c.EchoEngine.StaticFS(swaggerUIAssetsPath, swaggerUIAssets())
+			c.EchoEngine.GET("/api/reasons.json", func(context echo.Context) error {
+				body, err := reasonRegistryOrDefault(c.ReasonRegistry).ExportJSON()
+				if err != nil {
+					return err
+				}
+				return context.JSONBlob(http.StatusOK, body)
+			})
+			c.EchoEngine.GET("/api/reasons.md", func(context echo.Context) error {
+				return context.Blob(http.StatusOK, "text/markdown; charset=UTF-8", []byte(reasonRegistryOrDefault(c.ReasonRegistry).ExportMarkdown()))
+			})
+		}
 		//r.GET("/api/getFile", c.GetHandlerByActionPresenter(&ChainedActionImpl{
 		//	Actions: []IAction{c.CheckServerStateAction /*c.ValidateCallerAction,*/, c.GetUserAction /*checkWithSecurityAction(SecurityService.Params.Builder().admin().build()),*/, c.GetFileAction},
 		//}, c.FileResponsePresenter))
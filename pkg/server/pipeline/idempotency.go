@@ -0,0 +1,280 @@
+package pipeline
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/goava/pkg/goava/utils"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderIdempotencyKey   = "Idempotency-Key"
+	InterceptorIdempotency = "idempotency"
+
+	// Запрос с тем же ключом еще выполняется
+	ReasonIdempotencyConflict = "REASON_IDEMPOTENCY_CONFLICT"
+
+	// Ключ уже использован для запроса с другими параметрами
+	ReasonIdempotencyKeyMismatch = "REASON_IDEMPOTENCY_KEY_MISMATCH"
+
+	bagKeyIdempotencyReplayed = "idempotency.replayed"
+)
+
+// Запись о вызове с ключом идемпотентности. Result == nil, пока вызов выполняется
+type IdempotencyRecord struct {
+	Fingerprint string
+	Result      *Result
+	ExpiresAt   time.Time
+}
+
+type IIdempotencyStore interface {
+	// Занимает ключ на ttl. Если ключ уже занят - возвращает существующую запись и false
+	Begin(key string, fingerprint string, ttl time.Duration) (*IdempotencyRecord, bool, error)
+	Get(key string) (*IdempotencyRecord, error)
+	Complete(key string, result *Result) error
+
+	// Освобождает ключ, чтобы повтор выполнил экшен заново
+	Release(key string) error
+}
+
+// Хранилище в памяти с вытеснением давно не использованных ключей. MaxEntries <= 0 - без ограничения размера
+type MemoryIdempotencyStoreImpl struct {
+	IIdempotencyStore
+
+	MaxEntries int
+
+	lock    sync.Mutex
+	lru     *list.List
+	records map[string]*list.Element
+}
+
+type idempotencyEntry struct {
+	key    string
+	record *IdempotencyRecord
+}
+
+func (c *MemoryIdempotencyStoreImpl) Begin(key string, fingerprint string, ttl time.Duration) (*IdempotencyRecord, bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.records == nil {
+		c.lru = list.New()
+		c.records = map[string]*list.Element{}
+	}
+	now := time.Now()
+	if existing := c.get(key, now); existing != nil {
+		return existing.copy(), false, nil
+	}
+	c.records[key] = c.lru.PushFront(&idempotencyEntry{key: key, record: &IdempotencyRecord{Fingerprint: fingerprint, ExpiresAt: now.Add(ttl)}})
+	for c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries {
+		c.remove(c.lru.Back())
+	}
+	return nil, true, nil
+}
+
+func (c *MemoryIdempotencyStoreImpl) Get(key string) (*IdempotencyRecord, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	r := c.get(key, time.Now())
+	if r == nil {
+		return nil, nil
+	}
+	return r.copy(), nil
+}
+
+func (c *MemoryIdempotencyStoreImpl) Complete(key string, result *Result) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.records[key]; ok {
+		e.Value.(*idempotencyEntry).record.Result = result
+	}
+	return nil
+}
+
+func (c *MemoryIdempotencyStoreImpl) Release(key string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.records[key]; ok {
+		c.remove(e)
+	}
+	return nil
+}
+
+// Действующая запись. Истекшая удаляется
+func (c *MemoryIdempotencyStoreImpl) get(key string, now time.Time) *IdempotencyRecord {
+	e, ok := c.records[key]
+	if !ok {
+		return nil
+	}
+	r := e.Value.(*idempotencyEntry).record
+	if !r.ExpiresAt.After(now) {
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e)
+	return r
+}
+
+func (c *MemoryIdempotencyStoreImpl) remove(e *list.Element) {
+	delete(c.records, c.lru.Remove(e).(*idempotencyEntry).key)
+}
+
+func (c *IdempotencyRecord) copy() *IdempotencyRecord {
+	r := *c
+	return &r
+}
+
+// Повтор запроса с тем же заголовком Idempotency-Key (grpc-метаданными idempotency-key) получает сохраненный результат
+// первого вызова. Ключ действует в рамках аккаунта и экшена: шаги авторизации экшена выполняются до поиска результата,
+// и ключ привязывается к проверенной сессии. Для вызовов без авторизации ключ игнорируется.
+// Пока первый вызов выполняется, повтор ждет его WaitTimeout, а затем получает ReasonIdempotencyConflict.
+// Результаты с временными ошибками (Retryable в реестре причин) и внутренними ошибками не сохраняются
+type IdempotencyServiceImpl struct {
+	Store          IIdempotencyStore
+	ReasonRegistry IReasonRegistryService
+	TTL            time.Duration
+	WaitTimeout    time.Duration
+}
+
+const idempotencyPollInterval = 50 * time.Millisecond
+
+func (c *IdempotencyServiceImpl) GetInterceptor() *Interceptor {
+	return &Interceptor{
+		Name:       InterceptorIdempotency,
+		Middleware: c.middleware,
+	}
+}
+
+// Результат был взят из сохраненного ранее
+func IsIdempotentReplay(arg interface{}) bool {
+	bag := bagOf(arg)
+	if bag == nil {
+		return false
+	}
+	_, ok := bag.Get(bagKeyIdempotencyReplayed)
+	return ok
+}
+
+func (c *IdempotencyServiceImpl) middleware(next ActionHandler) ActionHandler {
+	var handler ActionHandler
+	handler = func(call *ActionCall) {
+
+		p, ok := call.Arg.(*entities.CallParams)
+		if !ok {
+			next(call)
+			return
+		}
+		key := p.GetHeader(HeaderIdempotencyKey)
+		if len(key) == 0 {
+			next(call)
+			return
+		}
+		if err := authenticateCall(call); err != nil {
+			call.Fail(err)
+			return
+		}
+		p, ok = call.Arg.(*entities.CallParams)
+		account := ""
+		if ok {
+			account = idempotencyAccount(p)
+		}
+		if len(account) == 0 {
+			next(call)
+			return
+		}
+
+		storeKey := utils.MD5(fmt.Sprintf("%v|%v|%v", call.Action.GetName(), account, key))
+		fingerprint := idempotencyFingerprint(p)
+
+		existing, begun, err := c.Store.Begin(storeKey, fingerprint, c.TTL)
+		if err != nil {
+			call.Fail(err)
+			return
+		}
+		if begun {
+			completed := false
+			defer func() {
+				// Паника в интерсепторе ниже - ключ не должен остаться занятым до истечения TTL
+				if !completed {
+					c.Store.Release(storeKey)
+				}
+			}()
+			next(call)
+			c.complete(storeKey, call.Result)
+			completed = true
+			return
+		}
+
+		if existing.Fingerprint != fingerprint {
+			call.Fail(errs.NewBaseErrorWithReason("Ключ идемпотентности уже использован для запроса с другими параметрами", ReasonIdempotencyKeyMismatch))
+			return
+		}
+		existing, err = c.waitResult(storeKey, existing)
+		if err != nil {
+			call.Fail(err)
+			return
+		}
+		if existing == nil {
+			// Первый вызов завершился временной ошибкой и освободил ключ - занимаем его заново
+			handler(call)
+			return
+		}
+		call.Result.Res = existing.Result.Res
+		call.Result.Err = existing.Result.Err
+		if bag := bagOf(p); bag != nil {
+			bag.Set(bagKeyIdempotencyReplayed, true)
+		}
+	}
+	return handler
+}
+
+func (c *IdempotencyServiceImpl) complete(key string, result *Result) {
+	if result.Err != nil && (isRetryableErr(c.ReasonRegistry, result.Err) || isInternalErr(result.Err)) {
+		c.Store.Release(key)
+		return
+	}
+	c.Store.Complete(key, &Result{Res: result.Res, Err: result.Err})
+}
+
+// Ждет завершения первого вызова. Возвращает nil, если ключ был освобожден
+func (c *IdempotencyServiceImpl) waitResult(key string, record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	deadline := time.Now().Add(c.WaitTimeout)
+	for record.Result == nil {
+		if !time.Now().Before(deadline) {
+			return nil, errs.NewBaseErrorWithReason("Запрос с этим ключом идемпотентности еще выполняется", ReasonIdempotencyConflict)
+		}
+		time.Sleep(idempotencyPollInterval)
+		var err error
+		record, err = c.Store.Get(key)
+		if err != nil {
+			return nil, err
+		}
+		if record == nil {
+			return nil, nil
+		}
+	}
+	return record, nil
+}
+
+// Пользователь сессии, проверенной GetUserAction. Пустая строка - вызов без авторизации
+func idempotencyAccount(p *entities.CallParams) string {
+	session := AuthenticatedSession(p)
+	if session == nil {
+		return ""
+	}
+	if session.Account != nil && len(session.Account.Username) > 0 {
+		return session.Account.Username
+	}
+	return session.Token
+}
+
+func idempotencyFingerprint(p *entities.CallParams) string {
+	data, _ := json.Marshal(map[string]interface{}{
+		"parameters": p.Parameters,
+		"body":       p.Body,
+	})
+	return utils.MD5(string(data))
+}
@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Экшен ждет release, если он задан
+type testPaymentAction struct {
+	BaseActionImpl
+
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *testPaymentAction) GetName() string {
+	return "testPayment"
+}
+
+func (c *testPaymentAction) Run(arg interface{}) (interface{}, error) {
+	n := atomic.AddInt32(&c.calls, 1)
+	if c.release != nil {
+		c.started <- struct{}{}
+		<-c.release
+	}
+	return n, nil
+}
+
+func newIdempotentTestRunner() IActionRunner {
+	runner, _, _ := newTestRunner()
+	runner.Use((&IdempotencyServiceImpl{Store: &MemoryIdempotencyStoreImpl{}, TTL: time.Hour}).GetInterceptor())
+	return runner
+}
+
+func runIdempotent(runner IActionRunner, action IAction, key string, amount string) (*Result, *entities.CallParams) {
+	p := newTestJobArg(map[string][]interface{}{"amount": {amount}})
+	p.Headers[HeaderIdempotencyKey] = []string{key}
+	return runner.Run(action, func() (interface{}, error) { return p, nil }, nil), p
+}
+
+func TestIdempotentReplay(t *testing.T) {
+	runner := newIdempotentTestRunner()
+	action := &testPaymentAction{}
+
+	first, _ := runIdempotent(runner, action, "k1", "10")
+	second, p := runIdempotent(runner, action, "k1", "10")
+	if first.Err != nil || second.Err != nil {
+		t.Fatalf("ошибки: %v, %v", first.Err, second.Err)
+	}
+	if action.calls != 1 || second.Res != first.Res || !IsIdempotentReplay(p) {
+		t.Errorf("повтор выполнил экшен заново: %v вызовов, результат %v", action.calls, second.Res)
+	}
+}
+
+func TestIdempotencyKeyMismatch(t *testing.T) {
+	runner := newIdempotentTestRunner()
+	action := &testPaymentAction{}
+
+	runIdempotent(runner, action, "k1", "10")
+	result, _ := runIdempotent(runner, action, "k1", "20")
+	if result.Err == nil || result.Err.Reason != ReasonIdempotencyKeyMismatch {
+		t.Fatalf("ожидалась ошибка %v, получено %v", ReasonIdempotencyKeyMismatch, result.Err)
+	}
+	if action.calls != 1 {
+		t.Errorf("экшен выполнен %v раз", action.calls)
+	}
+}
+
+func TestIdempotencyConflict(t *testing.T) {
+	runner := newIdempotentTestRunner()
+	action := &testPaymentAction{started: make(chan struct{}), release: make(chan struct{})}
+
+	done := make(chan *Result)
+	go func() {
+		result, _ := runIdempotent(runner, action, "k1", "10")
+		done <- result
+	}()
+	<-action.started
+
+	result, _ := runIdempotent(runner, action, "k1", "10")
+	if result.Err == nil || result.Err.Reason != ReasonIdempotencyConflict {
+		t.Errorf("ожидалась ошибка %v, получено %v", ReasonIdempotencyConflict, result.Err)
+	}
+	close(action.release)
+	if first := <-done; first.Err != nil {
+		t.Fatal(first.Err.Message)
+	}
+}
+
+// Временная ошибка освобождает ключ: повтор выполняет экшен заново
+func TestIdempotencyRetryableErrorIsNotStored(t *testing.T) {
+	runner := newIdempotentTestRunner()
+	action := &testFlakyAction{name: "flaky", failures: 1}
+
+	if result, _ := runIdempotent(runner, action, "k1", "10"); result.Err == nil {
+		t.Fatal("ожидалась ошибка первого вызова")
+	}
+	if result, _ := runIdempotent(runner, action, "k1", "10"); result.Err != nil || action.calls != 2 {
+		t.Errorf("повтор не выполнил экшен: %v вызовов, ошибка %v", action.calls, result.Err)
+	}
+}
+
+func TestMemoryIdempotencyStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := &MemoryIdempotencyStoreImpl{MaxEntries: 2}
+	for _, key := range []string{"a", "b"} {
+		store.Begin(key, "", time.Hour)
+	}
+	store.Get("a")
+	store.Begin("c", "", time.Hour)
+
+	for key, kept := range map[string]bool{"a": true, "b": false, "c": true} {
+		if r, _ := store.Get(key); (r != nil) != kept {
+			t.Errorf("%v: запись сохранена - %v, ожидалось %v", key, r != nil, kept)
+		}
+	}
+}
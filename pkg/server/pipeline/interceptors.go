@@ -0,0 +1,115 @@
+package pipeline
+
+import (
+	"sort"
+)
+
+// Вызов экшена, проходящий через интерсепторы раннера
+type ActionCall struct {
+	Action IAction
+	Arg    interface{}
+
+	// Результат заполняется внутренним обработчиком. Интерсептор может не вызывать next и заполнить его сам
+	Result *Result
+
+	errorProviderService IErrorProviderService
+}
+
+// Завершает вызов ошибкой так же, как если бы ее вернул экшен
+func (c *ActionCall) Fail(err error) {
+	c.Result.Res = nil
+	c.Result.Err = provideError(c.errorProviderService, err, c.Arg)
+}
+
+type ActionHandler func(call *ActionCall)
+
+type ActionMiddleware func(next ActionHandler) ActionHandler
+
+// Интерсептор раннера. Оборачивает каждый экшен, выполняемый раннером.
+// Меньший Order - внешний интерсептор, при равных Order - в порядке регистрации.
+// Интерсептор с OptIn применяется только к экшенам, которые включили его явно (см. InterceptorFilter)
+type Interceptor struct {
+	Name       string
+	Order      int
+	OptIn      bool
+	Middleware ActionMiddleware
+}
+
+// Выбор интерсепторов для экшена: Use включает интерсепторы с OptIn, Skip отключает любые
+type InterceptorFilter struct {
+	Use  []string
+	Skip []string
+}
+
+func (c *InterceptorFilter) Accepts(interceptor *Interceptor) bool {
+	if c == nil {
+		return !interceptor.OptIn
+	}
+	if containsString(c.Skip, interceptor.Name) {
+		return false
+	}
+	return !interceptor.OptIn || containsString(c.Use, interceptor.Name)
+}
+
+// Экшен, выбирающий интерсепторы для себя (например, маршрут из конфига)
+type IInterceptorFilterProvider interface {
+	GetInterceptorFilter() *InterceptorFilter
+}
+
+func (c *ActionRunnerImpl) Use(interceptor *Interceptor) {
+	c.interceptorsLock.Lock()
+	defer c.interceptorsLock.Unlock()
+	interceptors := append(append([]*Interceptor{}, c.interceptors...), interceptor)
+	sort.SliceStable(interceptors, func(i, j int) bool {
+		return interceptors[i].Order < interceptors[j].Order
+	})
+	c.interceptors = interceptors
+}
+
+func (c *ActionRunnerImpl) GetInterceptors() []*Interceptor {
+	c.interceptorsLock.RLock()
+	defer c.interceptorsLock.RUnlock()
+	return c.interceptors
+}
+
+// Выполняет экшен через подходящие ему интерсепторы. Паника в интерсепторе превращается в PanicError
+func (c *ActionRunnerImpl) handle(call *ActionCall) {
+	var err error
+	func() {
+		defer c.recoverPanic(call.Action.GetName(), &err)
+		c.buildHandler(call.Action)(call)
+	}()
+	if err != nil {
+		call.Fail(err)
+	}
+}
+
+func (c *ActionRunnerImpl) buildHandler(action IAction) ActionHandler {
+
+	handler := func(call *ActionCall) {
+		if err := c.runAction(call.Action, call.Arg, call.Result); err != nil {
+			call.Fail(err)
+		}
+	}
+
+	var filter *InterceptorFilter
+	if provider, ok := action.(IInterceptorFilterProvider); ok {
+		filter = provider.GetInterceptorFilter()
+	}
+	interceptors := c.GetInterceptors()
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		if filter.Accepts(interceptors[i]) {
+			handler = interceptors[i].Middleware(handler)
+		}
+	}
+	return handler
+}
+
+func containsString(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package pipeline
+
+import "sync"
+
+// Хранилище фоновых задач. Нужно, чтобы задачи пережили перезапуск
+type IJobStore interface {
+	Save(job *Job) error
+	Load(id string) (*Job, error)
+	List() ([]*Job, error)
+	Delete(id string) error
+}
+
+// Хранит каждую задачу в отдельном JSON-файле в Dir. Учетные данные в аргументы задач не попадают,
+// но параметры вызовов все равно не для посторонних, поэтому файлы доступны только владельцу процесса
+type FileJobStoreImpl struct {
+	IJobStore
+
+	Dir string
+
+	lock sync.Mutex
+}
+
+func (c *FileJobStoreImpl) Save(job *Job) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return saveJsonFile(c.Dir, job.ID, job)
+}
+
+func (c *FileJobStoreImpl) Load(id string) (*Job, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.load(jsonFileName(c.Dir, id))
+}
+
+func (c *FileJobStoreImpl) load(fileName string) (*Job, error) {
+	r := &Job{}
+	if err := loadJsonFile(fileName, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (c *FileJobStoreImpl) List() ([]*Job, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	files, err := listJsonFiles(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var r []*Job
+	for _, f := range files {
+		job, err := c.load(f)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, job)
+	}
+	return r, nil
+}
+
+func (c *FileJobStoreImpl) Delete(id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return deleteJsonFile(c.Dir, id)
+}
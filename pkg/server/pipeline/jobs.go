@@ -0,0 +1,708 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/itskovichanton/core/pkg/core"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+type JobStatus string
+
+const (
+	JobStatusQueued    JobStatus = "queued"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusSucceeded JobStatus = "succeeded"
+
+	// Ошибка, повтор которой не поможет (причина без Retryable в реестре и не из GetRetryableReasons экшена)
+	JobStatusFailed JobStatus = "failed"
+
+	// Попытки исчерпаны, задача передана в обработку недоставленных (алерт и OnDeadLetter)
+	JobStatusDead JobStatus = "dead"
+)
+
+const jobArgTypeCallParams = "callParams"
+
+// Задача прервана перезапуском, а ее аргумент без секретов выполнять нельзя
+const ReasonJobInterrupted = "REASON_JOB_INTERRUPTED"
+
+// Фоновая задача - отложенный вызов экшена
+type Job struct {
+	ID          string    `json:"id"`
+	Action      string    `json:"action"`
+	Status      JobStatus `json:"status"`
+	Attempts    int       `json:"attempts"`
+	MaxAttempts int       `json:"maxAttempts"`
+
+	// Пользователь, поставивший задачу (проверенный GetUserAction). Только он видит задачу через GetJobAction
+	Owner string `json:"owner,omitempty"`
+
+	// Результат последней попытки
+	Result *Result `json:"result,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	NextRunAt time.Time `json:"nextRunAt"`
+
+	// Аргумент экшена для восстановления после перезапуска. Наружу не отдается
+	Arg     json.RawMessage `json:"arg,omitempty"`
+	ArgType string          `json:"argType,omitempty"`
+
+	// Редактор скрыл в параметрах или теле аргумента секреты (пароль и т.п.). Такая задача после перезапуска
+	// не возобновляется, а завершается с ReasonJobInterrupted: с "***" вместо пароля экшен сделал бы не то
+	ArgRedacted bool `json:"argRedacted,omitempty"`
+}
+
+func (c *Job) IsFinished() bool {
+	return c.Status == JobStatusSucceeded || c.Status == JobStatusFailed || c.Status == JobStatusDead
+}
+
+func (c *Job) copy() *Job {
+	r := *c
+	return &r
+}
+
+// Задача без аргумента - для ответа клиенту
+func (c *Job) View() *Job {
+	r := c.copy()
+	r.Arg = nil
+	r.ArgType = ""
+	r.ArgRedacted = false
+	return r
+}
+
+// Аргументы http/grpc-вызова, сохраняемые вместе с задачей. Учетные данные не сохраняются: от вызывающего остается
+// только проверенный пользователь, параметры, заголовки и тело проходят через редактор, как аргументы саг.
+// Скрытые заголовки - это авторизация, она не нужна; скрытые параметры и тело помечают задачу ArgRedacted.
+// Request не сохраняется - к моменту выполнения запрос уже завершен, Body восстанавливается из DecodedBody
+type jobCallParams struct {
+	Parameters  map[string]interface{} `json:"parameters,omitempty"`
+	Headers     map[string]interface{} `json:"headers,omitempty"`
+	URL         string                 `json:"url,omitempty"`
+	Caller      *jobCaller             `json:"caller,omitempty"`
+	Raw         string                 `json:"raw,omitempty"`
+	DecodedBody interface{}            `json:"decodedBody,omitempty"`
+}
+
+// После перезапуска задача выполняется от имени Username без повторной авторизации
+type jobCaller struct {
+	IP       string            `json:"ip,omitempty"`
+	Version  *entities.Version `json:"version,omitempty"`
+	Type     string            `json:"type,omitempty"`
+	Language string            `json:"language,omitempty"`
+	Username string            `json:"username,omitempty"`
+	Role     string            `json:"role,omitempty"`
+}
+
+type IJobQueueService interface {
+	// Сохраняет задачу и сразу возвращает ее, экшен выполнится воркером
+	Enqueue(action IAction, arg interface{}) (*Job, error)
+
+	// Возвращает nil, если задачи нет
+	Get(id string) (*Job, error)
+
+	// Экшен, задачи которого нужно выполнить после перезапуска. Ищется по GetName(), затем в IActionRegistry
+	RegisterAction(action IAction)
+
+	// Запускает воркеры и возобновляет незавершенные задачи из хранилища. Задача, чей экшен еще не
+	// зарегистрирован, ждет RegisterAction
+	Start(runner IActionRunner) error
+	Stop()
+}
+
+// Очередь фоновых задач с пулом воркеров. Экшены выполняются через раннер (лог, интерсепторы, алерты).
+// Временные ошибки (Retryable в реестре причин либо причины из GetRetryableReasons экшена) повторяются
+// с экспоненциальной задержкой.
+// Результаты хранятся и отдаются через GetJobAction без секретов
+type JobQueueServiceImpl struct {
+	IJobQueueService
+
+	Store          IJobStore
+	ActionRegistry IActionRegistry
+	ErrorHandler   core.IErrorHandler
+	ReasonRegistry IReasonRegistryService
+
+	// Скрывает секреты в сохраняемых аргументах и результатах. Если не задан - используется NewDefaultRedactor()
+	Redactor IRedactorService
+
+	// По умолчанию 4 воркера, 3 попытки, задержка 1s, не более 5m
+	Workers     int
+	MaxAttempts int
+	Backoff     time.Duration
+	MaxBackoff  time.Duration
+
+	// Сколько хранятся завершенные задачи, по умолчанию 7 дней. Очистка - при запуске
+	Retention time.Duration
+
+	// Вызывается для задачи, исчерпавшей попытки
+	OnDeadLetter func(job *Job)
+
+	lock    sync.Mutex
+	cond    *sync.Cond
+	ready   []string
+	jobs    map[string]*Job
+	args    map[string]interface{}
+	actions map[string]IAction
+	// Задачи, чей экшен еще не зарегистрирован, по имени экшена
+	pending map[string][]string
+	runner  IActionRunner
+	started bool
+	stopped bool
+}
+
+func (c *JobQueueServiceImpl) init() {
+	if c.jobs == nil {
+		c.cond = sync.NewCond(&c.lock)
+		c.jobs = map[string]*Job{}
+		c.args = map[string]interface{}{}
+		c.actions = map[string]IAction{}
+		c.pending = map[string][]string{}
+	}
+}
+
+func (c *JobQueueServiceImpl) RegisterAction(action IAction) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.init()
+	c.actions[action.GetName()] = action
+	if ids, ok := c.pending[action.GetName()]; ok {
+		delete(c.pending, action.GetName())
+		if !c.stopped {
+			c.ready = append(c.ready, ids...)
+			c.cond.Broadcast()
+		}
+	}
+}
+
+func (c *JobQueueServiceImpl) Enqueue(action IAction, arg interface{}) (*Job, error) {
+
+	owner := ""
+	if session := AuthenticatedSession(arg); session != nil && session.Account != nil {
+		owner = session.Account.Username
+	}
+	arg = detachJobArg(arg)
+	now := time.Now()
+	job := &Job{
+		ID:          uuid.NewString(),
+		Action:      action.GetName(),
+		Owner:       owner,
+		Status:      JobStatusQueued,
+		MaxAttempts: c.getMaxAttempts(),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		NextRunAt:   now,
+	}
+	var err error
+	job.Arg, job.ArgType, job.ArgRedacted, err = c.encodeArg(arg)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.Store.Save(job); err != nil {
+		return nil, err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.init()
+	c.actions[job.Action] = action
+	c.jobs[job.ID] = job
+	c.args[job.ID] = arg
+	c.ready = append(c.ready, job.ID)
+	c.cond.Signal()
+	return job.copy(), nil
+}
+
+func (c *JobQueueServiceImpl) Get(id string) (*Job, error) {
+	c.lock.Lock()
+	if job, ok := c.jobs[id]; ok {
+		defer c.lock.Unlock()
+		return job.copy(), nil
+	}
+	c.lock.Unlock()
+	job, err := c.Store.Load(id)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return job, err
+}
+
+func (c *JobQueueServiceImpl) Start(runner IActionRunner) error {
+
+	c.lock.Lock()
+	if c.started {
+		c.lock.Unlock()
+		return nil
+	}
+	c.init()
+	c.started = true
+	c.runner = runner
+	c.lock.Unlock()
+
+	jobs, err := c.Store.List()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		if job.IsFinished() {
+			if time.Since(job.UpdatedAt) > c.getRetention() {
+				c.Store.Delete(job.ID)
+			}
+			continue
+		}
+		// Задача, прерванная падением процесса, выполняется заново; прерванная попытка засчитывается.
+		// Задача, аргумент которой сохранен без секретов, не возобновляется
+		c.lock.Lock()
+		_, known := c.jobs[job.ID]
+		resume := !known && !job.ArgRedacted
+		if resume {
+			job.Status = JobStatusQueued
+			c.jobs[job.ID] = job
+		}
+		c.lock.Unlock()
+		switch {
+		case resume:
+			c.schedule(job.ID, time.Until(job.NextRunAt))
+		case !known:
+			c.failInterrupted(job)
+		}
+	}
+
+	for i := 0; i < c.getWorkers(); i++ {
+		go c.work()
+	}
+	return nil
+}
+
+func (c *JobQueueServiceImpl) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.init()
+	c.stopped = true
+	c.cond.Broadcast()
+}
+
+func (c *JobQueueServiceImpl) schedule(id string, delay time.Duration) {
+	if delay <= 0 {
+		c.push(id)
+		return
+	}
+	time.AfterFunc(delay, func() {
+		c.push(id)
+	})
+}
+
+func (c *JobQueueServiceImpl) push(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.stopped {
+		return
+	}
+	c.ready = append(c.ready, id)
+	c.cond.Signal()
+}
+
+func (c *JobQueueServiceImpl) next() (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.ready) == 0 && !c.stopped {
+		c.cond.Wait()
+	}
+	if c.stopped {
+		return "", false
+	}
+	id := c.ready[0]
+	c.ready = c.ready[1:]
+	return id, true
+}
+
+func (c *JobQueueServiceImpl) work() {
+	for {
+		id, ok := c.next()
+		if !ok {
+			return
+		}
+		c.execute(id)
+	}
+}
+
+func (c *JobQueueServiceImpl) execute(id string) {
+
+	c.lock.Lock()
+	job, ok := c.jobs[id]
+	if !ok || job.Status != JobStatusQueued {
+		c.lock.Unlock()
+		return
+	}
+	action := c.resolveAction(job.Action)
+	if action == nil {
+		// Экшен зарегистрируют позже (например, в модификаторе роутера) - задача ждет его, попытка не засчитывается
+		c.pending[job.Action] = append(c.pending[job.Action], id)
+		c.lock.Unlock()
+		return
+	}
+	job.Status = JobStatusRunning
+	job.Attempts++
+	job.UpdatedAt = time.Now()
+	arg, hasArg := c.args[id]
+	snapshot := job.copy()
+	c.lock.Unlock()
+	c.Store.Save(snapshot)
+
+	result := c.runner.Run(action, func() (interface{}, error) {
+		if hasArg {
+			return arg, nil
+		}
+		return decodeJobArg(snapshot.Arg, snapshot.ArgType)
+	}, nil)
+
+	c.lock.Lock()
+	job.Result = c.redactResult(result)
+	job.UpdatedAt = time.Now()
+	var delay time.Duration
+	switch {
+	case result.Err == nil:
+		job.Status = JobStatusSucceeded
+	case !isRetryableErrFor(c.ReasonRegistry, action, result.Err):
+		job.Status = JobStatusFailed
+	case job.Attempts >= job.MaxAttempts:
+		job.Status = JobStatusDead
+	default:
+		job.Status = JobStatusQueued
+		delay = c.getDelay(job.Attempts)
+		job.NextRunAt = time.Now().Add(delay)
+	}
+	if job.IsFinished() {
+		delete(c.jobs, id)
+		delete(c.args, id)
+	}
+	snapshot = job.copy()
+	c.lock.Unlock()
+	c.Store.Save(snapshot)
+
+	switch snapshot.Status {
+	case JobStatusQueued:
+		c.schedule(id, delay)
+	case JobStatusDead:
+		c.deadLetter(snapshot)
+	}
+}
+
+// Возвращает nil, если экшен еще не зарегистрирован
+func (c *JobQueueServiceImpl) resolveAction(name string) IAction {
+	if action, ok := c.actions[name]; ok {
+		return action
+	}
+	if c.ActionRegistry != nil {
+		if action, err := c.ActionRegistry.Get(name); err == nil {
+			return action
+		}
+	}
+	return nil
+}
+
+func (c *JobQueueServiceImpl) failInterrupted(job *Job) {
+	message := "Задача прервана перезапуском сервера и не может быть возобновлена: секретные параметры не сохраняются. Повторите запрос"
+	job.Status = JobStatusFailed
+	job.UpdatedAt = time.Now()
+	job.Result = &Result{Err: &Err{
+		Error:   errs.NewBaseErrorWithReason(message, ReasonJobInterrupted),
+		Reason:  ReasonJobInterrupted,
+		Message: message,
+	}}
+	c.Store.Save(job)
+}
+
+// Копия результата без секретов (например, токена возвращенной сессии). Исходная ошибка остается для алерта
+func (c *JobQueueServiceImpl) redactResult(result *Result) *Result {
+	redactor := c.getRedactor()
+	r := &Result{Res: redactor.Redact(result.Res), ExecutionTimeMs: result.ExecutionTimeMs}
+	if result.Err != nil {
+		e := *result.Err
+		e.Message = redactor.RedactString(e.Message)
+		e.Details = redactor.RedactString(e.Details)
+		r.Err = &e
+	}
+	return r
+}
+
+func (c *JobQueueServiceImpl) getRedactor() IRedactorService {
+	if c.Redactor == nil {
+		return defaultRedactor
+	}
+	return c.Redactor
+}
+
+func (c *JobQueueServiceImpl) deadLetter(job *Job) {
+	if c.ErrorHandler != nil && job.Result != nil && job.Result.Err != nil && job.Result.Err.Error != nil {
+		c.ErrorHandler.HandleWithCustomParams(job.Result.Err.Error, func(alertParams *core.AlertParams) {
+			alertParams.Subject += "-DEAD-JOB"
+			alertParams.Message = fmt.Sprintf("Задача %v (%v) не выполнена за %v попыток: %v", job.ID, job.Action, job.Attempts, job.Result.Err.Message)
+		})
+	}
+	if c.OnDeadLetter != nil {
+		c.OnDeadLetter(job)
+	}
+}
+
+func (c *JobQueueServiceImpl) getDelay(attempt int) time.Duration {
+	backoff := c.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	maxBackoff := c.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 5 * time.Minute
+	}
+	delay := time.Duration(float64(backoff) * math.Pow(2, float64(attempt-1)))
+	if delay > maxBackoff || delay <= 0 {
+		delay = maxBackoff
+	}
+	return delay
+}
+
+func (c *JobQueueServiceImpl) getWorkers() int {
+	if c.Workers <= 0 {
+		return 4
+	}
+	return c.Workers
+}
+
+func (c *JobQueueServiceImpl) getMaxAttempts() int {
+	if c.MaxAttempts <= 0 {
+		return 3
+	}
+	return c.MaxAttempts
+}
+
+func (c *JobQueueServiceImpl) getRetention() time.Duration {
+	if c.Retention <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return c.Retention
+}
+
+// Копия аргумента, не привязанная к завершившемуся запросу. Из Bag переносится только проверенная сессия
+func detachJobArg(arg interface{}) interface{} {
+	p, ok := arg.(*entities.CallParams)
+	if !ok {
+		return arg
+	}
+	r := *p
+	r.Request = nil
+	r.Bag = entities.NewBag()
+	if session := AuthenticatedSession(p); session != nil {
+		r.Bag.Set(bagKeyAuthenticatedSession, session)
+	}
+	return &r
+}
+
+// Возвращает также признак того, что редактор скрыл секреты в значениях, нужных экшену
+func (c *JobQueueServiceImpl) encodeArg(arg interface{}) (json.RawMessage, string, bool, error) {
+	redactor := c.getRedactor()
+	p, ok := arg.(*entities.CallParams)
+	if !ok {
+		value, redacted, err := redactJobValue(redactor, arg)
+		if err != nil {
+			return nil, "", false, err
+		}
+		data, err := json.Marshal(value)
+		return data, "", redacted, err
+	}
+
+	r := &jobCallParams{
+		URL: redactor.RedactString(p.URL),
+		Raw: redactor.RedactString(p.Raw),
+	}
+	if p.Caller != nil {
+		r.Caller = &jobCaller{IP: p.Caller.IP, Version: p.Caller.Version, Type: p.Caller.Type, Language: p.Caller.Language}
+		if session := AuthenticatedSession(p); session != nil && session.Account != nil {
+			r.Caller.Username = session.Account.Username
+			r.Caller.Role = session.Account.Role
+		}
+	}
+	argRedacted := false
+	for _, f := range []struct {
+		value  interface{}
+		target interface{}
+		secret bool
+	}{{p.Parameters, &r.Parameters, true}, {p.Headers, &r.Headers, false}, {p.DecodedBody, &r.DecodedBody, true}} {
+		value, redacted, err := redactJobValue(redactor, f.value)
+		if err == nil {
+			var data []byte
+			data, err = json.Marshal(value)
+			if err == nil {
+				err = json.Unmarshal(data, f.target)
+			}
+		}
+		if err != nil {
+			return nil, "", false, err
+		}
+		argRedacted = argRedacted || (redacted && f.secret)
+	}
+	data, err := json.Marshal(r)
+	return data, jobArgTypeCallParams, argRedacted, err
+}
+
+// Значение, пропущенное через редактор, и признак того, что редактор что-то скрыл
+func redactJobValue(redactor IRedactorService, v interface{}) (interface{}, bool, error) {
+	if v == nil {
+		return nil, false, nil
+	}
+	plain, err := toGeneric(v)
+	if err != nil {
+		return nil, false, err
+	}
+	plainData, err := json.Marshal(plain)
+	if err != nil {
+		return nil, false, err
+	}
+	r := redactor.Redact(plain)
+	data, err := json.Marshal(r)
+	if err != nil {
+		return nil, false, err
+	}
+	return r, !bytes.Equal(plainData, data), nil
+}
+
+func jobArgValues(v interface{}) []interface{} {
+	if values, ok := v.([]interface{}); ok {
+		return values
+	}
+	return []interface{}{v}
+}
+
+func decodeJobArg(data json.RawMessage, argType string) (interface{}, error) {
+	if argType == jobArgTypeCallParams {
+		p := &jobCallParams{}
+		if err := json.Unmarshal(data, p); err != nil {
+			return nil, err
+		}
+		r := &entities.CallParams{
+			Parameters:  map[string][]interface{}{},
+			Headers:     map[string][]string{},
+			URL:         p.URL,
+			Caller:      &entities.Caller{},
+			Raw:         p.Raw,
+			DecodedBody: p.DecodedBody,
+			Bag:         entities.NewBag(),
+		}
+		// Значения скрытых параметров редактор заменяет целиком - "***" вместо списка
+		for name, values := range p.Parameters {
+			r.Parameters[name] = jobArgValues(values)
+		}
+		for name, values := range p.Headers {
+			for _, value := range jobArgValues(values) {
+				r.Headers[name] = append(r.Headers[name], fmt.Sprint(value))
+			}
+		}
+		if p.DecodedBody != nil {
+			r.Body, _ = json.Marshal(p.DecodedBody)
+		}
+		if p.Caller != nil {
+			r.Caller = &entities.Caller{IP: p.Caller.IP, Version: p.Caller.Version, Type: p.Caller.Type, Language: p.Caller.Language}
+			if len(p.Caller.Username) > 0 {
+				session := &entities.Session{Account: &entities.Account{Username: p.Caller.Username, Role: p.Caller.Role, Lang: p.Caller.Language, IP: p.Caller.IP}}
+				r.Caller.Session = session
+				r.Bag.Set(bagKeyAuthenticatedSession, session)
+			}
+		}
+		return r, nil
+	}
+	var r interface{}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	err := json.Unmarshal(data, &r)
+	return r, err
+}
+
+// Ставит экшен в очередь и возвращает задачу. Используется асинхронными маршрутами.
+// Auth (шаги авторизации цепочки) выполняется сразу: в очередь попадает только проверенный пользователь
+type EnqueueActionImpl struct {
+	BaseActionImpl
+
+	Auth   IAction
+	Action IAction
+	Runner IActionRunner
+}
+
+// Шаги авторизации экшена выполняются при постановке в очередь, остальные - задачей
+func NewEnqueueAction(action IAction, runner IActionRunner) *EnqueueActionImpl {
+	r := &EnqueueActionImpl{Action: action, Runner: runner}
+	if splittable, ok := action.(IAuthSplittableAction); ok {
+		r.Auth, r.Action = splittable.SplitAuth()
+	}
+	return r
+}
+
+func (c *EnqueueActionImpl) SplitAuth() (IAction, IAction) {
+	if c.Auth == nil {
+		return nil, c
+	}
+	return c.Auth, &EnqueueActionImpl{Action: c.Action, Runner: c.Runner}
+}
+
+func (c *EnqueueActionImpl) GetName() string {
+	return "Enqueue(" + c.Action.GetName() + ")"
+}
+
+func (c *EnqueueActionImpl) GetSteps() []IAction {
+	if c.Auth != nil {
+		return []IAction{c.Auth, c.Action}
+	}
+	return []IAction{c.Action}
+}
+
+func (c *EnqueueActionImpl) Run(arg interface{}) (interface{}, error) {
+	if c.Auth != nil {
+		r, err := c.Auth.Run(arg)
+		if err != nil {
+			return nil, err
+		}
+		if p, ok := r.(*entities.CallParams); ok {
+			arg = p
+		}
+	}
+	job, err := c.Runner.Enqueue(c.Action, arg)
+	if err != nil {
+		return nil, err
+	}
+	return job.View(), nil
+}
+
+// Состояние фоновой задачи по id (параметр пути id либо параметр id). Ставится после GetUserAction:
+// чужая задача и задача без владельца не находятся
+type GetJobAction struct {
+	BaseActionImpl
+
+	JobQueue IJobQueueService
+}
+
+func (c *GetJobAction) GetName() string {
+	return "GetJob"
+}
+
+func (c *GetJobAction) Run(arg interface{}) (interface{}, error) {
+	p := arg.(*entities.CallParams)
+	id := p.GetParamStr("path__id")
+	if len(id) == 0 {
+		id = p.GetParamStr("id")
+	}
+	job, err := c.JobQueue.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	session := AuthenticatedSession(p)
+	if job == nil || len(job.Owner) == 0 || session == nil || session.Account == nil || job.Owner != session.Account.Username {
+		return nil, errs.NewBaseErrorWithReason(fmt.Sprintf("Задача %v не найдена", id), frmclient.ReasonServerRespondedWithErrorNotFound)
+	}
+	return job.View(), nil
+}
@@ -0,0 +1,163 @@
+package pipeline
+
+import (
+	"github.com/itskovichanton/goava/pkg/goava/utils"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testJobAction struct {
+	BaseActionImpl
+
+	lock   sync.Mutex
+	args   []*entities.CallParams
+	result interface{}
+}
+
+func (c *testJobAction) GetName() string {
+	return "testJob"
+}
+
+func (c *testJobAction) Run(arg interface{}) (interface{}, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.args = append(c.args, arg.(*entities.CallParams))
+	return c.result, nil
+}
+
+func (c *testJobAction) calls() []*entities.CallParams {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]*entities.CallParams(nil), c.args...)
+}
+
+func newTestJobArg(params map[string][]interface{}) *entities.CallParams {
+	p := &entities.CallParams{
+		Parameters: params,
+		Headers:    map[string][]string{"Authorization": {testBasicAuth}},
+		Caller:     &entities.Caller{Language: "ru"},
+		Bag:        entities.NewBag(),
+	}
+	p.Bag.Set(bagKeyAuthenticatedSession, &entities.Session{Account: &entities.Account{Username: "bob", Role: entities.RoleUser}})
+	return p
+}
+
+func waitJob(t *testing.T, queue IJobQueueService, id string) *Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := queue.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if job != nil && job.IsFinished() {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("задача %v не завершилась", id)
+	return nil
+}
+
+// Задача, поставленная до перезапуска, выполняется новой очередью от имени владельца
+func TestJobResume(t *testing.T) {
+	store := &FileJobStoreImpl{Dir: t.TempDir()}
+	action := &testJobAction{}
+	job, err := (&JobQueueServiceImpl{Store: store}).Enqueue(action, newTestJobArg(map[string][]interface{}{"amount": {"10"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner, _, _ := newTestRunner()
+	queue := &JobQueueServiceImpl{Store: store}
+	queue.RegisterAction(action)
+	if err := queue.Start(runner); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Stop()
+
+	if job = waitJob(t, queue, job.ID); job.Status != JobStatusSucceeded {
+		t.Fatalf("статус %v, ожидался %v", job.Status, JobStatusSucceeded)
+	}
+	calls := action.calls()
+	if len(calls) != 1 {
+		t.Fatalf("экшен выполнен %v раз", len(calls))
+	}
+	p := calls[0]
+	if p.GetParamStr("amount") != "10" {
+		t.Errorf("параметр не восстановлен: %v", p.Parameters)
+	}
+	if session := AuthenticatedSession(p); session == nil || session.Account.Username != "bob" {
+		t.Errorf("задача выполнена не от имени владельца: %v", utils.ToJson(session))
+	}
+}
+
+// С "***" вместо пароля экшен сделал бы не то, поэтому такая задача после перезапуска завершается ошибкой
+func TestJobWithRedactedArgIsNotResumed(t *testing.T) {
+	store := &FileJobStoreImpl{Dir: t.TempDir()}
+	action := &testJobAction{}
+	job, err := (&JobQueueServiceImpl{Store: store}).Enqueue(action, newTestJobArg(map[string][]interface{}{
+		"username": {"alice"},
+		"password": {testPassword},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.Load(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !saved.ArgRedacted || strings.Contains(string(saved.Arg), testPassword) {
+		t.Fatalf("пароль сохранен либо задача не помечена: %v", string(saved.Arg))
+	}
+
+	runner, _, _ := newTestRunner()
+	queue := &JobQueueServiceImpl{Store: store}
+	queue.RegisterAction(action)
+	if err := queue.Start(runner); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Stop()
+
+	job = waitJob(t, queue, job.ID)
+	if job.Status != JobStatusFailed || job.Result == nil || job.Result.Err == nil || job.Result.Err.Reason != ReasonJobInterrupted {
+		t.Fatalf("ожидалась ошибка %v, получено %v", ReasonJobInterrupted, utils.ToJson(job))
+	}
+	if len(action.calls()) != 0 {
+		t.Error("экшен выполнен с аргументом без пароля")
+	}
+}
+
+// В той же очереди задача с паролем выполняется с исходным аргументом, а результат сохраняется без секретов
+func TestJobResultIsRedacted(t *testing.T) {
+	store := &FileJobStoreImpl{Dir: t.TempDir()}
+	action := &testJobAction{result: map[string]interface{}{"username": "bob", "sessionToken": testSessionToken}}
+	runner, _, _ := newTestRunner()
+	queue := &JobQueueServiceImpl{Store: store}
+	if err := queue.Start(runner); err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Stop()
+
+	job, err := queue.Enqueue(action, newTestJobArg(map[string][]interface{}{"password": {testPassword}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job = waitJob(t, queue, job.ID); job.Status != JobStatusSucceeded {
+		t.Fatalf("статус %v, ожидался %v", job.Status, JobStatusSucceeded)
+	}
+	if calls := action.calls(); len(calls) != 1 || calls[0].GetParamStr("password") != testPassword {
+		t.Error("экшен получил не исходный аргумент")
+	}
+	saved, err := store.Load(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := utils.ToJson(saved.Result)
+	if strings.Contains(s, testSessionToken) || !strings.Contains(s, "bob") {
+		t.Errorf("результат сохранен с секретом: %v", s)
+	}
+}
@@ -0,0 +1,256 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/echo-http"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/goava/pkg/goava/httputils"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"net/http"
+)
+
+// Коды ошибок JSON-RPC 2.0
+const (
+	JsonRpcParseError     = -32700
+	JsonRpcInvalidRequest = -32600
+	JsonRpcMethodNotFound = -32601
+	JsonRpcInvalidParams  = -32602
+	JsonRpcInternalError  = -32603
+	JsonRpcServerError    = -32000
+
+	jsonRpcVersion         = "2.0"
+	defaultJsonRpcMaxBatch = 100
+)
+
+// Успешный ответ всегда содержит result (в т.ч. null), ответ с ошибкой - только error
+type JsonRpcResponse struct {
+	Jsonrpc string
+	Result  interface{}
+	Error   *JsonRpcError
+	ID      json.RawMessage
+}
+
+type jsonRpcResult struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type jsonRpcFailure struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Error   *JsonRpcError   `json:"error"`
+	ID      json.RawMessage `json:"id"`
+}
+
+func (c JsonRpcResponse) MarshalJSON() ([]byte, error) {
+	if c.Error != nil {
+		return json.Marshal(&jsonRpcFailure{Jsonrpc: c.Jsonrpc, Error: c.Error, ID: c.ID})
+	}
+	return json.Marshal(&jsonRpcResult{Jsonrpc: c.Jsonrpc, Result: c.Result, ID: c.ID})
+}
+
+// Data - ошибка в том же виде, что и error обычного ответа: reason, message, details, нарушения валидации
+type JsonRpcError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type jsonRpcRequest struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// Код ошибки JSON-RPC по причине. Если в реестре не задан JsonRpcCode - -32602 для ошибок валидации,
+// -32603 для внутренних ошибок, иначе -32000
+func GetJsonRpcCode(registry IReasonRegistryService, e *Err) int {
+	info := reasonRegistryOrDefault(registry).Get(e.Reason)
+	switch {
+	case info != nil && info.JsonRpcCode != 0:
+		return info.JsonRpcCode
+	case e.Reason == frmclient.ReasonValidation:
+		return JsonRpcInvalidParams
+	case info == nil || e.Reason == frmclient.ReasonInternal || e.Reason == frmclient.ReasonTechnical:
+		return JsonRpcInternalError
+	}
+	return JsonRpcServerError
+}
+
+// Регистрирует метод JSON-RPC. Вызывается до Start либо в модификаторе роутера. Эндпоинт работает, только если задан server.jsonRpc
+func (c *HttpControllerImpl) HandleRpcMethod(method string, action IAction) {
+	if c.rpcMethods == nil {
+		c.rpcMethods = map[string]IAction{}
+	}
+	c.rpcMethods[method] = action
+}
+
+func (c *HttpControllerImpl) getRpcPath() string {
+	if c.Config.Server.JsonRpc != nil && len(c.Config.Server.JsonRpc.Path) > 0 {
+		return c.Config.Server.JsonRpc.Path
+	}
+	return "/rpc"
+}
+
+func (c *HttpControllerImpl) getRpcMaxBatch() int {
+	if c.Config.Server.JsonRpc != nil && c.Config.Server.JsonRpc.MaxBatch > 0 {
+		return c.Config.Server.JsonRpc.MaxBatch
+	}
+	return defaultJsonRpcMaxBatch
+}
+
+func (c *HttpControllerImpl) initConfiguredRpcMethods() error {
+	if c.Config.Server.JsonRpc == nil {
+		return nil
+	}
+	for i, method := range c.Config.Server.JsonRpc.Methods {
+		if len(method.Name) == 0 || len(method.Actions) == 0 {
+			return errs.NewBaseError(fmt.Sprintf("Метод server.jsonRpc.methods[%v]: нужны name и actions", i))
+		}
+		var actions []IAction
+		for _, name := range method.Actions {
+			a, err := c.ActionRegistry.Get(name)
+			if err != nil {
+				return errs.NewBaseErrorFromCauseMsg(err, fmt.Sprintf("Метод server.jsonRpc.methods[%v] %v: %v", i, method.Name, err.Error()))
+			}
+			actions = append(actions, a)
+		}
+		c.HandleRpcMethod(method.Name, &ChainedActionImpl{Name: method.Name, Actions: actions})
+	}
+	return nil
+}
+
+// Обрабатывает запрос JSON-RPC 2.0: одиночный либо пакет. На уведомления (без id) ответ не отправляется
+func (c *HttpControllerImpl) handleRpc(context echo.Context) error {
+
+	maxSize, err := getMaxRequestSizeBytes(c.Config)
+	if err != nil {
+		return err
+	}
+	if maxSize > 0 {
+		context.Request().Body = http.MaxBytesReader(context.Response(), context.Request().Body, int64(maxSize))
+	}
+	body, err := readBody(context.Request().Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return context.JSON(http.StatusRequestEntityTooLarge, c.rpcError(nil, JsonRpcInvalidRequest, "Превышен допустимый размер запроса", nil))
+		}
+		return context.JSON(http.StatusOK, c.rpcError(nil, JsonRpcParseError, "Не удалось прочитать запрос", nil))
+	}
+	body = bytes.TrimSpace(body)
+
+	if len(body) > 0 && body[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(body, &batch); err != nil {
+			return context.JSON(http.StatusOK, c.rpcError(nil, JsonRpcParseError, "Некорректный JSON", nil))
+		}
+		if len(batch) == 0 || len(batch) > c.getRpcMaxBatch() {
+			return context.JSON(http.StatusOK, c.rpcError(nil, JsonRpcInvalidRequest, fmt.Sprintf("Пакет должен содержать от 1 до %v запросов", c.getRpcMaxBatch()), nil))
+		}
+		var responses []*JsonRpcResponse
+		for _, raw := range batch {
+			if response := c.callRpc(context, raw); response != nil {
+				responses = append(responses, response)
+			}
+		}
+		if len(responses) == 0 {
+			return context.NoContent(http.StatusNoContent)
+		}
+		return context.JSON(http.StatusOK, responses)
+	}
+
+	if !json.Valid(body) {
+		return context.JSON(http.StatusOK, c.rpcError(nil, JsonRpcParseError, "Некорректный JSON", nil))
+	}
+	response := c.callRpc(context, body)
+	if response == nil {
+		return context.NoContent(http.StatusNoContent)
+	}
+	return context.JSON(http.StatusOK, response)
+}
+
+// Возвращает nil для уведомлений
+func (c *HttpControllerImpl) callRpc(context echo.Context, raw json.RawMessage) *JsonRpcResponse {
+
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &members); err != nil {
+		return c.rpcError(nil, JsonRpcInvalidRequest, "Запрос должен быть объектом", nil)
+	}
+	id, hasID := members["id"]
+	request := &jsonRpcRequest{}
+	if err := json.Unmarshal(raw, request); err != nil || request.Jsonrpc != jsonRpcVersion || len(request.Method) == 0 {
+		return c.rpcError(id, JsonRpcInvalidRequest, "Нужны jsonrpc \"2.0\" и method", nil)
+	}
+
+	action, ok := c.rpcMethods[request.Method]
+	if !ok {
+		if !hasID {
+			return nil
+		}
+		return c.rpcError(id, JsonRpcMethodNotFound, fmt.Sprintf("Метод %v не найден", request.Method), nil)
+	}
+
+	params := bytes.TrimSpace(request.Params)
+	if len(params) > 0 && params[0] != '{' && !bytes.Equal(params, []byte("null")) {
+		if !hasID {
+			return nil
+		}
+		return c.rpcError(id, JsonRpcInvalidParams, "Поддерживаются только именованные параметры (объект)", nil)
+	}
+
+	result := c.ActionRunner.Run(action, func() (interface{}, error) {
+		return c.readRpcCallParams(context, params)
+	}, c.ErrorProviderService)
+
+	if !hasID {
+		return nil
+	}
+	if result.Err != nil {
+		var data interface{} = result.Err
+		if model, ok := (&ResponseModelProviderImpl{}).ToModel(result).(*ValidationErrorModel); ok {
+			data = model.Error
+		}
+		return c.rpcError(id, GetJsonRpcCode(c.ReasonRegistry, result.Err), result.Err.Message, data)
+	}
+	return &JsonRpcResponse{Jsonrpc: jsonRpcVersion, Result: result.Res, ID: id}
+}
+
+// CallParams вызова: вызывающий (в т.ч. авторизация) - из заголовков http-запроса, параметры - из params
+func (c *HttpControllerImpl) readRpcCallParams(context echo.Context, params json.RawMessage) (*entities.CallParams, error) {
+	p := &entities.CallParams{
+		Request:    context,
+		Parameters: map[string][]interface{}{},
+		Headers:    context.Request().Header,
+		URL:        httputils.GetUrl(context.Request()),
+		Caller:     c.EntityFromHTTPReaderService.ReadCaller(context),
+		Raw:        context.Request().URL.RawQuery,
+		Body:       params,
+		Bag:        entities.NewBag(),
+	}
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		return p, nil
+	}
+	decoded, err := (&JSONBodyDecoderImpl{}).Decode(params)
+	if err != nil {
+		return nil, errs.NewBaseErrorFromCauseMsgReason(err, "Не удалось разобрать params", frmclient.ReasonValidation)
+	}
+	p.DecodedBody = decoded
+	flattenBody("", decoded, p.Parameters)
+	return p, nil
+}
+
+func (c *HttpControllerImpl) rpcError(id json.RawMessage, code int, message string, data interface{}) *JsonRpcResponse {
+	if len(id) == 0 {
+		id = json.RawMessage("null")
+	}
+	return &JsonRpcResponse{
+		Jsonrpc: jsonRpcVersion,
+		Error:   &JsonRpcError{Code: code, Message: message, Data: data},
+		ID:      id,
+	}
+}
@@ -0,0 +1,133 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/echo-http"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/server/pkg/server"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+type testHTTPReader struct {
+	IEntityFromHTTPReaderService
+}
+
+func (c *testHTTPReader) ReadCaller(r echo.Context) *entities.Caller {
+	return &entities.Caller{}
+}
+
+type testGreetAction struct {
+	BaseActionImpl
+
+	calls int32
+}
+
+func (c *testGreetAction) GetName() string {
+	return "testGreet"
+}
+
+func (c *testGreetAction) Run(arg interface{}) (interface{}, error) {
+	atomic.AddInt32(&c.calls, 1)
+	name := arg.(*entities.CallParams).GetParamStr("name")
+	if len(name) == 0 {
+		return nil, errs.NewBaseErrorWithReason("Не задано имя", frmclient.ReasonValidation)
+	}
+	return "hello " + name, nil
+}
+
+func newTestRpcController() (*HttpControllerImpl, *testGreetAction) {
+	runner, _, _ := newTestRunner()
+	action := &testGreetAction{}
+	c := &HttpControllerImpl{
+		Config:                      &server.Config{Server: &server.Server{}},
+		ActionRunner:                runner,
+		EntityFromHTTPReaderService: &testHTTPReader{},
+		ErrorProviderService:        runner.DefaultErrorProviderService,
+		EchoEngine:                  echo.New(),
+	}
+	c.HandleRpcMethod("greet", action)
+	return c, action
+}
+
+// Возвращает http-код и тело ответа как JSON-значение
+func postRpc(t *testing.T, c *HttpControllerImpl, body string) (int, interface{}) {
+	t.Helper()
+	request := httptest.NewRequest(http.MethodPost, "/rpc", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	if err := c.handleRpc(c.EchoEngine.NewContext(request, recorder)); err != nil {
+		t.Fatal(err)
+	}
+	var r interface{}
+	if recorder.Body.Len() > 0 {
+		if err := json.Unmarshal(recorder.Body.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return recorder.Code, r
+}
+
+func rpcErrorCode(response interface{}) float64 {
+	e, _ := response.(map[string]interface{})["error"].(map[string]interface{})
+	if e == nil {
+		return 0
+	}
+	return e["code"].(float64)
+}
+
+func TestJsonRpcCall(t *testing.T) {
+	c, _ := newTestRpcController()
+	_, r := postRpc(t, c, `{"jsonrpc": "2.0", "method": "greet", "params": {"name": "bob"}, "id": 7}`)
+	response := r.(map[string]interface{})
+	if response["result"] != "hello bob" || response["id"] != float64(7) || response["error"] != nil {
+		t.Errorf("ответ %v", response)
+	}
+}
+
+func TestJsonRpcNotifications(t *testing.T) {
+	c, action := newTestRpcController()
+
+	if code, r := postRpc(t, c, `{"jsonrpc": "2.0", "method": "greet", "params": {"name": "bob"}}`); code != http.StatusNoContent || r != nil {
+		t.Errorf("на уведомление отправлен ответ %v: %v", code, r)
+	}
+	if code, _ := postRpc(t, c, `[{"jsonrpc": "2.0", "method": "greet"}, {"jsonrpc": "2.0", "method": "missing"}]`); code != http.StatusNoContent {
+		t.Errorf("на пакет из уведомлений отправлен ответ %v", code)
+	}
+	if action.calls != 2 {
+		t.Errorf("уведомления выполнены %v раз, ожидалось 2", action.calls)
+	}
+
+	_, r := postRpc(t, c, `[
+		{"jsonrpc": "2.0", "method": "greet", "params": {"name": "bob"}, "id": 1},
+		{"jsonrpc": "2.0", "method": "greet", "params": {"name": "alice"}},
+		{"jsonrpc": "2.0", "method": "missing", "id": 2}
+	]`)
+	responses := r.([]interface{})
+	if len(responses) != 2 || rpcErrorCode(responses[1]) != JsonRpcMethodNotFound {
+		t.Errorf("пакет: %v", responses)
+	}
+}
+
+func TestJsonRpcErrorCodes(t *testing.T) {
+	c, _ := newTestRpcController()
+	for _, test := range []struct {
+		body string
+		code float64
+	}{
+		{`{"jsonrpc": "2.0", "method": "greet", "id": 1`, JsonRpcParseError},
+		{`{"method": "greet", "id": 1}`, JsonRpcInvalidRequest},
+		{`[]`, JsonRpcInvalidRequest},
+		{`{"jsonrpc": "2.0", "method": "missing", "id": 1}`, JsonRpcMethodNotFound},
+		{`{"jsonrpc": "2.0", "method": "greet", "params": ["bob"], "id": 1}`, JsonRpcInvalidParams},
+		{`{"jsonrpc": "2.0", "method": "greet", "params": {}, "id": 1}`, JsonRpcInvalidParams},
+	} {
+		if _, r := postRpc(t, c, test.body); rpcErrorCode(r) != test.code {
+			t.Errorf("%v: ответ %v, ожидался код %v", test.body, r, test.code)
+		}
+	}
+}
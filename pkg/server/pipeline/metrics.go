@@ -0,0 +1,80 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Счетчики сервера. Экспортируются в текстовом формате Prometheus
+type IMetricsService interface {
+	Inc(name string, labels map[string]string)
+	Get(name string, labels map[string]string) int64
+	ExportPrometheus() string
+}
+
+type MetricsServiceImpl struct {
+	IMetricsService
+
+	lock     sync.RWMutex
+	counters map[string]map[string]int64
+}
+
+func (c *MetricsServiceImpl) Inc(name string, labels map[string]string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counters == nil {
+		c.counters = map[string]map[string]int64{}
+	}
+	series := c.counters[name]
+	if series == nil {
+		series = map[string]int64{}
+		c.counters[name] = series
+	}
+	series[formatLabels(labels)]++
+}
+
+func (c *MetricsServiceImpl) Get(name string, labels map[string]string) int64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.counters[name][formatLabels(labels)]
+}
+
+func (c *MetricsServiceImpl) ExportPrometheus() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	var names []string
+	for name := range c.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(fmt.Sprintf("# TYPE %v counter\n", name))
+		var series []string
+		for labels := range c.counters[name] {
+			series = append(series, labels)
+		}
+		sort.Strings(series)
+		for _, labels := range series {
+			b.WriteString(fmt.Sprintf("%v%v %v\n", name, labels, c.counters[name][labels]))
+		}
+	}
+	return b.String()
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var pairs []string
+	for k, v := range labels {
+		v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, k, v))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,383 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/itskovichanton/echo-http"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	ReasonNotAcceptable = "REASON_NOT_ACCEPTABLE"
+
+	// Параметр запроса, явно задающий формат ответа
+	ParamResponseFormat = "format"
+)
+
+// Сериализует модель ответа в определенный формат
+type IResponseEncoder interface {
+	GetContentType() string
+
+	// Короткое имя формата для параметра format (json, xml, ...)
+	GetFormat() string
+	Encode(model interface{}) ([]byte, error)
+}
+
+// Выбирает формат ответа по параметру format либо заголовку Accept. Сначала ищется энкодер среди наиболее
+// предпочтительных типов Accept, затем - первый энкодер, если Accept допускает его (*/*, application/*, его тип):
+// браузеры (text/html, ..., application/xml;q=0.9, */*;q=0.8) получают JSON. Затем - любой тип из Accept.
+// Без Accept - первый энкодер. Неизвестный format и Accept, которому не подходит ни один энкодер, - 406
+type NegotiatingResponsePresenterImpl struct {
+	ResponsePresenterImpl
+
+	// Первый энкодер используется по умолчанию
+	Encoders []IResponseEncoder
+}
+
+func (c *NegotiatingResponsePresenterImpl) RegisterEncoder(encoder IResponseEncoder) {
+	c.Encoders = append(c.Encoders, encoder)
+}
+
+func (c *NegotiatingResponsePresenterImpl) Write(context echo.Context, result *Result, httpStatus int) error {
+
+	context.Response().Header().Add(echo.HeaderVary, "Accept")
+
+	encoder := c.Negotiate(context.QueryParam(ParamResponseFormat), context.Request().Header.Get(echo.HeaderAccept))
+	if encoder == nil {
+		return context.JSON(http.StatusNotAcceptable, c.ResponseModelProvider.ToModel(&Result{
+			Err: &Err{
+				Reason:  ReasonNotAcceptable,
+				Message: fmt.Sprintf("Неподдерживаемый формат ответа. Доступны: %v", strings.Join(c.getContentTypes(), ", ")),
+			},
+		}))
+	}
+
+	if notModified, err := c.WriteCacheHeaders(context, result); notModified || err != nil {
+		return err
+	}
+	httpStatus = c.GetHttpResponseCode(result, httpStatus)
+	body, err := encoder.Encode(c.ResponseModelProvider.ToModel(result))
+	if err != nil {
+		return err
+	}
+	return context.Blob(httpStatus, encoder.GetContentType(), body)
+}
+
+func (c *NegotiatingResponsePresenterImpl) Negotiate(format string, accept string) IResponseEncoder {
+
+	if len(c.Encoders) == 0 {
+		return nil
+	}
+
+	if len(format) > 0 {
+		for _, e := range c.Encoders {
+			if strings.EqualFold(e.GetFormat(), format) {
+				return e
+			}
+		}
+		return nil
+	}
+
+	if len(strings.TrimSpace(accept)) == 0 {
+		return c.Encoders[0]
+	}
+	ranges := parseAccept(accept)
+	for _, r := range ranges {
+		if r.q < ranges[0].q {
+			break
+		}
+		for _, e := range c.Encoders {
+			if r.value == mediaType(e.GetContentType()) {
+				return e
+			}
+		}
+	}
+	for _, r := range ranges {
+		if r.matches(c.Encoders[0].GetContentType()) {
+			return c.Encoders[0]
+		}
+	}
+	for _, r := range ranges {
+		for _, e := range c.Encoders {
+			if r.matches(e.GetContentType()) {
+				return e
+			}
+		}
+	}
+	return nil
+}
+
+func (c *NegotiatingResponsePresenterImpl) getContentTypes() []string {
+	var r []string
+	for _, e := range c.Encoders {
+		r = append(r, e.GetContentType())
+	}
+	return r
+}
+
+type mediaRange struct {
+	value string
+	q     float64
+}
+
+// Тип подходит под диапазон: совпадает с ним, */* либо тип/*
+func (c mediaRange) matches(contentType string) bool {
+	t := mediaType(contentType)
+	if c.value == "*/*" || c.value == t {
+		return true
+	}
+	return strings.HasSuffix(c.value, "/*") && strings.HasPrefix(t, strings.TrimSuffix(c.value, "*"))
+}
+
+// Возвращает media ranges из Accept в порядке убывания q (q=0 исключаются)
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		value := strings.ToLower(strings.TrimSpace(fields[0]))
+		if len(value) == 0 {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if x, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = x
+				}
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, mediaRange{value: value, q: q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].q > ranges[j].q
+	})
+	return ranges
+}
+
+func mediaType(contentType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
+
+func DefaultResponseEncoders() []IResponseEncoder {
+	return []IResponseEncoder{
+		&JSONResponseEncoderImpl{},
+		&XMLResponseEncoderImpl{},
+		&MsgpackResponseEncoderImpl{},
+		&CBORResponseEncoderImpl{},
+		&ProtobufResponseEncoderImpl{},
+	}
+}
+
+type JSONResponseEncoderImpl struct {
+	IResponseEncoder
+}
+
+func (c *JSONResponseEncoderImpl) GetContentType() string {
+	return echo.MIMEApplicationJSONCharsetUTF8
+}
+
+func (c *JSONResponseEncoderImpl) GetFormat() string {
+	return "json"
+}
+
+func (c *JSONResponseEncoderImpl) Encode(model interface{}) ([]byte, error) {
+	return json.Marshal(model)
+}
+
+// Модель приводится к виду JSON-ответа (с учетом json-тегов), ключи - элементы, элементы массивов - <item>.
+// Ключ, не являющийся допустимым именем элемента, приводится к нему, исходный ключ - в атрибуте key
+type XMLResponseEncoderImpl struct {
+	IResponseEncoder
+}
+
+func (c *XMLResponseEncoderImpl) GetContentType() string {
+	return echo.MIMEApplicationXMLCharsetUTF8
+}
+
+func (c *XMLResponseEncoderImpl) GetFormat() string {
+	return "xml"
+}
+
+func (c *XMLResponseEncoderImpl) Encode(model interface{}) ([]byte, error) {
+	generic, err := toGeneric(model)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	e := xml.NewEncoder(&b)
+	if err = c.encodeElement(e, "response", generic); err != nil {
+		return nil, err
+	}
+	if err = e.Flush(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (c *XMLResponseEncoderImpl) encodeElement(e *xml.Encoder, name string, v interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: xmlElementName(name)}}
+	if start.Name.Local != name {
+		start.Attr = []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}}
+	}
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := c.encodeElement(e, k, x[k]); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range x {
+			if err := c.encodeElement(e, "item", item); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := e.EncodeToken(xml.CharData(fmt.Sprintf("%v", x))); err != nil {
+			return err
+		}
+	}
+	return e.EncodeToken(start.End())
+}
+
+var (
+	xmlNameInvalidCharExpr  = regexp.MustCompile(`[^\p{L}\p{N}_.-]`)
+	xmlNameInvalidStartExpr = regexp.MustCompile(`^[^\p{L}_]`)
+)
+
+// Допустимое имя элемента XML: недопустимые символы заменяются на _, имя не начинается с цифры, -, . или xml
+func xmlElementName(name string) string {
+	r := xmlNameInvalidCharExpr.ReplaceAllString(name, "_")
+	if len(r) == 0 || xmlNameInvalidStartExpr.MatchString(r) || strings.HasPrefix(strings.ToLower(r), "xml") {
+		r = "_" + r
+	}
+	return r
+}
+
+type MsgpackResponseEncoderImpl struct {
+	IResponseEncoder
+}
+
+func (c *MsgpackResponseEncoderImpl) GetContentType() string {
+	return echo.MIMEApplicationMsgpack
+}
+
+func (c *MsgpackResponseEncoderImpl) GetFormat() string {
+	return "msgpack"
+}
+
+func (c *MsgpackResponseEncoderImpl) Encode(model interface{}) ([]byte, error) {
+	generic, err := toGeneric(model)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(generic)
+}
+
+type CBORResponseEncoderImpl struct {
+	IResponseEncoder
+}
+
+func (c *CBORResponseEncoderImpl) GetContentType() string {
+	return "application/cbor"
+}
+
+func (c *CBORResponseEncoderImpl) GetFormat() string {
+	return "cbor"
+}
+
+func (c *CBORResponseEncoderImpl) Encode(model interface{}) ([]byte, error) {
+	generic, err := toGeneric(model)
+	if err != nil {
+		return nil, err
+	}
+	return cbor.Marshal(generic)
+}
+
+// Модель сериализуется как google.protobuf.Struct
+type ProtobufResponseEncoderImpl struct {
+	IResponseEncoder
+}
+
+func (c *ProtobufResponseEncoderImpl) GetContentType() string {
+	return echo.MIMEApplicationProtobuf
+}
+
+func (c *ProtobufResponseEncoderImpl) GetFormat() string {
+	return "protobuf"
+}
+
+func (c *ProtobufResponseEncoderImpl) Encode(model interface{}) ([]byte, error) {
+	generic, err := toGeneric(model)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := generic.(map[string]interface{})
+	if !ok {
+		m = map[string]interface{}{"value": generic}
+	}
+	s, err := structpb.NewStruct(m)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(s)
+}
+
+// Приводит модель к map/slice/скалярам через JSON, чтобы все форматы учитывали json-теги.
+// Целые числа остаются int64
+func toGeneric(model interface{}) (interface{}, error) {
+	b, err := json.Marshal(model)
+	if err != nil {
+		return nil, err
+	}
+	var r interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err = d.Decode(&r); err != nil {
+		return nil, err
+	}
+	return convertNumbers(r), nil
+}
+
+func convertNumbers(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		f, _ := x.Float64()
+		return f
+	case map[string]interface{}:
+		for k, child := range x {
+			x[k] = convertNumbers(child)
+		}
+	case []interface{}:
+		for i, child := range x {
+			x[i] = convertNumbers(child)
+		}
+	}
+	return v
+}
@@ -0,0 +1,32 @@
+package pipeline
+
+import "testing"
+
+func TestNegotiate(t *testing.T) {
+	presenter := &NegotiatingResponsePresenterImpl{Encoders: DefaultResponseEncoders()}
+	for _, c := range []struct {
+		name   string
+		format string
+		accept string
+		want   string
+	}{
+		{name: "без Accept", want: "json"},
+		{name: "format", format: "xml", accept: "application/json", want: "xml"},
+		{name: "неизвестный format", format: "yaml"},
+		{name: "точный тип", accept: "application/cbor", want: "cbor"},
+		{name: "браузер", accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", want: "json"},
+		{name: "application/*", accept: "text/html, application/*;q=0.5", want: "json"},
+		{name: "менее предпочтительный тип", accept: "text/plain, application/xml;q=0.5", want: "xml"},
+		{name: "ничего не подходит", accept: "text/plain"},
+		{name: "только q=0", accept: "application/json;q=0"},
+	} {
+		encoder := presenter.Negotiate(c.format, c.accept)
+		got := ""
+		if encoder != nil {
+			got = encoder.GetFormat()
+		}
+		if got != c.want {
+			t.Errorf("%v: получен формат %q, ожидался %q", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package pipeline
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"github.com/itskovichanton/echo-http"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Экшен может описать свои параметры и результат для OpenAPI-спецификации
+type IDocumentedAction interface {
+	GetApiDoc() *ApiDoc
+}
+
+type ApiDoc struct {
+	Summary     string
+	Description string
+	Tags        []string
+	Params      []*ApiParam
+
+	// Пример значения результата (например &entities.Session{}), по нему строится схема поля result
+	Result interface{}
+}
+
+const (
+	ApiParamInQuery  = "query"
+	ApiParamInPath   = "path"
+	ApiParamInHeader = "header"
+	ApiParamInForm   = "form"
+)
+
+type ApiParam struct {
+	Name        string
+	In          string
+	Type        string
+	Required    bool
+	Description string
+}
+
+type RouteInfo struct {
+	Methods   []string
+	Path      string
+	Action    IAction
+	Presenter IResponsePresenter
+}
+
+// Строит OpenAPI 3 документ по маршрутам echo и документации экшенов
+type IOpenApiService interface {
+	Generate(routes []*RouteInfo, echoRoutes []*echo.Route) map[string]interface{}
+}
+
+type OpenApiServiceImpl struct {
+	IOpenApiService
+
+	Title     string
+	Version   string
+	Presenter *ResponsePresenterImpl
+}
+
+// Схемы components.schemas, собираемые за один вызов Generate. Ключ - тип с полным путем пакета
+type openApiSchemas map[string]interface{}
+
+var openApiSchemaNameExpr = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+func (c *OpenApiServiceImpl) Generate(routes []*RouteInfo, echoRoutes []*echo.Route) map[string]interface{} {
+
+	schemas := openApiSchemas{}
+	schemas.schemaRef(reflect.TypeOf(Result{}))
+	schemas.schemaRef(reflect.TypeOf(ValidationErrorModel{}))
+
+	paths := map[string]map[string]interface{}{}
+	documented := map[string]bool{}
+	for _, r := range routes {
+		for _, m := range r.Methods {
+			c.addOperation(schemas, paths, m, r.Path, r.Action)
+			documented[m+" "+r.Path] = true
+		}
+	}
+	for _, r := range echoRoutes {
+		if !documented[r.Method+" "+r.Path] && !strings.HasSuffix(r.Path, "/*") {
+			c.addOperation(schemas, paths, r.Method, r.Path, nil)
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   c.Title,
+			"version": c.Version,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}(schemas),
+			"securitySchemes": map[string]interface{}{
+				"basicAuth":    map[string]interface{}{"type": "http", "scheme": "basic"},
+				"sessionToken": map[string]interface{}{"type": "apiKey", "in": "header", "name": "sessionToken"},
+			},
+		},
+	}
+}
+
+func (c *OpenApiServiceImpl) addOperation(schemas openApiSchemas, paths map[string]map[string]interface{}, method, path string, action IAction) {
+
+	docs := collectApiDocs(action)
+	op := map[string]interface{}{
+		"responses": c.responses(schemas, docs),
+		"security": []interface{}{
+			map[string]interface{}{},
+			map[string]interface{}{"basicAuth": []string{}},
+			map[string]interface{}{"sessionToken": []string{}},
+		},
+	}
+	if action != nil {
+		op["operationId"] = action.GetName()
+	}
+
+	var summaries, descriptions, tags []string
+	var params []interface{}
+	var formProps = map[string]interface{}{}
+	var formRequired []string
+	for _, d := range docs {
+		if len(d.Summary) > 0 {
+			summaries = append(summaries, d.Summary)
+		}
+		if len(d.Description) > 0 {
+			descriptions = append(descriptions, d.Description)
+		}
+		tags = append(tags, d.Tags...)
+		for _, p := range d.Params {
+			if p.In == ApiParamInForm {
+				formProps[p.Name] = c.paramSchema(p)
+				if p.Required {
+					formRequired = append(formRequired, p.Name)
+				}
+				continue
+			}
+			in := p.In
+			if len(in) == 0 {
+				in = ApiParamInQuery
+			}
+			params = append(params, map[string]interface{}{
+				"name":        p.Name,
+				"in":          in,
+				"required":    p.Required || in == ApiParamInPath,
+				"description": p.Description,
+				"schema":      c.paramSchema(p),
+			})
+		}
+	}
+
+	for _, name := range echoPathParams(path) {
+		if !hasParam(params, name) {
+			params = append(params, map[string]interface{}{
+				"name":     name,
+				"in":       ApiParamInPath,
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+
+	if len(summaries) > 0 {
+		op["summary"] = strings.Join(summaries, " → ")
+	}
+	if len(descriptions) > 0 {
+		op["description"] = strings.Join(descriptions, "\n\n")
+	}
+	if len(tags) > 0 {
+		op["tags"] = tags
+	}
+	if len(params) > 0 {
+		op["parameters"] = params
+	}
+	if len(formProps) > 0 && method != http.MethodGet {
+		schema := map[string]interface{}{"type": "object", "properties": formProps}
+		if len(formRequired) > 0 {
+			schema["required"] = formRequired
+		}
+		op["requestBody"] = map[string]interface{}{
+			"content": map[string]interface{}{
+				echo.MIMEMultipartForm:   map[string]interface{}{"schema": schema},
+				echo.MIMEApplicationForm: map[string]interface{}{"schema": schema},
+			},
+		}
+	}
+
+	openApiPath := toOpenApiPath(path)
+	if paths[openApiPath] == nil {
+		paths[openApiPath] = map[string]interface{}{}
+	}
+	paths[openApiPath][strings.ToLower(method)] = op
+}
+
+func (c *OpenApiServiceImpl) responses(schemas openApiSchemas, docs []*ApiDoc) map[string]interface{} {
+
+	var resultSchema interface{} = schemas.schemaRef(reflect.TypeOf(Result{}))
+	for i := len(docs) - 1; i >= 0; i-- {
+		if docs[i].Result != nil {
+			resultSchema = map[string]interface{}{
+				"allOf": []interface{}{
+					resultSchema,
+					map[string]interface{}{
+						"properties": map[string]interface{}{
+							"result": schemas.schemaOf(reflect.TypeOf(docs[i].Result)),
+						},
+					},
+				},
+			}
+			break
+		}
+	}
+
+	r := map[string]interface{}{
+		strconv.Itoa(http.StatusOK): jsonResponse("Успешный вызов либо ошибка ERRCODE_SERVER_RESPONDED_WITH_ERROR", resultSchema),
+	}
+
+	reasonsByStatus := map[int][]string{}
+	for _, info := range reasonRegistryOrDefault(c.Presenter.ReasonRegistry).All() {
+		status := c.Presenter.GetHttpResponseCode(&Result{Err: &Err{Reason: info.Reason}}, 0)
+		if status == http.StatusOK || status == http.StatusNotModified {
+			continue
+		}
+		reasonsByStatus[status] = append(reasonsByStatus[status], info.Reason)
+	}
+	for status, reasons := range reasonsByStatus {
+		var schema interface{} = schemas.schemaRef(reflect.TypeOf(Result{}))
+		if status == http.StatusBadRequest {
+			schema = schemas.schemaRef(reflect.TypeOf(ValidationErrorModel{}))
+		}
+		sort.Strings(reasons)
+		r[strconv.Itoa(status)] = jsonResponse(fmt.Sprintf("%v: %v", http.StatusText(status), strings.Join(reasons, ", ")), schema)
+	}
+	return r
+}
+
+func jsonResponse(description string, schema interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			echo.MIMEApplicationJSON: map[string]interface{}{"schema": schema},
+		},
+	}
+}
+
+func (c *OpenApiServiceImpl) paramSchema(p *ApiParam) map[string]interface{} {
+	switch p.Type {
+	case "", "string":
+		return map[string]interface{}{"type": "string"}
+	case "file":
+		return map[string]interface{}{"type": "string", "format": "binary"}
+	case "int64":
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	}
+	return map[string]interface{}{"type": p.Type}
+}
+
+func (c openApiSchemas) schemaRef(t reflect.Type) map[string]interface{} {
+	// Одноименные типы из разных пакетов - разные схемы
+	name := openApiSchemaNameExpr.ReplaceAllString(strings.ReplaceAll(t.PkgPath(), "/", ".")+"."+t.Name(), "_")
+	if _, ok := c[name]; !ok {
+		c[name] = map[string]interface{}{}
+		c[name] = c.structSchema(t)
+	}
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func (c openApiSchemas) schemaOf(t reflect.Type) map[string]interface{} {
+
+	if t == nil {
+		return map[string]interface{}{}
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": c.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": c.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if len(t.Name()) > 0 {
+			return c.schemaRef(t)
+		}
+		return c.structSchema(t)
+	}
+	return map[string]interface{}{}
+}
+
+func (c openApiSchemas) structSchema(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	c.collectProps(t, props)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
+
+func (c openApiSchemas) collectProps(t reflect.Type, props map[string]interface{}) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if f.Anonymous && len(name) == 0 {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				c.collectProps(ft, props)
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+		props[name] = c.schemaOf(f.Type)
+	}
+}
+
+// Собирает документацию экшена и всех шагов цепочки (комбинатора)
+func collectApiDocs(action IAction) []*ApiDoc {
+	var r []*ApiDoc
+	switch a := action.(type) {
+	case nil:
+		return nil
+	case ICompositeAction:
+		for _, step := range a.GetSteps() {
+			r = append(r, collectApiDocs(step)...)
+		}
+		return r
+	case IDocumentedAction:
+		if d := a.GetApiDoc(); d != nil {
+			r = append(r, d)
+		}
+	}
+	return r
+}
+
+func toOpenApiPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i, p := range parts {
+		if strings.HasPrefix(p, ":") {
+			parts[i] = "{" + p[1:] + "}"
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+func echoPathParams(path string) []string {
+	var r []string
+	for _, p := range strings.Split(path, "/") {
+		if strings.HasPrefix(p, ":") {
+			r = append(r, p[1:])
+		}
+	}
+	return r
+}
+
+func hasParam(params []interface{}, name string) bool {
+	for _, p := range params {
+		if p.(map[string]interface{})["name"] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Ресурсы Swagger UI встроены в бинарник: страница не зависит от CDN, а инициализация вынесена в файл,
+// чтобы ее не блокировала CSP без 'unsafe-inline'
+//
+//go:embed swaggerui/*.js swaggerui/*.css
+var swaggerUIFiles embed.FS
+
+const swaggerUIAssetsPath = "/api/docs/assets/"
+
+var swaggerUIPage = template.Must(template.New("swaggerUI").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8"/>
+  <title>{{.Title}}</title>
+  <link rel="stylesheet" href="{{.Assets}}swagger-ui.css"/>
+</head>
+<body>
+<div id="swagger-ui" data-url="{{.SpecUrl}}"></div>
+<script src="{{.Assets}}swagger-ui-bundle.js"></script>
+<script src="{{.Assets}}swagger-initializer.js"></script>
+</body>
+</html>`))
+
+func writeSwaggerUIPage(context echo.Context, title string, specUrl string) error {
+	var b bytes.Buffer
+	if err := swaggerUIPage.Execute(&b, map[string]string{"Title": title, "SpecUrl": specUrl, "Assets": swaggerUIAssetsPath}); err != nil {
+		return err
+	}
+	return context.HTMLBlob(http.StatusOK, b.Bytes())
+}
+
+func swaggerUIAssets() fs.FS {
+	return echo.MustSubFS(swaggerUIFiles, "swaggerui")
+}
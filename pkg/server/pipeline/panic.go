@@ -0,0 +1,72 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"runtime/debug"
+)
+
+const MetricActionPanics = "action_panics_total"
+
+// Паника внутри экшена, перехваченная раннером
+type PanicError struct {
+	errs.BaseError
+
+	Action string
+	Value  interface{}
+	Stack  string
+}
+
+func NewPanicError(action string, value interface{}) *PanicError {
+	return &PanicError{
+		BaseError: *errs.NewBaseErrorWithReason(frmclient.InternalErrorMessage, frmclient.ReasonInternal),
+		Action:    action,
+		Value:     value,
+		Stack:     string(debug.Stack()),
+	}
+}
+
+func (c *PanicError) GetDetails() string {
+	return fmt.Sprintf("panic в %v: %v\n%v", c.Action, c.Value, c.Stack)
+}
+
+// Вызывается отложенно: превращает панику в PanicError и записывает ее в err
+func (c *ActionRunnerImpl) recoverPanic(action string, err *error) {
+	if r := recover(); r != nil {
+		panicErr := NewPanicError(action, r)
+		c.onPanic(panicErr)
+		*err = panicErr
+	}
+}
+
+// Паника в хуке (OnError, OnFinished) не меняет результат, но учитывается и алертится
+func (c *ActionRunnerImpl) callSafely(action IAction, f func()) {
+	var err error
+	defer func() {
+		if err != nil {
+			c.sendPanicAlert(action, err.(*PanicError))
+		}
+	}()
+	defer c.recoverPanic(action.GetName(), &err)
+	f()
+}
+
+func (c *ActionRunnerImpl) onPanic(e *PanicError) {
+	if c.MetricsService != nil {
+		c.MetricsService.Inc(MetricActionPanics, map[string]string{"action": e.Action})
+	}
+}
+
+func (c *ActionRunnerImpl) sendPanicAlert(action IAction, e *PanicError) {
+	prepare := func(alertParams *core.AlertParams) {
+		alertParams.Subject += "-PANIC"
+		alertParams.Message = e.GetDetails()
+	}
+	if c.AlertAggregator != nil {
+		c.AlertAggregator.Alert(action, &Err{Error: e, Reason: e.Reason, Message: e.Message}, prepare)
+	} else {
+		c.ErrorHandler.HandleWithCustomParams(e, prepare)
+	}
+}
@@ -0,0 +1,33 @@
+package pipeline
+
+import "testing"
+
+func panicAt(runner *ActionRunnerImpl, site int) (err error) {
+	defer runner.recoverPanic("test", &err)
+	if site == 1 {
+		panic("первое место")
+	}
+	var m map[string]int
+	m["x"] = 1
+	return nil
+}
+
+func panicFingerprint(runner *ActionRunnerImpl, site int) string {
+	e := panicAt(runner, site).(*PanicError)
+	return AlertFingerprint("test", &Err{Error: e, Reason: e.Reason})
+}
+
+// Паники в разных местах экшена различаются, повторная паника в том же месте дает тот же отпечаток
+func TestPanicFingerprintUsesPanicSite(t *testing.T) {
+	runner, _, _ := newTestRunner()
+	var fingerprints []string
+	for _, site := range []int{1, 1, 2} {
+		fingerprints = append(fingerprints, panicFingerprint(runner, site))
+	}
+	if fingerprints[0] != fingerprints[1] {
+		t.Error("отпечаток одной и той же паники изменился")
+	}
+	if fingerprints[0] == fingerprints[2] {
+		t.Error("паники в разных местах получили один отпечаток")
+	}
+}
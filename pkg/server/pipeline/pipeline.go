@@ -1,13 +1,16 @@
 package pipeline
 
 import (
+	"errors"
 	"fmt"
 	"github.com/itskovichanton/core/pkg/core"
 	"github.com/itskovichanton/core/pkg/core/logger"
 	"github.com/itskovichanton/goava/pkg/goava/errs"
 	"github.com/itskovichanton/goava/pkg/goava/utils"
+	"github.com/itskovichanton/server/pkg/server/entities"
 	"log"
 	"strings"
+	"sync"
 )
 
 type IAction interface {
@@ -56,9 +59,22 @@ func (c *BaseActionImpl) GetName() string {
 func (c *BaseActionImpl) PrepareErrorAlert(alertParams *core.AlertParams, err *Err, arg interface{}) {
 }
 
+// Экшен, добавляющий собственные поля в строку лога раннера
+type ILogFieldsProvider interface {
+	GetLogFields(arg interface{}) map[string]interface{}
+}
+
 type IActionRunner interface {
 	Run(action IAction, argsProvider func() (interface{}, error), service IErrorProviderService) *Result
 	RunByProvider(action func(args interface{}) IAction, argsProvider func() (interface{}, error), service IErrorProviderService) *Result
+
+	// Как Run, но без алертов: для вложенных вызовов (ветки комбинаторов), ошибку которых отправит в алерт внешний вызов
+	RunWithoutAlerts(action IAction, argsProvider func() (interface{}, error), service IErrorProviderService) *Result
+	Use(interceptor *Interceptor)
+	GetInterceptors() []*Interceptor
+
+	// Ставит экшен в очередь фоновых задач, не дожидаясь выполнения
+	Enqueue(action IAction, arg interface{}) (*Job, error)
 }
 
 type ActionRunnerImpl struct {
@@ -67,6 +83,16 @@ type ActionRunnerImpl struct {
 	LoggerService               logger.ILoggerService
 	ErrorHandler                core.IErrorHandler
 	DefaultErrorProviderService IErrorProviderService
+	ReasonRegistry              IReasonRegistryService
+	AlertAggregator             IAlertAggregatorService
+
+	// Скрывает секреты в логе. Если не задан - используется NewDefaultRedactor()
+	Redactor       IRedactorService
+	MetricsService IMetricsService
+	JobQueue       IJobQueueService
+
+	interceptorsLock sync.RWMutex
+	interceptors     []*Interceptor
 }
 
 type Result struct {
@@ -98,17 +124,28 @@ func (c *ActionRunnerImpl) Run(action IAction, argsProvider func() (interface{},
 	}, argsProvider, errorProviderService)
 }
 
+func (c *ActionRunnerImpl) RunWithoutAlerts(action IAction, argsProvider func() (interface{}, error), errorProviderService IErrorProviderService) *Result {
+	return c.run(func(args interface{}) IAction {
+		return action
+	}, argsProvider, errorProviderService, false)
+}
+
 func (c *ActionRunnerImpl) RunByProvider(actionProvider func(args interface{}) IAction, argsProvider func() (interface{}, error), errorProviderService IErrorProviderService) *Result {
+	return c.run(actionProvider, argsProvider, errorProviderService, true)
+}
+
+func (c *ActionRunnerImpl) run(actionProvider func(args interface{}) IAction, argsProvider func() (interface{}, error), errorProviderService IErrorProviderService, alert bool) *Result {
 
 	result := &Result{}
 	result.ExecutionTimeMs = utils.CurrentTimeMillis()
 
 	var action IAction
-	arg, err := argsProvider()
+	arg, err := c.provideArgs(argsProvider)
+	if err == nil {
+		action, err = c.provideAction(actionProvider, arg)
+	}
 	if err != nil {
 		action = &FailedActionImpl{Error: err}
-	} else {
-		action = actionProvider(arg)
 	}
 
 	ctx := ActionContextImpl{
@@ -119,15 +156,18 @@ func (c *ActionRunnerImpl) RunByProvider(actionProvider func(args interface{}) I
 		Logger: c.LoggerService.GetDefaultActionsLogger(),
 	}
 
+	redactor := c.getRedactor()
 	defer func() {
 		result.ExecutionTimeMs = utils.CurrentTimeMillis() - result.ExecutionTimeMs
-		action.OnFinished(arg, result)
+		c.callSafely(action, func() {
+			action.OnFinished(arg, result)
+		})
 		if len(action.GetLog()) > 0 {
-			logger.Field(ctx.Ld, "log", action.GetLog())
+			logger.Field(ctx.Ld, "log", redactor.RedactString(action.GetLog()))
 		}
-		logger.Result(ctx.Ld, result)
+		logger.Result(ctx.Ld, redactor.Redact(result))
 		if result.Err != nil {
-			logger.Err(ctx.Ld, result.Err.Error)
+			logger.Err(ctx.Ld, redactor.RedactString(utils.GetErrorFullInfo(result.Err.Error)))
 		}
 		logger.Print(ctx.Logger, ctx.Ld)
 	}()
@@ -135,99 +175,107 @@ func (c *ActionRunnerImpl) RunByProvider(actionProvider func(args interface{}) I
 	logger.Action(ctx.Ld, action.GetName())
 	//logger.Field(ctx.Ld, "c", caller)
 
+	if errorProviderService == nil {
+		errorProviderService = c.DefaultErrorProviderService
+	}
+	call := &ActionCall{Action: action, Arg: arg, Result: result, errorProviderService: errorProviderService}
 	if err == nil {
 		ctx.Arg = arg
-		logger.Args(ctx.Ld, action.GetArgsForLogger(arg))
-		action.OnBeforeRun(arg)
-		result.Res, err = action.Run(arg)
-		if err == nil {
-			action.OnSuccess(arg, result.Res)
+		logger.Args(ctx.Ld, redactor.Redact(action.GetArgsForLogger(arg)))
+		c.handle(call)
+		if fieldsProvider, ok := action.(ILogFieldsProvider); ok {
+			for k, v := range fieldsProvider.GetLogFields(arg) {
+				logger.Field(ctx.Ld, k, v)
+			}
 		}
+	} else {
+		call.Fail(err)
 	}
 
-	if err != nil {
+	if result.Err != nil {
 		result.Res = nil
-		if errorProviderService == nil {
-			errorProviderService = c.DefaultErrorProviderService
-		}
-		result.Err = errorProviderService.ProvideError(err)
-		action.OnError(arg, result.Err)
-		c.ErrorHandler.HandleWithCustomParams(result.Err.Error, func(alertParams *core.AlertParams) {
-			action.PrepareErrorAlert(alertParams, result.Err, arg)
+		c.callSafely(action, func() {
+			action.OnError(arg, result.Err)
 		})
+		if alert {
+			c.alert(action, arg, result.Err)
+		}
 	}
 
 	return result
 
 }
 
-type ChainedActionImpl struct {
-	BaseActionImpl
-
-	Name       string
-	Actions    []IAction
-	lastAction IAction
+func (c *ActionRunnerImpl) alert(action IAction, arg interface{}, e *Err) {
+	var panicErr *PanicError
+	if errors.As(e.Error, &panicErr) {
+		c.sendPanicAlert(action, panicErr)
+		return
+	}
+	if !c.shouldAlert(e) {
+		return
+	}
+	prepareAlert := func(alertParams *core.AlertParams) {
+		action.PrepareErrorAlert(alertParams, e, arg)
+	}
+	if c.AlertAggregator != nil {
+		c.AlertAggregator.Alert(action, e, prepareAlert)
+	} else {
+		c.ErrorHandler.HandleWithCustomParams(e.Error, prepareAlert)
+	}
 }
 
-func (c *ChainedActionImpl) PrepareErrorAlert(alertParams *core.AlertParams, err *Err, arg interface{}) {
-	if c.lastAction != nil {
-		c.lastAction.PrepareErrorAlert(alertParams, err, arg)
+func (c *ActionRunnerImpl) Enqueue(action IAction, arg interface{}) (*Job, error) {
+	if c.JobQueue == nil {
+		return nil, errs.NewBaseError("Очередь фоновых задач не настроена")
 	}
+	return c.JobQueue.Enqueue(action, arg)
 }
 
-func (c *ChainedActionImpl) GetName() string {
-	if len(c.Name) > 0 {
-		return c.Name
-	}
-	r := ""
-	for _, a := range c.Actions {
-		r += a.GetName() + "-"
+func (c *ActionRunnerImpl) runAction(action IAction, arg interface{}, result *Result) (err error) {
+	defer c.recoverPanic(action.GetName(), &err)
+	action.OnBeforeRun(arg)
+	result.Res, err = action.Run(arg)
+	if err == nil {
+		action.OnSuccess(arg, result.Res)
 	}
-	c.Name = strings.TrimRight(r, "-")
-	return c.Name
+	return err
 }
 
-func (c *ChainedActionImpl) Run(arg interface{}) (interface{}, error) {
+func (c *ActionRunnerImpl) provideArgs(argsProvider func() (interface{}, error)) (arg interface{}, err error) {
+	defer c.recoverPanic("argsProvider", &err)
+	return argsProvider()
+}
 
-	var lastResult interface{}
-	lastResult = nil
+func (c *ActionRunnerImpl) provideAction(actionProvider func(args interface{}) IAction, arg interface{}) (action IAction, err error) {
+	defer c.recoverPanic("actionProvider", &err)
+	return actionProvider(arg), nil
+}
 
-	for _, p := range c.Actions {
-		c.lastAction = p
-		if lastResult != nil {
-			arg = lastResult
-		}
-		p.OnBeforeRun(arg)
-		r, err := p.Run(arg)
-		p.OnSuccess(arg, r)
-		lastResult = r
-
-		var errObj *Err
-		errObj = nil
-
-		if err != nil {
-			errObj = &Err{
-				Error:   err,
-				Reason:  "",
-				Message: err.Error(),
-				Details: utils.GetErrorFullInfo(err),
-			}
-			be := errs.FindBaseError(err)
-			if be != nil {
-				errObj.Reason = be.Reason
-			}
-			p.OnError(arg, errObj)
-		}
-		p.OnFinished(arg, &Result{
-			Res: lastResult,
-			Err: errObj,
-		})
-		if err != nil {
-			return lastResult, err
-		}
+var defaultRedactor = NewDefaultRedactor()
+
+func (c *ActionRunnerImpl) getRedactor() IRedactorService {
+	if c.Redactor == nil {
+		return defaultRedactor
 	}
+	return c.Redactor
+}
+
+// Алерт не отправляется для причин, зарегистрированных с Alert=false
+func (c *ActionRunnerImpl) shouldAlert(e *Err) bool {
+	info := reasonRegistryOrDefault(c.ReasonRegistry).Get(e.Reason)
+	return info == nil || info.Alert
+}
 
-	return lastResult, nil
+func provideError(errorProviderService IErrorProviderService, err error, arg interface{}) *Err {
+	if localized, ok := errorProviderService.(ILocalizedErrorProviderService); ok {
+		lang := ""
+		if p, ok := arg.(*entities.CallParams); ok && p.Caller != nil {
+			lang = p.Caller.Language
+		}
+		return localized.ProvideLocalizedError(err, lang)
+	}
+	return errorProviderService.ProvideError(err)
 }
 
 type FuncActionImpl struct {
@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"bytes"
+	"github.com/itskovichanton/core/pkg/core"
+	"github.com/itskovichanton/core/pkg/core/logger"
+	"log"
+	"sync"
+)
+
+// Лог экшенов пишется в буфер
+type testLoggerService struct {
+	logger.ILoggerService
+
+	out bytes.Buffer
+}
+
+func (c *testLoggerService) GetDefaultActionsLogger() *log.Logger {
+	return log.New(&c.out, "", 0)
+}
+
+// Запоминает ошибки, по которым отправлены алерты
+type testErrorHandler struct {
+	core.IErrorHandler
+
+	lock   sync.Mutex
+	alerts []error
+}
+
+func (c *testErrorHandler) HandleWithCustomParams(err error, alertParamsPreprocessor func(alertParams *core.AlertParams)) *core.AlertParams {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	alertParams := &core.AlertParams{Message: err.Error()}
+	if alertParamsPreprocessor != nil {
+		alertParamsPreprocessor(alertParams)
+	}
+	c.alerts = append(c.alerts, err)
+	return alertParams
+}
+
+func (c *testErrorHandler) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.alerts)
+}
+
+func newTestRunner() (*ActionRunnerImpl, *testLoggerService, *testErrorHandler) {
+	loggerService := &testLoggerService{}
+	errorHandler := &testErrorHandler{}
+	runner := &ActionRunnerImpl{
+		LoggerService:               loggerService,
+		ErrorHandler:                errorHandler,
+		DefaultErrorProviderService: &ErrorProviderServiceImpl{Config: &core.Config{}},
+	}
+	return runner, loggerService, errorHandler
+}
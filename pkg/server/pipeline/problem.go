@@ -0,0 +1,112 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"github.com/itskovichanton/core/pkg/core/validation"
+	"github.com/itskovichanton/echo-http"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"net/http"
+	"strings"
+)
+
+const MIMEApplicationProblemJSON = "application/problem+json"
+
+// Тело ошибки по RFC 7807. Поля после Instance - расширения
+type ProblemDetails struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	Reason          string                `json:"reason"`
+	Details         string                `json:"details,omitempty"`
+	Param           string                `json:"param,omitempty"`
+	InvalidValue    interface{}           `json:"invalidValue,omitempty"`
+	Violations      []*ValidationErrorErr `json:"violations,omitempty"`
+	RequiredVersion *entities.Version     `json:"requiredVersion,omitempty"`
+	UpdateUrl       string                `json:"updateUrl,omitempty"`
+	ExecutionTimeMs int64                 `json:"executionTimeMs"`
+}
+
+// Ошибки отдаются как application/problem+json, успешные ответы - как обычно
+type ProblemResponseModelProviderImpl struct {
+	ResponseModelProviderImpl
+
+	// База для URI типа ошибки: type = TypeBaseUri + reason-in-kebab-case
+	TypeBaseUri    string
+	ReasonRegistry IReasonRegistryService
+}
+
+func (c *ProblemResponseModelProviderImpl) ToModel(r *Result) interface{} {
+
+	if r.Err == nil {
+		return r
+	}
+
+	status := (&ResponsePresenterImpl{ReasonRegistry: c.ReasonRegistry}).GetHttpResponseCode(r, 0)
+	p := &ProblemDetails{
+		Type:            c.getType(r.Err.Reason),
+		Title:           http.StatusText(status),
+		Status:          status,
+		Detail:          r.Err.Message,
+		Reason:          r.Err.Reason,
+		Details:         r.Err.Details,
+		ExecutionTimeMs: r.ExecutionTimeMs,
+	}
+
+	switch ex := r.Err.Error.(type) {
+	case *validation.ValidationError:
+		p.Param = ex.Param
+		p.InvalidValue = ex.InvalidValue
+	case *ValidationErrors:
+		m := c.createValidationErrorsModel(ex, r).(*ValidationErrorModel)
+		p.Param = m.Error.Param
+		p.InvalidValue = m.Error.InvalidValue
+		p.Violations = m.Error.Violations
+	case *CallerUpdateRequiredError:
+		p.RequiredVersion = ex.RequiredVersion
+		p.UpdateUrl = ex.UpdateUrl
+	}
+
+	return p
+}
+
+func (c *ProblemResponseModelProviderImpl) getType(reason string) string {
+	if len(reason) == 0 {
+		return "about:blank"
+	}
+	base := c.TypeBaseUri
+	if len(base) == 0 {
+		base = "/problems/"
+	}
+	return base + strings.ToLower(strings.ReplaceAll(reason, "_", "-"))
+}
+
+// Презентер RFC 7807: проставляет status и instance и отдает ошибки с content-type application/problem+json
+type ProblemResponsePresenterImpl struct {
+	JSONResponsePresenterImpl
+}
+
+func (c *ProblemResponsePresenterImpl) Write(context echo.Context, result *Result, httpStatus int) error {
+
+	if notModified, err := c.WriteCacheHeaders(context, result); notModified || err != nil {
+		return err
+	}
+
+	httpStatus = c.GetHttpResponseCode(result, httpStatus)
+	model := c.ResponseModelProvider.ToModel(result)
+	p, ok := model.(*ProblemDetails)
+	if !ok {
+		return context.JSON(httpStatus, model)
+	}
+
+	p.Status = httpStatus
+	p.Title = http.StatusText(httpStatus)
+	p.Instance = context.Request().RequestURI
+	body, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return context.Blob(httpStatus, MIMEApplicationProblemJSON, body)
+}
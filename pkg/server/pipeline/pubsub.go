@@ -0,0 +1,437 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/asaskevich/EventBus"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/echo-http"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"github.com/itskovichanton/server/pkg/server/users"
+	"golang.org/x/net/websocket"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Топик EventBus, в который публикуется PresenceEvent при подключении первого и отключении последнего соединения пользователя
+	TopicPresence = "TOPIC_PRESENCE"
+
+	MetricPubSubSlowConsumers = "pubsub_slow_consumers_total"
+
+	PubSubCommandSubscribe   = "subscribe"
+	PubSubCommandUnsubscribe = "unsubscribe"
+
+	PubSubEventMessage      = "message"
+	PubSubEventSubscribed   = "subscribed"
+	PubSubEventUnsubscribed = "unsubscribed"
+	PubSubEventError        = "error"
+
+	defaultPubSubBuffer            = 64
+	defaultPubSubMaxWildcardTopics = 1000
+)
+
+// Правило доступа к топику. Name - топик EventBus либо префикс с * на конце
+type TopicRule struct {
+	Name string
+
+	// Роли, которым разрешена подписка. Если не заданы - любому авторизованному пользователю
+	Roles []string
+
+	// Доставляются только сообщения TopicMessage, адресованные подписчику. Сообщение без получателей не получает никто
+	Personal bool
+}
+
+// Сообщение для определенных пользователей либо ролей. Публикуется в EventBus единственным аргументом.
+// Без получателей доставляется всем подписчикам, кроме топиков Personal
+type TopicMessage struct {
+	Usernames []string
+	Roles     []string
+	Data      interface{}
+}
+
+type PresenceEvent struct {
+	Username string `json:"username"`
+	Online   bool   `json:"online"`
+}
+
+type PresenceInfo struct {
+	Username    string    `json:"username"`
+	Role        string    `json:"role"`
+	Connections int       `json:"connections"`
+	Topics      []string  `json:"topics"`
+	Since       time.Time `json:"since"`
+}
+
+type IPubSubService interface {
+	// Обслуживает WebSocket-соединение авторизованного клиента (после GetUserAction)
+	Serve(context echo.Context, p *entities.CallParams) error
+	GetPresence() []*PresenceInfo
+	IsOnline(username string) bool
+}
+
+// Команда клиента: {"action":"subscribe","topic":"..."}
+type pubSubCommand struct {
+	Action string `json:"action"`
+	Topic  string `json:"topic"`
+}
+
+// Кадр сервера. Data - тот же Result, что и у обычных маршрутов
+type pubSubFrame struct {
+	Topic string      `json:"topic,omitempty"`
+	Event string      `json:"event"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// Доставляет публикации EventBus подписанным WebSocket-клиентам. У каждого соединения свой буфер кадров:
+// если клиент не успевает читать и буфер переполнен, соединение закрывается.
+// Соединения, сессия которых завершилась в ISessionStorageService, закрываются на очередном heartbeat
+type PubSubServiceImpl struct {
+	IPubSubService
+
+	EventBus             EventBus.Bus
+	SessionStorage       users.ISessionStorageService
+	ErrorProviderService IErrorProviderService
+	MetricsService       IMetricsService
+	Rules                []*TopicRule
+	BufferSize           int
+	Heartbeat            time.Duration
+	WriteTimeout         time.Duration
+
+	// Origin, с которых можно подключиться, как в server.streaming.allowedOrigins
+	AllowedOrigins []string
+
+	// Сколько разных топиков можно подписать по правилам с *: каждый добавляет обработчик в EventBus навсегда
+	MaxWildcardTopics int
+
+	lock  sync.RWMutex
+	conns map[*pubSubConn]bool
+
+	busLock        sync.Mutex
+	busTopics      map[string]bool
+	wildcardTopics int
+}
+
+type pubSubConn struct {
+	p         *entities.CallParams
+	account   *entities.Account
+	token     string
+	out       chan *pubSubFrame
+	topics    map[string]bool
+	since     time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// Возвращает true, если соединение закрыто этим вызовом
+func (c *pubSubConn) close() bool {
+	closed := false
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		closed = true
+	})
+	return closed
+}
+
+func (c *PubSubServiceImpl) Serve(context echo.Context, p *entities.CallParams) error {
+
+	if p.Caller == nil || p.Caller.Session == nil || p.Caller.Session.Account == nil {
+		return errs.NewBaseErrorWithReason("Пользователь не авторизован", frmclient.ReasonAuthorizationRequired)
+	}
+
+	wsServer := websocket.Server{
+		Handshake: checkWebSocketOrigin(c.AllowedOrigins),
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			conn := &pubSubConn{
+				p:       p,
+				account: p.Caller.Session.Account,
+				token:   p.Caller.Session.Token,
+				out:     make(chan *pubSubFrame, c.getBufferSize()),
+				topics:  map[string]bool{},
+				since:   time.Now(),
+				closed:  make(chan struct{}),
+			}
+			c.register(conn)
+			defer c.unregister(conn)
+
+			go func() {
+				defer conn.close()
+				for {
+					cmd := &pubSubCommand{}
+					if err := websocket.JSON.Receive(ws, cmd); err != nil {
+						return
+					}
+					c.handleCommand(conn, cmd)
+				}
+			}()
+
+			c.writeLoop(ws, conn)
+		},
+	}
+	wsServer.ServeHTTP(context.Response(), context.Request())
+	return nil
+}
+
+func (c *PubSubServiceImpl) writeLoop(ws *websocket.Conn, conn *pubSubConn) {
+	heartbeat := time.NewTicker(c.getHeartbeat())
+	defer heartbeat.Stop()
+	for {
+		var frame *pubSubFrame
+		select {
+		case <-conn.closed:
+			return
+		case <-heartbeat.C:
+			if c.SessionStorage != nil && len(conn.token) > 0 && !c.SessionStorage.IsLoggedIn(conn.token) {
+				return
+			}
+			frame = &pubSubFrame{Event: StreamEventHeartbeat}
+		case frame = <-conn.out:
+		}
+		ws.SetWriteDeadline(time.Now().Add(c.getWriteTimeout()))
+		if websocket.JSON.Send(ws, frame) != nil {
+			return
+		}
+	}
+}
+
+func (c *PubSubServiceImpl) handleCommand(conn *pubSubConn, cmd *pubSubCommand) {
+	var err error
+	event := ""
+	switch cmd.Action {
+	case PubSubCommandSubscribe:
+		event = PubSubEventSubscribed
+		err = c.subscribe(conn, cmd.Topic)
+	case PubSubCommandUnsubscribe:
+		event = PubSubEventUnsubscribed
+		c.lock.Lock()
+		delete(conn.topics, cmd.Topic)
+		c.lock.Unlock()
+	default:
+		err = errs.NewBaseErrorWithReason(fmt.Sprintf("Неизвестная команда %v, допустимы %v, %v", cmd.Action, PubSubCommandSubscribe, PubSubCommandUnsubscribe), frmclient.ReasonValidation)
+	}
+	if err != nil {
+		c.send(conn, &pubSubFrame{Topic: cmd.Topic, Event: PubSubEventError, Data: c.toModel(&Result{Err: provideError(c.ErrorProviderService, err, conn.p)})})
+		return
+	}
+	c.send(conn, &pubSubFrame{Topic: cmd.Topic, Event: event})
+}
+
+func (c *PubSubServiceImpl) subscribe(conn *pubSubConn, topic string) error {
+	rule := c.findRule(topic)
+	if rule == nil || !rule.allows(conn.account) {
+		return errs.NewBaseErrorWithReason(fmt.Sprintf("Подписка на топик %v запрещена", topic), frmclient.ReasonAccessDenied)
+	}
+	if err := c.subscribeBus(topic, rule.Name != topic); err != nil {
+		return err
+	}
+	c.lock.Lock()
+	conn.topics[topic] = true
+	c.lock.Unlock()
+	return nil
+}
+
+// Подписка на топик EventBus одна на все соединения и не снимается: EventBus различает обработчики только по коду функции.
+// Поэтому число топиков, подписанных по правилам с *, ограничено MaxWildcardTopics
+func (c *PubSubServiceImpl) subscribeBus(topic string, wildcard bool) error {
+	c.busLock.Lock()
+	defer c.busLock.Unlock()
+	if c.busTopics == nil {
+		c.busTopics = map[string]bool{}
+	}
+	if c.busTopics[topic] {
+		return nil
+	}
+	if wildcard && c.wildcardTopics >= c.getMaxWildcardTopics() {
+		return errs.NewBaseErrorWithReason(fmt.Sprintf("Превышено число топиков (%v), подписка на %v невозможна", c.getMaxWildcardTopics(), topic), frmclient.ReasonServerUnavailable)
+	}
+	err := c.EventBus.Subscribe(topic, func(args ...interface{}) {
+		c.deliver(topic, args)
+	})
+	if err != nil {
+		return err
+	}
+	c.busTopics[topic] = true
+	if wildcard {
+		c.wildcardTopics++
+	}
+	return nil
+}
+
+func (c *PubSubServiceImpl) deliver(topic string, args []interface{}) {
+
+	var data interface{} = args
+	if len(args) == 1 {
+		data = args[0]
+	}
+	message, addressed := data.(*TopicMessage)
+	if addressed {
+		data = message.Data
+	}
+	personal := false
+	if rule := c.findRule(topic); rule != nil {
+		personal = rule.Personal
+	}
+	frame := &pubSubFrame{Topic: topic, Event: PubSubEventMessage, Data: c.toModel(&Result{Res: data})}
+
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	for conn := range c.conns {
+		if !conn.topics[topic] {
+			continue
+		}
+		if addressed && !message.isAddressedTo(conn.account, personal) || !addressed && personal {
+			continue
+		}
+		c.send(conn, frame)
+	}
+}
+
+// Не блокирует публикующего: если буфер соединения полон, клиент считается медленным и отключается
+func (c *PubSubServiceImpl) send(conn *pubSubConn, frame *pubSubFrame) {
+	select {
+	case conn.out <- frame:
+	default:
+		if conn.close() && c.MetricsService != nil {
+			c.MetricsService.Inc(MetricPubSubSlowConsumers, nil)
+		}
+	}
+}
+
+func (c *PubSubServiceImpl) register(conn *pubSubConn) {
+	c.lock.Lock()
+	if c.conns == nil {
+		c.conns = map[*pubSubConn]bool{}
+	}
+	online := c.isOnline(conn.account.Username)
+	c.conns[conn] = true
+	c.lock.Unlock()
+	if !online {
+		c.EventBus.Publish(TopicPresence, &PresenceEvent{Username: conn.account.Username, Online: true})
+	}
+}
+
+func (c *PubSubServiceImpl) unregister(conn *pubSubConn) {
+	conn.close()
+	c.lock.Lock()
+	delete(c.conns, conn)
+	online := c.isOnline(conn.account.Username)
+	c.lock.Unlock()
+	if !online {
+		c.EventBus.Publish(TopicPresence, &PresenceEvent{Username: conn.account.Username, Online: false})
+	}
+}
+
+func (c *PubSubServiceImpl) IsOnline(username string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.isOnline(username)
+}
+
+func (c *PubSubServiceImpl) isOnline(username string) bool {
+	for conn := range c.conns {
+		if conn.account.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *PubSubServiceImpl) GetPresence() []*PresenceInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	byUsername := map[string]*PresenceInfo{}
+	for conn := range c.conns {
+		info := byUsername[conn.account.Username]
+		if info == nil {
+			info = &PresenceInfo{Username: conn.account.Username, Role: conn.account.Role, Since: conn.since}
+			byUsername[conn.account.Username] = info
+		}
+		info.Connections++
+		if conn.since.Before(info.Since) {
+			info.Since = conn.since
+		}
+		for topic := range conn.topics {
+			if !containsString(info.Topics, topic) {
+				info.Topics = append(info.Topics, topic)
+			}
+		}
+	}
+	var r []*PresenceInfo
+	for _, info := range byUsername {
+		sort.Strings(info.Topics)
+		r = append(r, info)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Username < r[j].Username
+	})
+	return r
+}
+
+func (c *PubSubServiceImpl) findRule(topic string) *TopicRule {
+	for _, rule := range c.Rules {
+		if rule.Name == topic || strings.HasSuffix(rule.Name, "*") && strings.HasPrefix(topic, strings.TrimSuffix(rule.Name, "*")) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (c *TopicRule) allows(account *entities.Account) bool {
+	return len(c.Roles) == 0 || containsString(c.Roles, account.Role)
+}
+
+func (c *TopicMessage) isAddressedTo(account *entities.Account, personal bool) bool {
+	if len(c.Usernames) == 0 && len(c.Roles) == 0 {
+		return !personal
+	}
+	return containsString(c.Usernames, account.Username) || containsString(c.Roles, account.Role)
+}
+
+func (c *PubSubServiceImpl) toModel(result *Result) interface{} {
+	return (&ResponseModelProviderImpl{}).ToModel(result)
+}
+
+func (c *PubSubServiceImpl) getBufferSize() int {
+	if c.BufferSize <= 0 {
+		return defaultPubSubBuffer
+	}
+	return c.BufferSize
+}
+
+func (c *PubSubServiceImpl) getMaxWildcardTopics() int {
+	if c.MaxWildcardTopics <= 0 {
+		return defaultPubSubMaxWildcardTopics
+	}
+	return c.MaxWildcardTopics
+}
+
+func (c *PubSubServiceImpl) getHeartbeat() time.Duration {
+	if c.Heartbeat <= 0 {
+		return defaultStreamHeartbeat
+	}
+	return c.Heartbeat
+}
+
+func (c *PubSubServiceImpl) getWriteTimeout() time.Duration {
+	if c.WriteTimeout <= 0 {
+		return defaultStreamWriteTimeout
+	}
+	return c.WriteTimeout
+}
+
+type GetPresenceAction struct {
+	BaseActionImpl
+
+	PubSub IPubSubService
+}
+
+func (c *GetPresenceAction) GetName() string {
+	return "GetPresence"
+}
+
+func (c *GetPresenceAction) Run(arg interface{}) (interface{}, error) {
+	return c.PubSub.GetPresence(), nil
+}
@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"github.com/asaskevich/EventBus"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"testing"
+	"time"
+)
+
+func newTestPubSubConn(service *PubSubServiceImpl, username string, role string) *pubSubConn {
+	conn := &pubSubConn{
+		account: &entities.Account{Username: username, Role: role},
+		out:     make(chan *pubSubFrame, 8),
+		topics:  map[string]bool{},
+		since:   time.Now(),
+		closed:  make(chan struct{}),
+	}
+	service.register(conn)
+	return conn
+}
+
+func TestPersonalTopicWithoutRecipients(t *testing.T) {
+	service := &PubSubServiceImpl{EventBus: EventBus.New(), Rules: []*TopicRule{
+		{Name: "orders"},
+		{Name: "inbox", Personal: true},
+	}}
+	alice := newTestPubSubConn(service, "alice", entities.RoleUser)
+	for _, topic := range []string{"orders", "inbox"} {
+		if err := service.subscribe(alice, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	service.EventBus.Publish("orders", &TopicMessage{Data: "всем"})
+	if len(alice.out) != 1 {
+		t.Fatalf("сообщение без получателей не доставлено в обычный топик")
+	}
+	<-alice.out
+
+	service.EventBus.Publish("inbox", &TopicMessage{Data: "никому"})
+	service.EventBus.Publish("inbox", "без адреса")
+	if len(alice.out) != 0 {
+		t.Fatalf("в личный топик доставлено сообщение без получателей")
+	}
+
+	service.EventBus.Publish("inbox", &TopicMessage{Usernames: []string{"alice"}, Data: "лично"})
+	if len(alice.out) != 1 {
+		t.Fatalf("адресованное сообщение не доставлено")
+	}
+}
+
+func TestWildcardTopicsAreLimited(t *testing.T) {
+	service := &PubSubServiceImpl{EventBus: EventBus.New(), MaxWildcardTopics: 2, Rules: []*TopicRule{
+		{Name: "news"},
+		{Name: "chat.*"},
+	}}
+	conn := newTestPubSubConn(service, "alice", entities.RoleUser)
+	for _, topic := range []string{"chat.1", "chat.2", "chat.1", "news"} {
+		if err := service.subscribe(conn, topic); err != nil {
+			t.Fatalf("%v: %v", topic, err)
+		}
+	}
+	if err := service.subscribe(conn, "chat.3"); err == nil {
+		t.Error("подписка сверх MaxWildcardTopics разрешена")
+	}
+}
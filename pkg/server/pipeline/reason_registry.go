@@ -0,0 +1,215 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/server/pkg/server/filestorage"
+	"github.com/itskovichanton/server/pkg/server/i18n"
+	"github.com/itskovichanton/server/pkg/server/users"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Описание причины ошибки (Err.Reason)
+type ReasonInfo struct {
+	Reason     string     `json:"reason"`
+	HttpStatus int        `json:"httpStatus"`
+	GrpcCode   codes.Code `json:"grpcCode"`
+
+	// Сообщение, если ошибка его не содержит
+	DefaultMessage string `json:"defaultMessage,omitempty"`
+
+	// Отправлять ли алерт разработчикам
+	Alert bool `json:"alert"`
+
+	// Можно ли клиенту повторить запрос
+	Retryable   bool   `json:"retryable"`
+	Description string `json:"description,omitempty"`
+
+	// Код ошибки JSON-RPC. Если не задан, выбирается по умолчанию (см. GetJsonRpcCode)
+	JsonRpcCode int `json:"jsonRpcCode,omitempty"`
+
+	// Переводы сообщения по языкам. Попадают в каталог сообщений раньше файлов settings/i18n, поэтому те их переопределяют
+	Messages map[string]string `json:"messages,omitempty"`
+}
+
+// Реестр причин ошибок. Незарегистрированные причины считаются внутренними ошибками (500, алерт)
+type IReasonRegistryService interface {
+	Register(info *ReasonInfo)
+	Get(reason string) *ReasonInfo
+	All() []*ReasonInfo
+	ExportJSON() ([]byte, error)
+	ExportMarkdown() string
+}
+
+type ReasonRegistryServiceImpl struct {
+	IReasonRegistryService
+
+	lock    sync.RWMutex
+	reasons map[string]*ReasonInfo
+}
+
+// Реестр, заполненный причинами по умолчанию
+func NewReasonRegistry() *ReasonRegistryServiceImpl {
+	r := &ReasonRegistryServiceImpl{}
+	for _, info := range DefaultReasons() {
+		r.Register(info)
+	}
+	return r
+}
+
+// Используется, если реестр не передан явно
+var defaultReasonRegistry IReasonRegistryService = NewReasonRegistry()
+
+func reasonRegistryOrDefault(r IReasonRegistryService) IReasonRegistryService {
+	if r == nil {
+		return defaultReasonRegistry
+	}
+	return r
+}
+
+func (c *ReasonRegistryServiceImpl) Register(info *ReasonInfo) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.reasons == nil {
+		c.reasons = map[string]*ReasonInfo{}
+	}
+	c.reasons[info.Reason] = info
+}
+
+func (c *ReasonRegistryServiceImpl) Get(reason string) *ReasonInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.reasons[reason]
+}
+
+func (c *ReasonRegistryServiceImpl) All() []*ReasonInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	var r []*ReasonInfo
+	for _, info := range c.reasons {
+		r = append(r, info)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Reason < r[j].Reason
+	})
+	return r
+}
+
+func (c *ReasonRegistryServiceImpl) ExportJSON() ([]byte, error) {
+	return json.MarshalIndent(c.All(), "", "  ")
+}
+
+func (c *ReasonRegistryServiceImpl) ExportMarkdown() string {
+	var b strings.Builder
+	b.WriteString("| Reason | HTTP | gRPC | Alert | Retryable | Message | Description |\n")
+	b.WriteString("|---|---|---|---|---|---|---|\n")
+	for _, info := range c.All() {
+		b.WriteString(fmt.Sprintf("| `%v` | %v | %v | %v | %v | %v | %v |\n",
+			info.Reason, info.HttpStatus, info.GrpcCode, yesNo(info.Alert), yesNo(info.Retryable),
+			escapeMarkdownCell(info.DefaultMessage), escapeMarkdownCell(info.Description)))
+	}
+	return b.String()
+}
+
+func yesNo(v bool) string {
+	if v {
+		return "yes"
+	}
+	return "no"
+}
+
+func escapeMarkdownCell(s string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(s, "|", "\\|"), "\n", " ")
+}
+
+// Экшен, для которого временными считаются и другие причины. Внутренние ошибки (паники, баги) по умолчанию
+// не повторяются - идемпотентный экшен может разрешить повтор при них, вернув frmclient.ReasonInternal
+type IRetryableReasonsProvider interface {
+	GetRetryableReasons() []string
+}
+
+// Временная ошибка: повтор вызова может пройти успешно
+func isRetryableErr(registry IReasonRegistryService, e *Err) bool {
+	info := reasonRegistryOrDefault(registry).Get(e.Reason)
+	return info != nil && info.Retryable
+}
+
+// Временная ошибка с учетом причин, разрешенных экшеном (IRetryableReasonsProvider)
+func isRetryableErrFor(registry IReasonRegistryService, action IAction, e *Err) bool {
+	if provider, ok := action.(IRetryableReasonsProvider); ok {
+		for _, reason := range provider.GetRetryableReasons() {
+			if reason == e.Reason {
+				return true
+			}
+		}
+	}
+	return isRetryableErr(registry, e)
+}
+
+func isInternalErr(e *Err) bool {
+	return e.Reason == frmclient.ReasonInternal || e.Reason == frmclient.ReasonTechnical
+}
+
+// Добавляет в каталог переводы причин (ReasonInfo.Messages), зарегистрированных к этому моменту
+func AddReasonMessages(registry IReasonRegistryService, catalog i18n.IMessageCatalogService) {
+	bundles := map[string]map[string]interface{}{}
+	for _, info := range reasonRegistryOrDefault(registry).All() {
+		for lang, msg := range info.Messages {
+			if bundles[lang] == nil {
+				bundles[lang] = map[string]interface{}{}
+			}
+			bundles[lang][info.Reason] = msg
+		}
+	}
+	for lang, messages := range bundles {
+		catalog.AddBundle(lang, messages)
+	}
+}
+
+// Ошибка gRPC с кодом из реестра
+func GetGrpcError(registry IReasonRegistryService, e *Err) error {
+	if e == nil {
+		return nil
+	}
+	code := codes.Internal
+	if info := reasonRegistryOrDefault(registry).Get(e.Reason); info != nil {
+		code = info.GrpcCode
+	}
+	return status.Error(code, e.Message)
+}
+
+func DefaultReasons() []*ReasonInfo {
+	return []*ReasonInfo{
+		{Reason: frmclient.ReasonValidation, HttpStatus: http.StatusBadRequest, GrpcCode: codes.InvalidArgument, DefaultMessage: "Неверный параметр", Description: "Параметры запроса не прошли валидацию"},
+		{Reason: frmclient.ReasonAuthorizationRequired, HttpStatus: http.StatusUnauthorized, GrpcCode: codes.Unauthenticated, DefaultMessage: "Пользователь не авторизован", Description: "Нужны sessionToken либо Basic-авторизация"},
+		{Reason: frmclient.ReasonInactiveUser, HttpStatus: http.StatusForbidden, GrpcCode: codes.PermissionDenied, DefaultMessage: "Пользователь неактивен"},
+		{Reason: frmclient.ReasonAccessDenied, HttpStatus: http.StatusForbidden, GrpcCode: codes.PermissionDenied, DefaultMessage: "Доступ запрещен"},
+		{Reason: frmclient.ReasonCallerUpdateRequired, HttpStatus: http.StatusForbidden, GrpcCode: codes.FailedPrecondition, DefaultMessage: "Необходимо обновить приложение"},
+		{Reason: frmclient.ReasonTooManyRequests, HttpStatus: http.StatusTooManyRequests, GrpcCode: codes.ResourceExhausted, DefaultMessage: "Слишком много запросов", Retryable: true},
+		{Reason: frmclient.ReasonServerRespondedWithError, HttpStatus: http.StatusOK, GrpcCode: codes.Unknown, Alert: true, Description: "Ошибка без отдельной причины"},
+		{Reason: frmclient.ReasonServerRespondedWithErrorNotFound, HttpStatus: http.StatusNotFound, GrpcCode: codes.NotFound, DefaultMessage: "Не найдено"},
+		{Reason: frmclient.ReasonServerUnavailable, HttpStatus: http.StatusServiceUnavailable, GrpcCode: codes.Unavailable, DefaultMessage: "Сервис временно недоступен", Alert: true, Retryable: true},
+		{Reason: frmclient.ReasonTechnical, HttpStatus: http.StatusInternalServerError, GrpcCode: codes.Internal, DefaultMessage: frmclient.InternalErrorMessage, Alert: true},
+		{Reason: frmclient.ReasonInternal, HttpStatus: http.StatusInternalServerError, GrpcCode: codes.Internal, DefaultMessage: frmclient.InternalErrorMessage, Alert: true},
+		{Reason: ReasonRequestTooLarge, HttpStatus: http.StatusRequestEntityTooLarge, GrpcCode: codes.ResourceExhausted, DefaultMessage: "Превышен допустимый размер запроса", Messages: map[string]string{"en": "Request is too large"}},
+		{Reason: ReasonTimeout, HttpStatus: http.StatusGatewayTimeout, GrpcCode: codes.DeadlineExceeded, DefaultMessage: "Превышено время выполнения", Alert: true, Retryable: true, Messages: map[string]string{"en": "Request timed out"}},
+		{Reason: ReasonCanceled, HttpStatus: 499, GrpcCode: codes.Canceled, DefaultMessage: "Вызов отменен клиентом", Messages: map[string]string{"en": "The call was canceled by the client"}},
+		{Reason: ReasonBatchDependencyFailed, HttpStatus: http.StatusFailedDependency, GrpcCode: codes.FailedPrecondition, DefaultMessage: "Запрос, на результат которого ссылается подзапрос, завершился ошибкой", Messages: map[string]string{"en": "A request referenced by this batch item failed"}},
+		{Reason: ReasonIdempotencyConflict, HttpStatus: http.StatusConflict, GrpcCode: codes.Aborted, DefaultMessage: "Запрос с этим ключом идемпотентности еще выполняется", Retryable: true, Messages: map[string]string{"en": "A request with this idempotency key is still in progress"}},
+		{Reason: ReasonIdempotencyKeyMismatch, HttpStatus: http.StatusUnprocessableEntity, GrpcCode: codes.InvalidArgument, DefaultMessage: "Ключ идемпотентности уже использован для запроса с другими параметрами", Messages: map[string]string{"en": "The idempotency key was already used for a request with different parameters"}},
+		{Reason: ReasonJobInterrupted, HttpStatus: http.StatusConflict, GrpcCode: codes.Aborted, DefaultMessage: "Задача прервана перезапуском сервера, повторите запрос", Messages: map[string]string{"en": "The job was interrupted by a server restart, please repeat the request"}},
+		{Reason: ReasonNotAcceptable, HttpStatus: http.StatusNotAcceptable, GrpcCode: codes.InvalidArgument, DefaultMessage: "Неподдерживаемый формат ответа", Messages: map[string]string{"en": "Unsupported response format"}},
+		{Reason: InvalidCallerErrorReasonEmptyVersion, HttpStatus: http.StatusBadRequest, GrpcCode: codes.InvalidArgument, DefaultMessage: "Не указана версия клиента", Messages: map[string]string{"en": "Client version is not specified"}},
+		{Reason: users.ReasonAlreadyExist, HttpStatus: http.StatusInternalServerError, GrpcCode: codes.AlreadyExists, DefaultMessage: "Пользователь уже существует"},
+		{Reason: users.ReasonAuthorizationFailedInvalidPassword, HttpStatus: http.StatusInternalServerError, GrpcCode: codes.Unauthenticated, DefaultMessage: "Неверный пароль"},
+		{Reason: users.ReasonAuthorizationFailedUserNotExist, HttpStatus: http.StatusInternalServerError, GrpcCode: codes.Unauthenticated, DefaultMessage: "Пользователь не существует"},
+		{Reason: filestorage.ReasonNotFound, HttpStatus: http.StatusNotFound, GrpcCode: codes.NotFound, DefaultMessage: "Файл не найден"},
+		{Reason: filestorage.ReasonNoUpdateNeeded, HttpStatus: http.StatusNotModified, GrpcCode: codes.FailedPrecondition, DefaultMessage: "Файл не требует обновления"},
+	}
+}
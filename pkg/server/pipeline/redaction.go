@@ -0,0 +1,197 @@
+package pipeline
+
+import (
+	"github.com/itskovichanton/goava/pkg/goava/utils"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Скрывает секреты (пароли, токены, номера карт) в том, что пишется в лог
+type IRedactorService interface {
+	// Возвращает копию значения в виде map/slice/скаляров со скрытыми полями. Исходное значение не меняется
+	Redact(v interface{}) interface{}
+	RedactString(s string) string
+}
+
+// Поля, скрываемые по умолчанию. Сравнение без учета регистра, "_" и "-"; поле совпадает также по окончанию имени
+// (newPassword, accessToken)
+var DefaultRedactedFields = []string{
+	"password", "passwd", "secret", "token", "authorization", "apikey", "cookie",
+	"cardnumber", "cvv", "cvc",
+}
+
+const DefaultRedactionMask = "***"
+
+type RedactorServiceImpl struct {
+	IRedactorService
+
+	// Имена полей либо пути через точку от корня (caller.authArgs.username)
+	Fields []string
+
+	// Дополнительные шаблоны: совпадения заменяются маской
+	Patterns []*regexp.Regexp
+
+	Mask string
+
+	// Маскировать номера карт (проверяются по алгоритму Луна), остаются последние 4 цифры
+	MaskCardNumbers bool
+
+	// Логировать как есть
+	Disabled bool
+
+	once         sync.Once
+	names        []string
+	paths        map[string]bool
+	keyValueExpr *regexp.Regexp
+}
+
+func NewDefaultRedactor() *RedactorServiceImpl {
+	return &RedactorServiceImpl{
+		Fields:          append([]string(nil), DefaultRedactedFields...),
+		Mask:            DefaultRedactionMask,
+		MaskCardNumbers: true,
+	}
+}
+
+var (
+	authHeaderExpr = regexp.MustCompile(`(?i)\b(basic|bearer)\s+[a-z0-9._~+/=-]{6,}`)
+	cardNumberExpr = regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`)
+)
+
+func (c *RedactorServiceImpl) init() {
+	c.once.Do(func() {
+		if len(c.Mask) == 0 {
+			c.Mask = DefaultRedactionMask
+		}
+		c.paths = map[string]bool{}
+		var quoted []string
+		for _, f := range c.Fields {
+			f = normalizeFieldName(f)
+			if strings.Contains(f, ".") {
+				c.paths[f] = true
+				continue
+			}
+			c.names = append(c.names, f)
+			quoted = append(quoted, regexp.QuoteMeta(f))
+		}
+		if len(quoted) > 0 {
+			// password=..., "sessionToken":"...", Authorization: ...
+			c.keyValueExpr = regexp.MustCompile(`(?i)([a-z_-]*(?:` + strings.Join(quoted, "|") + `)["']?\s*[:=]\s*["']?)([^"'\s,;&}]+)`)
+		}
+	})
+}
+
+func (c *RedactorServiceImpl) Redact(v interface{}) interface{} {
+	if c.Disabled || v == nil {
+		return v
+	}
+	c.init()
+	generic, err := toGeneric(v)
+	if err != nil {
+		return c.RedactString(utils.ToJson(v))
+	}
+	return c.redactValue("", generic)
+}
+
+func (c *RedactorServiceImpl) RedactString(s string) string {
+	if c.Disabled || len(s) == 0 {
+		return s
+	}
+	c.init()
+	s = authHeaderExpr.ReplaceAllString(s, "${1} "+c.Mask)
+	if c.keyValueExpr != nil {
+		s = c.keyValueExpr.ReplaceAllString(s, "${1}"+c.Mask)
+	}
+	for _, p := range c.Patterns {
+		s = p.ReplaceAllString(s, c.Mask)
+	}
+	if c.MaskCardNumbers {
+		s = cardNumberExpr.ReplaceAllStringFunc(s, maskCardNumber)
+	}
+	return s
+}
+
+func (c *RedactorServiceImpl) redactValue(path string, v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, child := range x {
+			childPath := joinKey(path, normalizeFieldName(k))
+			if c.isSecret(childPath, k) {
+				if child != nil && child != "" {
+					x[k] = c.Mask
+				}
+				continue
+			}
+			x[k] = c.redactValue(childPath, child)
+		}
+	case []interface{}:
+		for i, child := range x {
+			x[i] = c.redactValue(path, child)
+		}
+	case string:
+		return c.RedactString(x)
+	}
+	return v
+}
+
+func (c *RedactorServiceImpl) isSecret(path string, key string) bool {
+	if c.paths[path] {
+		return true
+	}
+	key = normalizeFieldName(key)
+	for _, name := range c.names {
+		if strings.HasSuffix(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Пишет в writer текст, пропущенный через редактор. Каждый Write - целая запись лога
+type redactingWriter struct {
+	writer   io.Writer
+	redactor IRedactorService
+}
+
+func (c *redactingWriter) Write(p []byte) (int, error) {
+	if _, err := c.writer.Write([]byte(c.redactor.RedactString(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func normalizeFieldName(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(strings.TrimSpace(name)))
+}
+
+func maskCardNumber(s string) string {
+	var digits []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] >= '0' && s[i] <= '9' {
+			digits = append(digits, s[i])
+		}
+	}
+	if !luhnValid(digits) {
+		return s
+	}
+	return strings.Repeat("*", len(digits)-4) + string(digits[len(digits)-4:])
+}
+
+func luhnValid(digits []byte) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
@@ -0,0 +1,150 @@
+package pipeline
+
+import (
+	"errors"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/goava/pkg/goava/utils"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"strings"
+	"testing"
+)
+
+const (
+	testPassword     = "s3cr3t-pass"
+	testSessionToken = "tok-1234567890"
+	testBasicAuth    = "Basic Ym9iOnMzY3IzdC1wYXNz"
+	testBearerAuth   = "Bearer eyJhbGciOiJIUzI1NiJ9.payload"
+)
+
+var testSecrets = []string{testPassword, testSessionToken, "Ym9iOnMzY3IzdC1wYXNz", "eyJhbGciOiJIUzI1NiJ9.payload"}
+
+func assertRedacted(t *testing.T, name string, s string) {
+	t.Helper()
+	for _, secret := range testSecrets {
+		if strings.Contains(s, secret) {
+			t.Errorf("%v: секрет %q не скрыт: %v", name, secret, s)
+		}
+	}
+	if !strings.Contains(s, DefaultRedactionMask) {
+		t.Errorf("%v: нет маски %v: %v", name, DefaultRedactionMask, s)
+	}
+}
+
+func TestRedactCallParams(t *testing.T) {
+	redactor := NewDefaultRedactor()
+	p := &entities.CallParams{
+		Parameters: map[string][]interface{}{
+			"username":     {"bob"},
+			"password":     {testPassword},
+			"sessionToken": {testSessionToken},
+		},
+		URL: "example.com/api/login?sessionToken=" + testSessionToken,
+		Raw: "password=" + testPassword + "&x=1",
+		Caller: &entities.Caller{
+			AuthArgs: &entities.AuthArgs{Username: "bob", Password: testPassword, SessionToken: testSessionToken},
+			Session: &entities.Session{Token: testSessionToken, Account: &entities.Account{
+				Username: "bob", Password: testPassword, SessionToken: testSessionToken,
+			}},
+		},
+	}
+
+	s := utils.ToJson(redactor.Redact(p))
+	assertRedacted(t, "CallParams", s)
+	if !strings.Contains(s, "bob") {
+		t.Errorf("CallParams: имя пользователя не должно скрываться: %v", s)
+	}
+	if p.Caller.AuthArgs.Password != testPassword || p.Parameters["password"][0] != testPassword {
+		t.Error("CallParams: Redact изменил исходное значение")
+	}
+}
+
+func TestRedactHeaders(t *testing.T) {
+	redactor := NewDefaultRedactor()
+	headers := map[string][]string{
+		"Authorization": {testBasicAuth},
+		"Sessiontoken":  {testSessionToken},
+		"Content-Type":  {"application/json"},
+	}
+	s := utils.ToJson(redactor.Redact(headers))
+	assertRedacted(t, "Headers", s)
+	if !strings.Contains(s, "application/json") {
+		t.Errorf("Headers: обычные заголовки не должны скрываться: %v", s)
+	}
+}
+
+func TestRedactResult(t *testing.T) {
+	redactor := NewDefaultRedactor()
+	result := &Result{
+		Res: map[string]interface{}{
+			"account": map[string]interface{}{"username": "bob", "password": testPassword},
+			"token":   testSessionToken,
+		},
+		Err: &Err{
+			Message: "Неверный пароль: password=" + testPassword,
+			Details: "Authorization: " + testBearerAuth,
+			Reason:  frmclient.ReasonValidation,
+		},
+	}
+	assertRedacted(t, "Result", utils.ToJson(redactor.Redact(result)))
+}
+
+func TestRedactString(t *testing.T) {
+	redactor := NewDefaultRedactor()
+	for name, s := range map[string]string{
+		"log":                  "log=[login bob password=" + testPassword + " sessionToken=" + testSessionToken + "]",
+		"json":                 `{"sessionToken":"` + testSessionToken + `","password":"` + testPassword + `"}`,
+		"basic":                "Authorization: " + testBasicAuth,
+		"bearer":               "отправлен заголовок " + testBearerAuth,
+		"error":                errors.New("login failed: password=" + testPassword).Error(),
+		"error with auth":      "call failed (Authorization=" + testBasicAuth + ")",
+		"query string":         "/api/stream?sessionToken=" + testSessionToken + "&x=1",
+		"header in error text": "header Sessiontoken: " + testSessionToken,
+	} {
+		assertRedacted(t, name, redactor.RedactString(s))
+	}
+}
+
+func TestRedactDisabled(t *testing.T) {
+	redactor := &RedactorServiceImpl{Fields: DefaultRedactedFields, Disabled: true}
+	s := "password=" + testPassword
+	if redactor.RedactString(s) != s {
+		t.Errorf("Disabled: строка изменена: %v", redactor.RedactString(s))
+	}
+}
+
+type testLoginAction struct {
+	BaseActionImpl
+}
+
+func (c *testLoginAction) GetName() string {
+	return "testLogin"
+}
+
+func (c *testLoginAction) Run(arg interface{}) (interface{}, error) {
+	return map[string]interface{}{"username": "bob", "sessionToken": testSessionToken}, nil
+}
+
+// Запись лога экшенов, которую раннер отдает в logger.Print, не содержит секретов аргумента и результата
+func TestRunnerLogIsRedacted(t *testing.T) {
+	runner, loggerService, _ := newTestRunner()
+	p := &entities.CallParams{
+		Parameters: map[string][]interface{}{"username": {"bob"}, "password": {testPassword}},
+		Headers:    map[string][]string{"Authorization": {testBasicAuth}},
+		URL:        "example.com/api/login?sessionToken=" + testSessionToken,
+		Caller:     &entities.Caller{AuthArgs: &entities.AuthArgs{Username: "bob", Password: testPassword}},
+		Bag:        entities.NewBag(),
+	}
+
+	result := runner.Run(&testLoginAction{}, func() (interface{}, error) { return p, nil }, nil)
+	if result.Err != nil {
+		t.Fatal(result.Err.Message)
+	}
+	s := loggerService.out.String()
+	if !strings.Contains(s, "testLogin") || !strings.Contains(s, "bob") {
+		t.Fatalf("запись экшена не попала в лог: %v", s)
+	}
+	assertRedacted(t, "лог экшена", s)
+	if result.Res.(map[string]interface{})["sessionToken"] != testSessionToken {
+		t.Error("скрытие секретов в логе изменило результат")
+	}
+}
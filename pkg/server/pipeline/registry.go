@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"sort"
+	"sync"
+)
+
+// Реестр экшенов по имени. Наполняется DI-контейнером, используется для сборки маршрутов из конфига
+type IActionRegistry interface {
+	Register(name string, action IAction)
+	Get(name string) (IAction, error)
+	Names() []string
+}
+
+type ActionRegistryImpl struct {
+	IActionRegistry
+
+	lock    sync.RWMutex
+	actions map[string]IAction
+}
+
+func (c *ActionRegistryImpl) Register(name string, action IAction) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.actions == nil {
+		c.actions = map[string]IAction{}
+	}
+	c.actions[name] = action
+}
+
+func (c *ActionRegistryImpl) Get(name string) (IAction, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	a, ok := c.actions[name]
+	if !ok {
+		return nil, errs.NewBaseError(fmt.Sprintf("Экшен %v не зарегистрирован", name))
+	}
+	return a, nil
+}
+
+func (c *ActionRegistryImpl) Names() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	var r []string
+	for name := range c.actions {
+		r = append(r, name)
+	}
+	sort.Strings(r)
+	return r
+}
+
+// Реестр презентеров по имени
+type IPresenterRegistry interface {
+	Register(name string, presenter IResponsePresenter)
+	Get(name string) (IResponsePresenter, error)
+}
+
+type PresenterRegistryImpl struct {
+	IPresenterRegistry
+
+	lock       sync.RWMutex
+	presenters map[string]IResponsePresenter
+}
+
+func (c *PresenterRegistryImpl) Register(name string, presenter IResponsePresenter) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.presenters == nil {
+		c.presenters = map[string]IResponsePresenter{}
+	}
+	c.presenters[name] = presenter
+}
+
+func (c *PresenterRegistryImpl) Get(name string) (IResponsePresenter, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	p, ok := c.presenters[name]
+	if !ok {
+		return nil, errs.NewBaseError(fmt.Sprintf("Презентер %v не зарегистрирован", name))
+	}
+	return p, nil
+}
@@ -21,6 +21,9 @@ type ResponsePresenterImpl struct {
 	IResponsePresenter
 
 	ResponseModelProvider IResponseModelProvider
+
+	// Источник http-статусов по причинам ошибок. Если не задан - реестр по умолчанию
+	ReasonRegistry IReasonRegistryService
 }
 
 type IResponseModelProvider interface {
@@ -36,6 +39,9 @@ type JSONResponsePresenterImpl struct {
 }
 
 func (c *JSONResponsePresenterImpl) Write(context echo.Context, result *Result, httpStatus int) error {
+	if notModified, err := c.WriteCacheHeaders(context, result); notModified || err != nil {
+		return err
+	}
 	//contentType := context.Request().Header.Get("Accept")
 	if httpStatus == 0 {
 		httpStatus = c.GetHttpResponseCode(result, httpStatus)
@@ -51,6 +57,8 @@ func (c *ResponseModelProviderImpl) ToModel(r *Result) interface{} {
 		switch ex := r.Err.Error.(type) {
 		case *validation.ValidationError:
 			return c.createValidationErrorModel(ex, r)
+		case *ValidationErrors:
+			return c.createValidationErrorsModel(ex, r)
 		}
 	}
 	return r
@@ -68,6 +76,35 @@ func (c *ResponseModelProviderImpl) createValidationErrorModel(e *validation.Val
 	}
 }
 
+// Первое нарушение выводится в полях error (совместимость с клиентами), все нарушения - в error.violations
+func (c *ResponseModelProviderImpl) createValidationErrorsModel(e *ValidationErrors, r *Result) interface{} {
+	m := &ValidationErrorModel{
+		Result: *r,
+		Error: &ValidationErrorErr{
+			Err: *r.Err,
+		},
+	}
+	for _, v := range e.Errors {
+		m.Error.Violations = append(m.Error.Violations, &ValidationErrorErr{
+			Err: Err{
+				Error:   v,
+				Reason:  frmclient.ReasonValidation,
+				Message: v.Message,
+			},
+			Param:        v.Param,
+			InvalidValue: v.InvalidValue,
+			Reason:       v.Reason,
+		})
+	}
+	if len(m.Error.Violations) > 0 {
+		first := m.Error.Violations[0]
+		m.Error.Param = first.Param
+		m.Error.InvalidValue = first.InvalidValue
+		m.Error.Reason = first.Reason
+	}
+	return m
+}
+
 type ValidationErrorModel struct {
 	Result
 	Error *ValidationErrorErr `json:"error,omitempty"`
@@ -78,6 +115,8 @@ type ValidationErrorErr struct {
 	Param        string      `json:"param,omitempty"`
 	InvalidValue interface{} `json:"invalidValue,omitempty"`
 	Reason       string      `json:"reason,omitempty"`
+
+	Violations []*ValidationErrorErr `json:"violations,omitempty"`
 }
 
 type FileResponsePresenterImpl struct {
@@ -121,21 +160,8 @@ func (c *ResponsePresenterImpl) GetHttpResponseCode(result *Result, httpStatus i
 		return http.StatusOK
 	}
 
-	switch result.Err.Reason {
-	case frmclient.ReasonTooManyRequests:
-		return http.StatusTooManyRequests
-	case frmclient.ReasonAccessDenied, frmclient.ReasonCallerUpdateRequired, frmclient.ReasonInactiveUser:
-		return http.StatusForbidden
-	case frmclient.ReasonAuthorizationRequired:
-		return http.StatusUnauthorized
-	case frmclient.ReasonServerRespondedWithError:
-		return http.StatusOK
-	case frmclient.ReasonValidation:
-		return http.StatusBadRequest
-	case frmclient.ReasonServerUnavailable:
-		return http.StatusServiceUnavailable
-	case frmclient.ReasonServerRespondedWithErrorNotFound:
-		return http.StatusNotFound
+	if info := reasonRegistryOrDefault(c.ReasonRegistry).Get(result.Err.Reason); info != nil && info.HttpStatus > 0 {
+		return info.HttpStatus
 	}
 	return http.StatusInternalServerError
 }
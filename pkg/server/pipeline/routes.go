@@ -0,0 +1,195 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/server/pkg/server"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"github.com/itskovichanton/server/pkg/server/security"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const MethodAny = "ANY"
+
+var routeMethods = []string{
+	http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodHead, http.MethodOptions,
+}
+
+// Регистрирует маршруты, объявленные в конфиге (server.routes). Ошибки конфигурации возвращаются до старта сервера
+func (c *HttpControllerImpl) initConfiguredRoutes() error {
+	for i, route := range c.Config.Server.Routes {
+		methods, action, presenter, err := c.buildRoute(route)
+		if err != nil {
+			return errs.NewBaseErrorFromCauseMsg(err, fmt.Sprintf("Некорректный маршрут server.routes[%v] %v: %v", i, route.Path, err.Error()))
+		}
+		if route.Async {
+			if c.JobQueue == nil {
+				return errs.NewBaseError(fmt.Sprintf("Маршрут server.routes[%v] %v: фоновые задачи не настроены либо отключены (server.jobs)", i, route.Path))
+			}
+			c.HandleAsync(methods, route.Path, action, presenter)
+		} else if route.Stream {
+			if len(methods) != 1 || methods[0] != http.MethodGet {
+				return errs.NewBaseError(fmt.Sprintf("Маршрут server.routes[%v] %v: потоковый маршрут поддерживает только GET", i, route.Path))
+			}
+			c.HandleStream(route.Path, action, presenter)
+		} else {
+			c.Handle(methods, route.Path, action, presenter)
+		}
+	}
+	return nil
+}
+
+func (c *HttpControllerImpl) buildRoute(route *server.Route) ([]string, IAction, IResponsePresenter, error) {
+
+	if len(route.Path) == 0 || !strings.HasPrefix(route.Path, "/") {
+		return nil, nil, nil, errs.NewBaseError("path должен начинаться с /")
+	}
+
+	methods, err := parseRouteMethods(route.Method)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if len(route.Actions) == 0 {
+		return nil, nil, nil, errs.NewBaseError("не указан ни один экшен")
+	}
+
+	var actions []IAction
+	if route.Throttle != nil {
+		if route.Throttle.Eps <= 0 || route.Throttle.Burst <= 0 {
+			return nil, nil, nil, errs.NewBaseError("throttle.eps и throttle.burst должны быть положительными")
+		}
+		actions = append(actions, &ThrottleAction{
+			Limiter: security.NewLimiter(route.Throttle.Eps, route.Throttle.Burst),
+		})
+	}
+	for _, name := range route.Actions {
+		a, err := c.ActionRegistry.Get(name)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		actions = append(actions, a)
+	}
+
+	var presenter IResponsePresenter
+	if len(route.Presenter) > 0 {
+		presenter, err = c.PresenterRegistry.Get(route.Presenter)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	mode, err := parseChainMode(route.Mode)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	action := &ChainedActionImpl{Actions: actions, Mode: mode, InvalidatesCacheTags: route.InvalidatesCacheTags}
+	if route.Cache != nil {
+		action.Cache, err = parseCachePolicy(route.Cache)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if len(route.Interceptors) > 0 || len(route.SkipInterceptors) > 0 {
+		if err := c.validateInterceptorNames(append(route.Interceptors, route.SkipInterceptors...)); err != nil {
+			return nil, nil, nil, err
+		}
+		action.Interceptors = &InterceptorFilter{Use: route.Interceptors, Skip: route.SkipInterceptors}
+	}
+
+	return methods, action, presenter, nil
+}
+
+func (c *HttpControllerImpl) validateInterceptorNames(names []string) error {
+	interceptors := c.ActionRunner.GetInterceptors()
+	for _, name := range names {
+		found := false
+		for _, interceptor := range interceptors {
+			if interceptor.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errs.NewBaseError(fmt.Sprintf("неизвестный интерсептор %v", name))
+		}
+	}
+	return nil
+}
+
+func parseCachePolicy(cache *server.RouteCache) (*CachePolicy, error) {
+	ttl, err := time.ParseDuration(cache.TTL)
+	if err != nil || ttl <= 0 {
+		return nil, errs.NewBaseError(fmt.Sprintf("некорректный cache.ttl %v", cache.TTL))
+	}
+	r := &CachePolicy{TTL: ttl, Params: cache.Params, Tags: cache.Tags}
+	switch {
+	case len(cache.Scope) == 0, strings.EqualFold(cache.Scope, string(CacheScopeAccount)):
+		r.Scope = CacheScopeAccount
+	case strings.EqualFold(cache.Scope, string(CacheScopeShared)):
+		r.Scope = CacheScopeShared
+	default:
+		return nil, errs.NewBaseError(fmt.Sprintf("неизвестный cache.scope %v, допустимы %v, %v", cache.Scope, CacheScopeAccount, CacheScopeShared))
+	}
+	return r, nil
+}
+
+func parseChainMode(mode string) (ChainMode, error) {
+	switch {
+	case len(mode) == 0, strings.EqualFold(mode, string(ChainModeReplace)):
+		return ChainModeReplace, nil
+	case strings.EqualFold(mode, string(ChainModePassThrough)):
+		return ChainModePassThrough, nil
+	}
+	return "", errs.NewBaseError(fmt.Sprintf("неизвестный режим цепочки %v, допустимы %v, %v", mode, ChainModeReplace, ChainModePassThrough))
+}
+
+func parseRouteMethods(method string) ([]string, error) {
+	if len(method) == 0 {
+		return []string{http.MethodGet}, nil
+	}
+	if strings.EqualFold(method, MethodAny) {
+		return routeMethods, nil
+	}
+	var r []string
+	for _, m := range strings.Split(method, ",") {
+		m = strings.ToUpper(strings.TrimSpace(m))
+		if !containsMethod(m) {
+			return nil, errs.NewBaseError(fmt.Sprintf("неизвестный http-метод %v", m))
+		}
+		r = append(r, m)
+	}
+	return r, nil
+}
+
+func containsMethod(m string) bool {
+	for _, x := range routeMethods {
+		if x == m {
+			return true
+		}
+	}
+	return false
+}
+
+// Ограничивает частоту вызовов по IP вызывающего
+type ThrottleAction struct {
+	BaseActionImpl
+
+	Limiter security.Limiter
+}
+
+func (c *ThrottleAction) GetName() string {
+	return "Throttle"
+}
+
+func (c *ThrottleAction) Run(arg interface{}) (interface{}, error) {
+	p := arg.(*entities.CallParams)
+	if !c.Limiter.Allow(p.Caller.IP) {
+		return nil, errs.NewBaseErrorWithReason("Слишком много запросов", frmclient.ReasonTooManyRequests)
+	}
+	return arg, nil
+}
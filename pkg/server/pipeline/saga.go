@@ -0,0 +1,416 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/itskovichanton/core/pkg/core"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/goava/pkg/goava/utils"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"log"
+	"strings"
+	"time"
+)
+
+// Экшен, действие которого можно отменить. Вызывается сагой для успешно выполненных шагов при сбое следующего шага
+type ICompensatingAction interface {
+	Compensate(arg interface{}, result interface{}) error
+}
+
+// Шаг, умеющий восстановить аргумент и результат из сохраненного состояния саги (при восстановлении после сбоя).
+// Без него в Compensate передаются значения, декодированные из JSON (map[string]interface{} и т.д.)
+type ISagaStateDecoder interface {
+	DecodeSagaState(arg json.RawMessage, result json.RawMessage) (interface{}, interface{}, error)
+}
+
+type SagaStatus string
+
+const (
+	SagaStatusRunning            SagaStatus = "running"
+	SagaStatusCompleted          SagaStatus = "completed"
+	SagaStatusCompensating       SagaStatus = "compensating"
+	SagaStatusCompensated        SagaStatus = "compensated"
+	SagaStatusCompensationFailed SagaStatus = "compensationFailed"
+)
+
+type SagaStepStatus string
+
+const (
+	SagaStepStatusCompleted          SagaStepStatus = "completed"
+	SagaStepStatusFailed             SagaStepStatus = "failed"
+	SagaStepStatusCompensated        SagaStepStatus = "compensated"
+	SagaStepStatusCompensationFailed SagaStepStatus = "compensationFailed"
+)
+
+type SagaState struct {
+	ID        string           `json:"id"`
+	Name      string           `json:"name"`
+	Status    SagaStatus       `json:"status"`
+	Steps     []*SagaStepState `json:"steps"`
+	Error     string           `json:"error,omitempty"`
+	StartedAt time.Time        `json:"startedAt"`
+	UpdatedAt time.Time        `json:"updatedAt"`
+}
+
+type SagaStepState struct {
+	Name   string          `json:"name"`
+	Status SagaStepStatus  `json:"status"`
+	Arg    json.RawMessage `json:"arg,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+
+	arg    interface{}
+	result interface{}
+}
+
+// Ошибка компенсации шага
+type CompensationFailure struct {
+	Step    string `json:"step"`
+	Message string `json:"message"`
+}
+
+// Ошибка саги: исходная ошибка шага и ошибки компенсаций. Причина - причина исходной ошибки
+type SagaError struct {
+	errs.BaseError
+
+	SagaID               string
+	FailedStep           string
+	CompensationFailures []*CompensationFailure
+}
+
+// Цепочка с компенсацией: при ошибке шага для уже выполненных шагов в обратном порядке вызывается Compensate.
+// Если задан StateStore, состояние сохраняется после каждого шага, и незавершенные саги можно откатить
+// после перезапуска через RecoverUnfinished. Имена шагов должны быть уникальны - по ним шаг находится при компенсации
+type SagaActionImpl struct {
+	ChainedActionImpl
+
+	StateStore ISagaStateStore
+
+	// Скрывает секреты в сохраняемых аргументах и результатах. Если не задан - используется NewDefaultRedactor()
+	Redactor IRedactorService
+
+	// Получает ошибки сохранения состояния. Если не задан - ошибки пишутся в стандартный лог
+	ErrorHandler core.IErrorHandler
+}
+
+// Паникует, если имена шагов повторяются
+func Saga(name string, actions ...IAction) *SagaActionImpl {
+	if err := checkUniqueStepNames(name, actions); err != nil {
+		panic(err)
+	}
+	return &SagaActionImpl{ChainedActionImpl: ChainedActionImpl{Name: name, Actions: actions}}
+}
+
+// Остальные шаги - тоже сага с теми же хранилищем и настройками: иначе интерсепторы и асинхронные маршруты,
+// выполняющие авторизацию отдельно, потеряли бы компенсацию и сохранение состояния
+func (c *SagaActionImpl) SplitAuth() (IAction, IAction) {
+	auth, rest := c.ChainedActionImpl.SplitAuth()
+	if auth == nil {
+		return nil, c
+	}
+	return auth, &SagaActionImpl{
+		ChainedActionImpl: *rest.(*ChainedActionImpl),
+		StateStore:        c.StateStore,
+		Redactor:          c.Redactor,
+		ErrorHandler:      c.ErrorHandler,
+	}
+}
+
+const bagKeySagaPrefix = "saga."
+
+func (c *SagaActionImpl) Run(arg interface{}) (interface{}, error) {
+
+	if err := checkUniqueStepNames(c.GetName(), c.Actions); err != nil {
+		return nil, err
+	}
+
+	bag := bagOf(arg)
+	if bag == nil {
+		bag = entities.NewBag()
+	}
+
+	state := &SagaState{
+		ID:        uuid.NewString(),
+		Name:      c.GetName(),
+		Status:    SagaStatusRunning,
+		StartedAt: time.Now(),
+	}
+	bag.Set(bagKeySagaPrefix+c.GetName(), state)
+
+	stepArg := arg
+	var lastResult interface{}
+	for i, step := range c.Actions {
+
+		startTime := utils.CurrentTimeMillis()
+		r, errObj := runStep(step, stepArg)
+		timing := &StepTiming{Name: step.GetName(), TimeMs: utils.CurrentTimeMillis() - startTime}
+
+		stepState := &SagaStepState{Name: step.GetName(), arg: stepArg, result: r}
+		state.Steps = append(state.Steps, stepState)
+
+		if errObj != nil {
+			timing.Reason = errObj.Reason
+			addStepTiming(bag, timing)
+			bag.Set(bagKeyChainFailedPrefix+c.GetName(), step)
+			stepState.Status = SagaStepStatusFailed
+			stepState.Error = errObj.Message
+			state.Error = errObj.Message
+			return nil, c.compensate(state, step, errObj.Error)
+		}
+		addStepTiming(bag, timing)
+
+		stepState.Status = SagaStepStatusCompleted
+		c.save(state)
+
+		c.setStepResult(bag, i, step, r)
+		lastResult = r
+		if _, passThrough := step.(*PassThroughActionImpl); !passThrough && c.Mode != ChainModePassThrough {
+			stepArg = r
+		}
+	}
+
+	state.Status = SagaStatusCompleted
+	c.finish(state)
+	return lastResult, nil
+}
+
+// Компенсирует выполненные шаги в обратном порядке
+func (c *SagaActionImpl) compensate(state *SagaState, failedStep IAction, cause error) error {
+
+	state.Status = SagaStatusCompensating
+	c.save(state)
+
+	failures := c.compensateSteps(state)
+	if len(failures) > 0 {
+		state.Status = SagaStatusCompensationFailed
+	} else {
+		state.Status = SagaStatusCompensated
+	}
+	c.finish(state)
+
+	reason := frmclient.ReasonInternal
+	if be := errs.FindBaseError(cause); be != nil {
+		reason = be.Reason
+	}
+	r := &SagaError{
+		BaseError:            *errs.NewBaseErrorFromCauseMsgReason(cause, cause.Error(), reason),
+		SagaID:               state.ID,
+		FailedStep:           failedStep.GetName(),
+		CompensationFailures: failures,
+	}
+	return r
+}
+
+func (c *SagaActionImpl) compensateSteps(state *SagaState) []*CompensationFailure {
+	var failures []*CompensationFailure
+	for i := len(state.Steps) - 1; i >= 0; i-- {
+		stepState := state.Steps[i]
+		if stepState.Status != SagaStepStatusCompleted && stepState.Status != SagaStepStatusCompensationFailed {
+			continue
+		}
+		step := c.findStep(stepState.Name)
+		compensating, ok := step.(ICompensatingAction)
+		if !ok {
+			continue
+		}
+		if err := c.compensateStep(step, compensating, stepState); err != nil {
+			stepState.Status = SagaStepStatusCompensationFailed
+			stepState.Error = err.Error()
+			failures = append(failures, &CompensationFailure{Step: stepState.Name, Message: err.Error()})
+		} else {
+			stepState.Status = SagaStepStatusCompensated
+			stepState.Error = ""
+		}
+		c.save(state)
+	}
+	return failures
+}
+
+func (c *SagaActionImpl) compensateStep(step IAction, compensating ICompensatingAction, stepState *SagaStepState) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = NewPanicError(step.GetName()+".Compensate", p)
+		}
+	}()
+	arg, result := stepState.arg, stepState.result
+	if arg == nil && result == nil {
+		arg, result, err = c.decodeStepState(step, stepState)
+		if err != nil {
+			return err
+		}
+	}
+	return compensating.Compensate(arg, result)
+}
+
+// Значения шага, восстановленные после перезапуска
+func (c *SagaActionImpl) decodeStepState(step IAction, stepState *SagaStepState) (interface{}, interface{}, error) {
+	if decoder, ok := step.(ISagaStateDecoder); ok {
+		return decoder.DecodeSagaState(stepState.Arg, stepState.Result)
+	}
+	var arg, result interface{}
+	if len(stepState.Arg) > 0 {
+		if err := json.Unmarshal(stepState.Arg, &arg); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(stepState.Result) > 0 {
+		if err := json.Unmarshal(stepState.Result, &result); err != nil {
+			return nil, nil, err
+		}
+	}
+	return arg, result, nil
+}
+
+func (c *SagaActionImpl) findStep(name string) IAction {
+	for _, a := range c.Actions {
+		if a.GetName() == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// Откатывает саги этого экшена, не завершенные до перезапуска. Прерванная сага только компенсируется,
+// до конца она не доводится. Http-контроллер вызывает его при старте через RecoverSagas для саг из маршрутов,
+// методов JSON-RPC и реестра экшенов. Возвращает ошибку, если какие-то компенсации не удались
+func (c *SagaActionImpl) RecoverUnfinished() error {
+	if c.StateStore == nil {
+		return nil
+	}
+	if err := checkUniqueStepNames(c.GetName(), c.Actions); err != nil {
+		return err
+	}
+	states, err := c.StateStore.ListUnfinished(c.GetName())
+	if err != nil {
+		return err
+	}
+	var failed []string
+	for _, state := range states {
+		state.Status = SagaStatusCompensating
+		if failures := c.compensateSteps(state); len(failures) > 0 {
+			state.Status = SagaStatusCompensationFailed
+			failed = append(failed, state.ID)
+		} else {
+			state.Status = SagaStatusCompensated
+		}
+		c.finish(state)
+	}
+	if len(failed) > 0 {
+		return errs.NewBaseError(fmt.Sprintf("Не удалось откатить саги %v: %v", c.GetName(), strings.Join(failed, ", ")))
+	}
+	return nil
+}
+
+// Откатывает незавершенные саги среди экшенов и их шагов. Каждая сага (по имени) восстанавливается один раз
+func RecoverSagas(actions []IAction) error {
+	recovered := map[string]bool{}
+	var failed []string
+	var visit func(action IAction)
+	visit = func(action IAction) {
+		if action == nil {
+			return
+		}
+		if saga, ok := action.(*SagaActionImpl); ok && saga.StateStore != nil && !recovered[saga.GetName()] {
+			recovered[saga.GetName()] = true
+			if err := saga.RecoverUnfinished(); err != nil {
+				failed = append(failed, err.Error())
+			}
+		}
+		if composite, ok := action.(ICompositeAction); ok {
+			for _, step := range composite.GetSteps() {
+				visit(step)
+			}
+		}
+	}
+	for _, action := range actions {
+		visit(action)
+	}
+	if len(failed) > 0 {
+		return errs.NewBaseError(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (c *SagaActionImpl) save(state *SagaState) {
+	if c.StateStore == nil {
+		return
+	}
+	state.UpdatedAt = time.Now()
+	redactor := c.Redactor
+	if redactor == nil {
+		redactor = defaultRedactor
+	}
+	for _, s := range state.Steps {
+		var err error
+		if s.Arg == nil && s.arg != nil {
+			if s.Arg, err = json.Marshal(redactor.Redact(s.arg)); err != nil {
+				c.handleStoreError(state, "сохранить аргумент шага "+s.Name, err)
+			}
+		}
+		if s.Result == nil && s.result != nil {
+			if s.Result, err = json.Marshal(redactor.Redact(s.result)); err != nil {
+				c.handleStoreError(state, "сохранить результат шага "+s.Name, err)
+			}
+		}
+	}
+	if err := c.StateStore.Save(state); err != nil {
+		c.handleStoreError(state, "сохранить состояние", err)
+	}
+}
+
+// Без сохраненного состояния сагу не удастся откатить после перезапуска, поэтому ошибка не должна теряться
+func (c *SagaActionImpl) handleStoreError(state *SagaState, operation string, err error) {
+	message := fmt.Sprintf("Сага %v (%v): не удалось %v: %v", state.Name, state.ID, operation, err.Error())
+	if c.ErrorHandler == nil {
+		log.Println(message)
+		return
+	}
+	c.ErrorHandler.HandleWithCustomParams(err, func(alertParams *core.AlertParams) {
+		alertParams.Subject += "-SAGA-STATE"
+		alertParams.Message = message
+	})
+}
+
+// Успешно завершенные и откаченные саги удаляются, саги с неудавшейся компенсацией остаются для разбора
+func (c *SagaActionImpl) finish(state *SagaState) {
+	if c.StateStore == nil {
+		return
+	}
+	if state.Status == SagaStatusCompensationFailed {
+		c.save(state)
+		return
+	}
+	if err := c.StateStore.Delete(state.ID); err != nil {
+		c.handleStoreError(state, "удалить состояние", err)
+	}
+}
+
+func (c *SagaActionImpl) GetLogFields(arg interface{}) map[string]interface{} {
+	r := c.ChainedActionImpl.GetLogFields(arg)
+	bag := bagOf(arg)
+	if bag == nil {
+		return r
+	}
+	v, ok := bag.Get(bagKeySagaPrefix + c.GetName())
+	if !ok {
+		return r
+	}
+	state := v.(*SagaState)
+	if r == nil {
+		r = map[string]interface{}{}
+	}
+	saga := map[string]interface{}{"id": state.ID, "status": state.Status}
+	var failures []*CompensationFailure
+	for _, s := range state.Steps {
+		if s.Status == SagaStepStatusCompensationFailed {
+			failures = append(failures, &CompensationFailure{Step: s.Name, Message: s.Error})
+		}
+	}
+	if len(failures) > 0 {
+		saga["compensationFailures"] = failures
+	}
+	r["saga"] = saga
+	return r
+}
@@ -0,0 +1,68 @@
+package pipeline
+
+import "sync"
+
+// Хранилище состояний саг. Нужно, чтобы откатить саги, прерванные падением процесса
+type ISagaStateStore interface {
+	Save(state *SagaState) error
+	Load(id string) (*SagaState, error)
+	ListUnfinished(name string) ([]*SagaState, error)
+	Delete(id string) error
+}
+
+// Хранит каждую сагу в отдельном JSON-файле в Dir. Файлы доступны только владельцу процесса
+type FileSagaStateStoreImpl struct {
+	ISagaStateStore
+
+	Dir string
+
+	lock sync.Mutex
+}
+
+func (c *FileSagaStateStoreImpl) Save(state *SagaState) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return saveJsonFile(c.Dir, state.ID, state)
+}
+
+func (c *FileSagaStateStoreImpl) Load(id string) (*SagaState, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.load(jsonFileName(c.Dir, id))
+}
+
+func (c *FileSagaStateStoreImpl) load(fileName string) (*SagaState, error) {
+	r := &SagaState{}
+	if err := loadJsonFile(fileName, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Саги с именем name, не дошедшие до завершения или откаченные не полностью
+func (c *FileSagaStateStoreImpl) ListUnfinished(name string) ([]*SagaState, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	files, err := listJsonFiles(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var r []*SagaState
+	for _, f := range files {
+		state, err := c.load(f)
+		if err != nil {
+			return nil, err
+		}
+		if state.Name != name || state.Status == SagaStatusCompleted || state.Status == SagaStatusCompensated {
+			continue
+		}
+		r = append(r, state)
+	}
+	return r, nil
+}
+
+func (c *FileSagaStateStoreImpl) Delete(id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return deleteJsonFile(c.Dir, id)
+}
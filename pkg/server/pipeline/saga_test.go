@@ -0,0 +1,161 @@
+package pipeline
+
+import (
+	"errors"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type testSagaStep struct {
+	BaseActionImpl
+
+	name        string
+	fail        bool
+	compensated *[]string
+}
+
+func (c *testSagaStep) GetName() string {
+	return c.name
+}
+
+func (c *testSagaStep) Run(arg interface{}) (interface{}, error) {
+	if c.fail {
+		return nil, errors.New(c.name + " failed")
+	}
+	return arg, nil
+}
+
+func (c *testSagaStep) Compensate(arg interface{}, result interface{}) error {
+	*c.compensated = append(*c.compensated, c.name)
+	return nil
+}
+
+type testCallerValidator struct{}
+
+func (c *testCallerValidator) Check(a *entities.CallParams, name string) error {
+	return nil
+}
+
+type testSagaStateStore struct {
+	ISagaStateStore
+
+	lock   sync.Mutex
+	states map[string]*SagaState
+	saves  int
+}
+
+func newTestSagaStateStore() *testSagaStateStore {
+	return &testSagaStateStore{states: map[string]*SagaState{}}
+}
+
+func (c *testSagaStateStore) Save(state *SagaState) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.saves++
+	c.states[state.ID] = state
+	return nil
+}
+
+func (c *testSagaStateStore) ListUnfinished(name string) ([]*SagaState, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var r []*SagaState
+	for _, state := range c.states {
+		if state.Name == name && state.Status != SagaStatusCompleted && state.Status != SagaStatusCompensated {
+			r = append(r, state)
+		}
+	}
+	return r, nil
+}
+
+func (c *testSagaStateStore) Delete(id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.states, id)
+	return nil
+}
+
+func newTestSaga(compensated *[]string, failAt string) *SagaActionImpl {
+	var steps []IAction
+	for _, name := range []string{"a", "b", "c", "d"} {
+		steps = append(steps, &testSagaStep{name: name, fail: name == failAt, compensated: compensated})
+	}
+	return Saga("test", steps...)
+}
+
+func TestSagaCompensationOrder(t *testing.T) {
+	var compensated []string
+	saga := newTestSaga(&compensated, "d")
+	saga.StateStore = newTestSagaStateStore()
+
+	_, err := saga.Run(&entities.CallParams{Bag: entities.NewBag()})
+	var sagaErr *SagaError
+	if !errors.As(err, &sagaErr) || sagaErr.FailedStep != "d" {
+		t.Fatalf("ожидалась SagaError шага d, получено %v", err)
+	}
+	if !reflect.DeepEqual(compensated, []string{"c", "b", "a"}) {
+		t.Errorf("шаги компенсированы в порядке %v, ожидался c, b, a", compensated)
+	}
+}
+
+func TestSagaSplitAuthKeepsCompensation(t *testing.T) {
+	var compensated []string
+	store := newTestSagaStateStore()
+	saga := Saga("test",
+		&ValidateCallerAction{CallerValidatorService: &testCallerValidator{}},
+		&testSagaStep{name: "a", compensated: &compensated},
+		&testSagaStep{name: "b", fail: true, compensated: &compensated},
+	)
+	saga.StateStore = store
+
+	auth, rest := saga.SplitAuth()
+	if auth == nil {
+		t.Fatal("шаг авторизации не отделен")
+	}
+	restSaga, ok := rest.(*SagaActionImpl)
+	if !ok {
+		t.Fatalf("остальные шаги - %T, ожидалась сага", rest)
+	}
+	if restSaga.GetName() != saga.GetName() || restSaga.StateStore != saga.StateStore || len(restSaga.Actions) != 2 {
+		t.Errorf("сага остальных шагов потеряла настройки: %v, %v шагов", restSaga.GetName(), len(restSaga.Actions))
+	}
+
+	call := &ActionCall{Action: saga, Arg: &entities.CallParams{Bag: entities.NewBag()}}
+	if err := authenticateCall(call); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := call.Action.Run(call.Arg); err == nil {
+		t.Fatal("ожидалась ошибка шага b")
+	}
+	if !reflect.DeepEqual(compensated, []string{"a"}) {
+		t.Errorf("компенсированы %v, ожидался a", compensated)
+	}
+	if store.saves == 0 {
+		t.Error("состояние саги не сохранялось")
+	}
+}
+
+func TestRecoverSagas(t *testing.T) {
+	var compensated []string
+	store := newTestSagaStateStore()
+	saga := newTestSaga(&compensated, "")
+	saga.StateStore = store
+	store.states["1"] = &SagaState{ID: "1", Name: "test", Status: SagaStatusRunning, Steps: []*SagaStepState{
+		{Name: "a", Status: SagaStepStatusCompleted, Arg: []byte(`{}`)},
+		{Name: "b", Status: SagaStepStatusCompleted, Arg: []byte(`{}`)},
+	}}
+
+	// Сага встречается дважды: в маршруте и внутри другой цепочки, но восстанавливается один раз
+	actions := []IAction{saga, &ChainedActionImpl{Name: "outer", Actions: []IAction{saga}}}
+	if err := RecoverSagas(actions); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(compensated, []string{"b", "a"}) {
+		t.Errorf("компенсированы %v, ожидались b, a", compensated)
+	}
+	if len(store.states) != 0 {
+		t.Errorf("откаченная сага осталась в хранилище: %v", store.states)
+	}
+}
@@ -0,0 +1,497 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/server/pkg/server"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"github.com/robfig/cron/v3"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const MetricScheduledRuns = "scheduled_runs_total"
+
+type OverlapPolicy string
+
+const (
+	// Запуск пропускается, если предыдущий еще выполняется (по умолчанию)
+	OverlapSkip OverlapPolicy = "skip"
+
+	// Запуски выполняются параллельно
+	OverlapAllow OverlapPolicy = "allow"
+
+	// Запуск ждет завершения предыдущего
+	OverlapQueue OverlapPolicy = "queue"
+)
+
+// Экшен, выполняемый по расписанию
+type ScheduledTask struct {
+	Name string
+
+	// Cron-выражение из 5 полей либо @every 1h, @daily и т.д.
+	Schedule string
+
+	// Часовой пояс расписания. Если не задан - часовой пояс планировщика
+	Timezone string
+
+	Action IAction
+
+	// Параметры вызова экшена
+	Params map[string][]interface{}
+
+	// Случайная задержка запуска от 0 до Jitter, чтобы экземпляры не стартовали одновременно
+	Jitter  time.Duration
+	Overlap OverlapPolicy
+	Paused  bool
+}
+
+// Состояние задачи по расписанию для админки
+type ScheduledTaskInfo struct {
+	Name           string        `json:"name"`
+	Schedule       string        `json:"schedule"`
+	Timezone       string        `json:"timezone,omitempty"`
+	Action         string        `json:"action"`
+	Overlap        OverlapPolicy `json:"overlap"`
+	Paused         bool          `json:"paused"`
+	Running        int           `json:"running"`
+	Runs           int64         `json:"runs"`
+	NextRunAt      *time.Time    `json:"nextRunAt,omitempty"`
+	LastRunAt      *time.Time    `json:"lastRunAt,omitempty"`
+	LastDurationMs int64         `json:"lastDurationMs"`
+	LastError      *Err          `json:"lastError,omitempty"`
+}
+
+type ISchedulerService interface {
+	Schedule(task *ScheduledTask) error
+	List() []*ScheduledTaskInfo
+	Pause(name string) error
+	Resume(name string) error
+
+	// Запускает задачу вне расписания (в том числе приостановленную), не дожидаясь выполнения
+	Trigger(name string) error
+
+	Start(runner IActionRunner) error
+	Stop()
+}
+
+// Планировщик экшенов на robfig/cron. Экшены выполняются через раннер (лог, алерты, интерсепторы).
+// Если задан LockFile, по расписанию задачи выполняет только один экземпляр приложения - владелец файла блокировки
+type SchedulerServiceImpl struct {
+	ISchedulerService
+
+	Location       *time.Location
+	LockFile       string
+	MetricsService IMetricsService
+
+	lock   sync.Mutex
+	tasks  map[string]*scheduledTaskState
+	cron   *cron.Cron
+	runner IActionRunner
+	leader *FileLock
+}
+
+type scheduledTaskState struct {
+	task      *ScheduledTask
+	entryID   cron.EntryID
+	runLock   sync.Mutex
+	running   int
+	runs      int64
+	lastRunAt time.Time
+	lastMs    int64
+	lastError *Err
+}
+
+func (c *SchedulerServiceImpl) Schedule(task *ScheduledTask) error {
+
+	if len(task.Name) == 0 || task.Action == nil {
+		return errs.NewBaseError("У задачи по расписанию должны быть имя и экшен")
+	}
+	if len(task.Timezone) > 0 {
+		if _, err := time.LoadLocation(task.Timezone); err != nil {
+			return errs.NewBaseErrorFromCauseMsg(err, fmt.Sprintf("Неизвестный часовой пояс %v задачи %v", task.Timezone, task.Name))
+		}
+	}
+	if _, err := cron.ParseStandard(task.getSpec()); err != nil {
+		return errs.NewBaseErrorFromCauseMsg(err, fmt.Sprintf("Неверное расписание %v задачи %v", task.Schedule, task.Name))
+	}
+	switch task.Overlap {
+	case "":
+		task.Overlap = OverlapSkip
+	case OverlapSkip, OverlapAllow, OverlapQueue:
+	default:
+		return errs.NewBaseError(fmt.Sprintf("Неизвестная политика перекрытия %v задачи %v, допустимы %v, %v, %v", task.Overlap, task.Name, OverlapSkip, OverlapAllow, OverlapQueue))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.init()
+	if _, exists := c.tasks[task.Name]; exists {
+		return errs.NewBaseError(fmt.Sprintf("Задача по расписанию %v уже зарегистрирована", task.Name))
+	}
+	state := &scheduledTaskState{task: task}
+	c.tasks[task.Name] = state
+	if c.runner != nil {
+		return c.addEntry(state)
+	}
+	return nil
+}
+
+// Собирает задачу из конфига: экшены берутся из реестра и выполняются цепочкой
+func NewScheduledTask(cfg *server.ScheduledTask, actionRegistry IActionRegistry) (*ScheduledTask, error) {
+
+	if len(cfg.Actions) == 0 {
+		return nil, errs.NewBaseError(fmt.Sprintf("У задачи по расписанию %v не указан ни один экшен", cfg.Name))
+	}
+	var actions []IAction
+	for _, name := range cfg.Actions {
+		a, err := actionRegistry.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, a)
+	}
+
+	r := &ScheduledTask{
+		Name:     cfg.Name,
+		Schedule: cfg.Schedule,
+		Timezone: cfg.Timezone,
+		Action:   &ChainedActionImpl{Name: cfg.Name, Actions: actions},
+		Params:   map[string][]interface{}{},
+		Overlap:  OverlapPolicy(strings.ToLower(cfg.Overlap)),
+		Paused:   cfg.Paused,
+	}
+	for _, param := range cfg.Params {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			return nil, errs.NewBaseError(fmt.Sprintf("Параметр %v задачи %v должен быть в виде имя=значение", param, cfg.Name))
+		}
+		r.Params[name] = append(r.Params[name], value)
+	}
+	if len(cfg.Jitter) > 0 {
+		jitter, err := time.ParseDuration(cfg.Jitter)
+		if err != nil {
+			return nil, errs.NewBaseErrorFromCauseMsg(err, fmt.Sprintf("Неверный jitter %v задачи %v", cfg.Jitter, cfg.Name))
+		}
+		r.Jitter = jitter
+	}
+	return r, nil
+}
+
+func (c *ScheduledTask) getSpec() string {
+	if len(c.Timezone) > 0 {
+		return "CRON_TZ=" + c.Timezone + " " + c.Schedule
+	}
+	return c.Schedule
+}
+
+func (c *SchedulerServiceImpl) init() {
+	if c.tasks == nil {
+		c.tasks = map[string]*scheduledTaskState{}
+		location := c.Location
+		if location == nil {
+			location = time.Local
+		}
+		c.cron = cron.New(cron.WithLocation(location))
+	}
+}
+
+func (c *SchedulerServiceImpl) addEntry(state *scheduledTaskState) error {
+	id, err := c.cron.AddFunc(state.task.getSpec(), func() {
+		c.onSchedule(state)
+	})
+	state.entryID = id
+	return err
+}
+
+func (c *SchedulerServiceImpl) Start(runner IActionRunner) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.runner != nil {
+		return nil
+	}
+	c.init()
+	c.runner = runner
+	if len(c.LockFile) > 0 {
+		c.leader = &FileLock{Path: c.LockFile, Owner: uuid.NewString()}
+		// Владелец обновляет файл, остальные экземпляры перехватывают его, если владелец пропал
+		if _, err := c.cron.AddFunc(fmt.Sprintf("@every %v", fileLockHeartbeat), func() {
+			c.leader.TryAcquire()
+		}); err != nil {
+			return err
+		}
+		c.leader.TryAcquire()
+	}
+	for _, state := range c.tasks {
+		if err := c.addEntry(state); err != nil {
+			return err
+		}
+	}
+	c.cron.Start()
+	return nil
+}
+
+func (c *SchedulerServiceImpl) Stop() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.cron != nil {
+		c.cron.Stop()
+	}
+	if c.leader != nil {
+		c.leader.Release()
+	}
+}
+
+func (c *SchedulerServiceImpl) onSchedule(state *scheduledTaskState) {
+	c.lock.Lock()
+	paused := state.task.Paused
+	c.lock.Unlock()
+	if paused {
+		return
+	}
+	if c.leader != nil && !c.leader.TryAcquire() {
+		return
+	}
+	if state.task.Jitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(state.task.Jitter))))
+	}
+	c.run(state)
+}
+
+func (c *SchedulerServiceImpl) run(state *scheduledTaskState) {
+
+	task := state.task
+	switch task.Overlap {
+	case OverlapSkip:
+		if !state.runLock.TryLock() {
+			c.incMetric(task, "skipped")
+			return
+		}
+		defer state.runLock.Unlock()
+	case OverlapQueue:
+		state.runLock.Lock()
+		defer state.runLock.Unlock()
+	}
+
+	c.lock.Lock()
+	state.running++
+	c.lock.Unlock()
+
+	result := c.runner.Run(task.Action, func() (interface{}, error) {
+		params := map[string][]interface{}{}
+		for k, v := range task.Params {
+			params[k] = v
+		}
+		return &entities.CallParams{
+			Parameters: params,
+			URL:        "scheduler://" + task.Name,
+			Caller:     &entities.Caller{Type: "scheduler"},
+			Bag:        entities.NewBag(),
+		}, nil
+	}, nil)
+
+	c.lock.Lock()
+	state.running--
+	state.runs++
+	state.lastRunAt = time.Now()
+	state.lastMs = result.ExecutionTimeMs
+	state.lastError = result.Err
+	c.lock.Unlock()
+
+	if result.Err != nil {
+		c.incMetric(task, "error")
+	} else {
+		c.incMetric(task, "ok")
+	}
+}
+
+func (c *SchedulerServiceImpl) incMetric(task *ScheduledTask, status string) {
+	if c.MetricsService != nil {
+		c.MetricsService.Inc(MetricScheduledRuns, map[string]string{"task": task.Name, "status": status})
+	}
+}
+
+func (c *SchedulerServiceImpl) List() []*ScheduledTaskInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var r []*ScheduledTaskInfo
+	for _, state := range c.tasks {
+		task := state.task
+		info := &ScheduledTaskInfo{
+			Name:           task.Name,
+			Schedule:       task.Schedule,
+			Timezone:       task.Timezone,
+			Action:         task.Action.GetName(),
+			Overlap:        task.Overlap,
+			Paused:         task.Paused,
+			Running:        state.running,
+			Runs:           state.runs,
+			LastDurationMs: state.lastMs,
+			LastError:      state.lastError,
+		}
+		if !state.lastRunAt.IsZero() {
+			lastRunAt := state.lastRunAt
+			info.LastRunAt = &lastRunAt
+		}
+		if c.cron != nil && state.entryID != 0 && !task.Paused {
+			if next := c.cron.Entry(state.entryID).Next; !next.IsZero() {
+				info.NextRunAt = &next
+			}
+		}
+		r = append(r, info)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Name < r[j].Name
+	})
+	return r
+}
+
+func (c *SchedulerServiceImpl) Pause(name string) error {
+	return c.setPaused(name, true)
+}
+
+func (c *SchedulerServiceImpl) Resume(name string) error {
+	return c.setPaused(name, false)
+}
+
+func (c *SchedulerServiceImpl) setPaused(name string, paused bool) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	state, err := c.getState(name)
+	if err != nil {
+		return err
+	}
+	state.task.Paused = paused
+	return nil
+}
+
+func (c *SchedulerServiceImpl) Trigger(name string) error {
+	c.lock.Lock()
+	state, err := c.getState(name)
+	started := c.runner != nil
+	c.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	if !started {
+		return errs.NewBaseError("Планировщик не запущен")
+	}
+	go c.run(state)
+	return nil
+}
+
+func (c *SchedulerServiceImpl) getState(name string) (*scheduledTaskState, error) {
+	state, ok := c.tasks[name]
+	if !ok {
+		return nil, errs.NewBaseErrorWithReason(fmt.Sprintf("Задача по расписанию %v не найдена", name), frmclient.ReasonServerRespondedWithErrorNotFound)
+	}
+	return state, nil
+}
+
+const (
+	fileLockHeartbeat = 30 * time.Second
+	fileLockStale     = 3 * fileLockHeartbeat
+)
+
+// Блокировка одного экземпляра через файл с идентификатором владельца.
+// Владелец обновляет время изменения файла; файл, не обновлявшийся дольше fileLockStale, считается брошенным
+type FileLock struct {
+	Path  string
+	Owner string
+
+	lock sync.Mutex
+}
+
+// Захватывает либо продлевает блокировку. Возвращает true, если владелец - текущий экземпляр
+func (c *FileLock) TryAcquire() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	data, err := os.ReadFile(c.Path)
+	if err == nil {
+		if strings.TrimSpace(string(data)) == c.Owner {
+			now := time.Now()
+			os.Chtimes(c.Path, now, now)
+			return true
+		}
+		info, err := os.Stat(c.Path)
+		if err != nil || time.Since(info.ModTime()) < fileLockStale {
+			return false
+		}
+		os.Remove(c.Path)
+	} else if !os.IsNotExist(err) {
+		return false
+	}
+
+	f, err := os.OpenFile(c.Path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.WriteString(c.Owner)
+	return err == nil
+}
+
+func (c *FileLock) Release() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if data, err := os.ReadFile(c.Path); err == nil && strings.TrimSpace(string(data)) == c.Owner {
+		os.Remove(c.Path)
+	}
+}
+
+const (
+	SchedulerCommandList    = "list"
+	SchedulerCommandPause   = "pause"
+	SchedulerCommandResume  = "resume"
+	SchedulerCommandTrigger = "trigger"
+)
+
+// Админка планировщика: список задач, приостановка, возобновление и внеплановый запуск
+type SchedulerAdminAction struct {
+	BaseActionImpl
+
+	Scheduler ISchedulerService
+	Command   string
+}
+
+func (c *SchedulerAdminAction) GetName() string {
+	return "Scheduler." + c.Command
+}
+
+func (c *SchedulerAdminAction) Run(arg interface{}) (interface{}, error) {
+	if c.Command == SchedulerCommandList {
+		return c.Scheduler.List(), nil
+	}
+	p := arg.(*entities.CallParams)
+	name := p.GetParamStr("path__name")
+	if len(name) == 0 {
+		name = p.GetParamStr("name")
+	}
+	var err error
+	switch c.Command {
+	case SchedulerCommandPause:
+		err = c.Scheduler.Pause(name)
+	case SchedulerCommandResume:
+		err = c.Scheduler.Resume(name)
+	case SchedulerCommandTrigger:
+		err = c.Scheduler.Trigger(name)
+	default:
+		err = errs.NewBaseError(fmt.Sprintf("Неизвестная команда планировщика %v", c.Command))
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range c.Scheduler.List() {
+		if info.Name == name {
+			return info, nil
+		}
+	}
+	return nil, nil
+}
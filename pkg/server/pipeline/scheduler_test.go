@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestScheduleValidation(t *testing.T) {
+	scheduler := &SchedulerServiceImpl{}
+	for _, task := range []*ScheduledTask{
+		{Name: "a", Schedule: "* * *", Action: &testPaymentAction{}},
+		{Name: "b", Schedule: "@daily", Timezone: "Mars/Olympus", Action: &testPaymentAction{}},
+		{Name: "c", Schedule: "@daily", Overlap: "sometimes", Action: &testPaymentAction{}},
+		{Name: "d", Schedule: "@daily"},
+	} {
+		if err := scheduler.Schedule(task); err == nil {
+			t.Errorf("%v: задача с ошибкой принята", task.Name)
+		}
+	}
+}
+
+// При OverlapSkip запуск, совпавший с выполняющимся, пропускается
+func TestSchedulerOverlapSkip(t *testing.T) {
+	runner, _, _ := newTestRunner()
+	action := &testPaymentAction{started: make(chan struct{}), release: make(chan struct{})}
+	scheduler := &SchedulerServiceImpl{}
+	if err := scheduler.Schedule(&ScheduledTask{Name: "report", Schedule: "@daily", Action: action}); err != nil {
+		t.Fatal(err)
+	}
+	if err := scheduler.Start(runner); err != nil {
+		t.Fatal(err)
+	}
+	defer scheduler.Stop()
+
+	if err := scheduler.Trigger("report"); err != nil {
+		t.Fatal(err)
+	}
+	<-action.started
+	scheduler.run(scheduler.tasks["report"])
+	if calls := atomic.LoadInt32(&action.calls); calls != 1 {
+		t.Errorf("экшен запущен %v раз, ожидался 1", calls)
+	}
+	close(action.release)
+}
+
+func TestFileLockSingleOwner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scheduler.lock")
+	first := &FileLock{Path: path, Owner: "first"}
+	second := &FileLock{Path: path, Owner: "second"}
+
+	if !first.TryAcquire() || !first.TryAcquire() {
+		t.Fatal("владелец не получил блокировку")
+	}
+	if second.TryAcquire() {
+		t.Fatal("блокировку получили оба экземпляра")
+	}
+	first.Release()
+	if !second.TryAcquire() {
+		t.Error("освобожденная блокировка не досталась второму экземпляру")
+	}
+}
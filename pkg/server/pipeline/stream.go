@@ -0,0 +1,356 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core/frmclient"
+	"github.com/itskovichanton/echo-http"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/server/pkg/server"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"golang.org/x/net/websocket"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HeaderLastEventID = "Last-Event-ID"
+
+	// Для WebSocket и клиентов, не умеющих выставлять заголовки
+	ParamLastEventID = "lastEventId"
+
+	// EventSource и браузерный WebSocket не умеют выставлять заголовки, поэтому токен сессии можно передать параметром
+	ParamSessionToken = "sessionToken"
+
+	StreamEventHeartbeat = "heartbeat"
+
+	defaultStreamBuffer       = 16
+	defaultStreamHeartbeat    = 15 * time.Second
+	defaultStreamRetry        = 3 * time.Second
+	defaultStreamWriteTimeout = 10 * time.Second
+)
+
+// Событие потока. ID нужен клиенту для переподключения с Last-Event-ID.
+// Err превращается в Result.Err так же, как ошибка обычного экшена
+type StreamEvent struct {
+	ID   string
+	Name string
+	Res  interface{}
+	Err  error
+}
+
+// Результат стримингового экшена. Экшен отправляет события через Send и вызывает Close, когда поток закончился.
+// Буфер ограничен: если клиент не успевает читать, Send блокируется
+type Stream struct {
+	events    chan *StreamEvent
+	done      chan struct{}
+	closeOnce sync.Once
+	doneOnce  sync.Once
+}
+
+func NewStream(buffer int) *Stream {
+	if buffer <= 0 {
+		buffer = defaultStreamBuffer
+	}
+	return &Stream{
+		events: make(chan *StreamEvent, buffer),
+		done:   make(chan struct{}),
+	}
+}
+
+// Возвращает false, если клиент отключился - дальше отправлять не нужно
+func (c *Stream) Send(event *StreamEvent) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.events <- event:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *Stream) Close() {
+	c.closeOnce.Do(func() {
+		close(c.events)
+	})
+}
+
+// Закрывается при отключении клиента
+func (c *Stream) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Stream) cancel() {
+	c.doneOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// Id последнего полученного клиентом события при переподключении
+func StreamLastEventID(p *entities.CallParams) string {
+	if id := p.GetHeader(HeaderLastEventID); len(id) > 0 {
+		return id
+	}
+	return p.GetParamStr(ParamLastEventID)
+}
+
+// Регистрирует стриминговый маршрут. Экшен возвращает *Stream, события отдаются как Server-Sent Events,
+// а при запросе с Upgrade: websocket - как текстовые кадры WebSocket. Каждое событие - тот же Result, что и у обычных маршрутов.
+// Если экшен завершился ошибкой, она отдается презентером как обычный ответ.
+// Буфера для повторной отправки событий нет: при переподключении экшен сам продолжает поток
+// после события StreamLastEventID, иначе пропущенные клиентом события теряются
+func (c *HttpControllerImpl) HandleStream(path string, action IAction, presenter IResponsePresenter) {
+	c.routes = append(c.routes, &RouteInfo{
+		Methods:   []string{http.MethodGet},
+		Path:      path,
+		Action:    action,
+		Presenter: presenter,
+	})
+	c.EchoEngine.GET(path, c.getStreamHandler(action, presenter))
+}
+
+func (c *HttpControllerImpl) getStreamHandler(action IAction, presenter IResponsePresenter) func(context echo.Context) error {
+	return func(context echo.Context) error {
+
+		var p *entities.CallParams
+		result := c.ActionRunner.Run(action, func() (interface{}, error) {
+			var err error
+			p, err = c.readStreamCallParams(context)
+			return p, err
+		}, nil)
+
+		stream, ok := result.Res.(*Stream)
+		if result.Err == nil && !ok {
+			result.Res = nil
+			result.Err = c.provideStreamError(errs.NewBaseError(fmt.Sprintf("Экшен %v не вернул поток", action.GetName())), p)
+		}
+		if result.Err != nil {
+			if presenter == nil {
+				presenter = c.DefaultResponsePresenter
+			}
+			return presenter.Write(context, result, 0)
+		}
+
+		defer stream.cancel()
+		if strings.EqualFold(context.Request().Header.Get("Upgrade"), "websocket") {
+			return c.serveWebSocket(context, stream, p)
+		}
+		return c.serveSSE(context, stream, p)
+	}
+}
+
+func (c *HttpControllerImpl) readStreamCallParams(context echo.Context) (*entities.CallParams, error) {
+	p, err := c.EntityFromHTTPReaderService.ReadCallParams(context)
+	if err == nil && p.Caller != nil && p.Caller.Session == nil {
+		if token := context.QueryParam(ParamSessionToken); len(token) > 0 {
+			p.Caller.Session = &entities.Session{Token: token}
+		}
+	}
+	return p, err
+}
+
+func (c *HttpControllerImpl) serveSSE(context echo.Context, stream *Stream, p *entities.CallParams) error {
+
+	settings := c.getStreamSettings()
+	response := context.Response()
+	header := response.Header()
+	header.Set(echo.HeaderContentType, "text/event-stream; charset=UTF-8")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+	header.Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+	if _, err := fmt.Fprintf(response, "retry: %v\n\n", settings.retry.Milliseconds()); err != nil {
+		return nil
+	}
+	response.Flush()
+
+	heartbeat := time.NewTicker(settings.heartbeat)
+	defer heartbeat.Stop()
+	started := time.Now()
+	for {
+		var err error
+		select {
+		case <-context.Request().Context().Done():
+			return nil
+		case <-heartbeat.C:
+			_, err = fmt.Fprint(response, ": "+StreamEventHeartbeat+"\n\n")
+		case event, ok := <-stream.events:
+			if !ok {
+				return nil
+			}
+			err = c.writeSSEEvent(response, event, c.toStreamModel(event, p, started))
+		}
+		if err != nil {
+			return nil
+		}
+		response.Flush()
+	}
+}
+
+func (c *HttpControllerImpl) writeSSEEvent(response *echo.Response, event *StreamEvent, model interface{}) error {
+	data, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	if len(event.ID) > 0 {
+		b.WriteString("id: " + sseLine(event.ID) + "\n")
+	}
+	if len(event.Name) > 0 {
+		b.WriteString("event: " + sseLine(event.Name) + "\n")
+	}
+	b.WriteString("data: ")
+	b.Write(data)
+	b.WriteString("\n\n")
+	_, err = response.Write([]byte(b.String()))
+	return err
+}
+
+func sseLine(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
+
+// Кадр WebSocket: событие потока в том же Result
+type streamFrame struct {
+	ID    string      `json:"id,omitempty"`
+	Event string      `json:"event,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+func (c *HttpControllerImpl) serveWebSocket(context echo.Context, stream *Stream, p *entities.CallParams) error {
+
+	settings := c.getStreamSettings()
+	wsServer := websocket.Server{
+		Handshake: checkWebSocketOrigin(settings.allowedOrigins),
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			// Входящие кадры не нужны, читаем их только чтобы узнать об отключении клиента
+			go func() {
+				var msg string
+				for websocket.Message.Receive(ws, &msg) == nil {
+				}
+				stream.cancel()
+			}()
+
+			heartbeat := time.NewTicker(settings.heartbeat)
+			defer heartbeat.Stop()
+			started := time.Now()
+			for {
+				var frame *streamFrame
+				select {
+				case <-stream.done:
+					return
+				case <-heartbeat.C:
+					frame = &streamFrame{Event: StreamEventHeartbeat}
+				case event, ok := <-stream.events:
+					if !ok {
+						return
+					}
+					frame = &streamFrame{ID: event.ID, Event: event.Name, Data: c.toStreamModel(event, p, started)}
+				}
+				ws.SetWriteDeadline(time.Now().Add(settings.writeTimeout))
+				if websocket.JSON.Send(ws, frame) != nil {
+					return
+				}
+			}
+		},
+	}
+	wsServer.ServeHTTP(context.Response(), context.Request())
+	return nil
+}
+
+func (c *HttpControllerImpl) toStreamModel(event *StreamEvent, p *entities.CallParams, started time.Time) interface{} {
+	result := &Result{Res: event.Res, ExecutionTimeMs: time.Since(started).Milliseconds()}
+	if event.Err != nil {
+		result.Res = nil
+		result.Err = c.provideStreamError(event.Err, p)
+	}
+	return (&ResponseModelProviderImpl{}).ToModel(result)
+}
+
+func (c *HttpControllerImpl) provideStreamError(err error, p *entities.CallParams) *Err {
+	errorProviderService := c.ErrorProviderService
+	if errorProviderService == nil {
+		errorProviderService = &ErrorProviderServiceImpl{Config: c.Config.CoreConfig}
+	}
+	var arg interface{}
+	if p != nil {
+		arg = p
+	}
+	return provideError(errorProviderService, err, arg)
+}
+
+type streamSettings struct {
+	heartbeat      time.Duration
+	retry          time.Duration
+	writeTimeout   time.Duration
+	allowedOrigins []string
+}
+
+func (c *HttpControllerImpl) getStreamSettings() *streamSettings {
+	if c.streamSettings == nil {
+		return &streamSettings{
+			heartbeat:    defaultStreamHeartbeat,
+			retry:        defaultStreamRetry,
+			writeTimeout: defaultStreamWriteTimeout,
+		}
+	}
+	return c.streamSettings
+}
+
+func parseStreamSettings(cfg *server.Streaming) (*streamSettings, error) {
+	r := &streamSettings{
+		heartbeat:    defaultStreamHeartbeat,
+		retry:        defaultStreamRetry,
+		writeTimeout: defaultStreamWriteTimeout,
+	}
+	if cfg == nil {
+		return r, nil
+	}
+	r.allowedOrigins = cfg.AllowedOrigins
+	for _, d := range []struct {
+		name   string
+		value  string
+		target *time.Duration
+	}{{"heartbeat", cfg.Heartbeat, &r.heartbeat}, {"retry", cfg.Retry, &r.retry}, {"writeTimeout", cfg.WriteTimeout, &r.writeTimeout}} {
+		if len(d.value) == 0 {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v <= 0 {
+			return nil, errs.NewBaseError(fmt.Sprintf("Некорректный server.streaming.%v %v", d.name, d.value))
+		}
+		*d.target = v
+	}
+	return r, nil
+}
+
+// Проверка Origin при открытии WebSocket. Соединения без Origin (не из браузера) допускаются.
+// Если allowed не задан - только с хоста самого сервера, "*" - с любого
+func checkWebSocketOrigin(allowed []string) func(config *websocket.Config, request *http.Request) error {
+	return func(config *websocket.Config, request *http.Request) error {
+		origin := request.Header.Get("Origin")
+		if len(origin) == 0 {
+			return nil
+		}
+		if len(allowed) == 0 {
+			if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, request.Host) {
+				return nil
+			}
+		}
+		for _, a := range allowed {
+			if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+				return nil
+			}
+		}
+		return errs.NewBaseErrorWithReason(fmt.Sprintf("Подключение с %v запрещено", origin), frmclient.ReasonAccessDenied)
+	}
+}
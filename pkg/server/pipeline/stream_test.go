@@ -0,0 +1,30 @@
+package pipeline
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCheckWebSocketOrigin(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		allowed []string
+		origin  string
+		ok      bool
+	}{
+		{name: "без Origin", ok: true},
+		{name: "тот же хост", origin: "https://api.example.com", ok: true},
+		{name: "чужой хост", origin: "https://evil.example.com"},
+		{name: "из списка", allowed: []string{"https://app.example.com/"}, origin: "https://app.example.com", ok: true},
+		{name: "не из списка", allowed: []string{"https://app.example.com"}, origin: "https://api.example.com"},
+		{name: "любой", allowed: []string{"*"}, origin: "https://evil.example.com", ok: true},
+	} {
+		request, _ := http.NewRequest(http.MethodGet, "https://api.example.com/api/pubsub", nil)
+		if len(c.origin) > 0 {
+			request.Header.Set("Origin", c.origin)
+		}
+		if err := checkWebSocketOrigin(c.allowed)(nil, request); (err == nil) != c.ok {
+			t.Errorf("%v: получено %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,4 @@
+window.onload = function () {
+  var root = document.getElementById("swagger-ui");
+  window.ui = SwaggerUIBundle({url: root.getAttribute("data-url"), dom_id: "#swagger-ui"});
+};
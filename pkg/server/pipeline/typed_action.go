@@ -0,0 +1,173 @@
+package pipeline
+
+import (
+	"fmt"
+	"github.com/itskovichanton/core/pkg/core"
+	"github.com/itskovichanton/goava/pkg/goava/errs"
+	"github.com/itskovichanton/server/pkg/server/entities"
+	"reflect"
+	"strings"
+)
+
+// Типизированный экшен. Приводится к IAction через Adapt
+type Action[In, Out any] interface {
+	Run(in In) (Out, error)
+	GetName() string
+}
+
+type actionFunc[In, Out any] struct {
+	name string
+	f    func(in In) (Out, error)
+}
+
+func (c *actionFunc[In, Out]) Run(in In) (Out, error) {
+	return c.f(in)
+}
+
+func (c *actionFunc[In, Out]) GetName() string {
+	return c.name
+}
+
+func NewAction[In, Out any](name string, f func(in In) (Out, error)) Action[In, Out] {
+	return &actionFunc[In, Out]{name: name, f: f}
+}
+
+type chainedAction[A, B, C any] struct {
+	first  Action[A, B]
+	second Action[B, C]
+}
+
+func (c *chainedAction[A, B, C]) Run(in A) (C, error) {
+	b, err := c.first.Run(in)
+	if err != nil {
+		var zero C
+		return zero, err
+	}
+	return c.second.Run(b)
+}
+
+func (c *chainedAction[A, B, C]) GetName() string {
+	return c.first.GetName() + "-" + c.second.GetName()
+}
+
+// Цепочка first -> second. Совместимость типов проверяется при компиляции
+func Then[A, B, C any](first Action[A, B], second Action[B, C]) Action[A, C] {
+	return &chainedAction[A, B, C]{first: first, second: second}
+}
+
+// Then для трех экшенов
+func Then3[A, B, C, D any](first Action[A, B], second Action[B, C], third Action[C, D]) Action[A, D] {
+	return Then(Then(first, second), third)
+}
+
+// Адаптер типизированного экшена к IAction.
+// Если аргумент - *entities.CallParams, а In - указатель на структуру, то аргумент заполняется через BindCallParams
+type TypedActionImpl[In, Out any] struct {
+	BaseActionImpl
+
+	Action Action[In, Out]
+}
+
+// Паникует, если теги входной структуры заданы с ошибкой
+func Adapt[In, Out any](action Action[In, Out]) *TypedActionImpl[In, Out] {
+	var in In
+	if err := CheckBindingTags(reflect.TypeOf(&in).Elem()); err != nil {
+		panic(err)
+	}
+	return &TypedActionImpl[In, Out]{Action: action}
+}
+
+func (c *TypedActionImpl[In, Out]) GetName() string {
+	return c.Action.GetName()
+}
+
+func (c *TypedActionImpl[In, Out]) Run(arg interface{}) (interface{}, error) {
+	in, err := c.toInput(arg)
+	if err != nil {
+		return nil, err
+	}
+	return c.Action.Run(in)
+}
+
+func (c *TypedActionImpl[In, Out]) PrepareErrorAlert(alertParams *core.AlertParams, err *Err, arg interface{}) {
+	if a, ok := c.Action.(interface {
+		PrepareErrorAlert(alertParams *core.AlertParams, err *Err, arg interface{})
+	}); ok {
+		a.PrepareErrorAlert(alertParams, err, arg)
+	}
+}
+
+// Документация берется у экшена, либо строится по тегам param/path/header входной структуры
+func (c *TypedActionImpl[In, Out]) GetApiDoc() *ApiDoc {
+	if a, ok := c.Action.(IDocumentedAction); ok {
+		return a.GetApiDoc()
+	}
+
+	var in In
+	var out Out
+	r := &ApiDoc{Result: out}
+	t := reflect.TypeOf(&in).Elem()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return r
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		in, key := ApiParamInQuery, f.Tag.Get("param")
+		if len(key) == 0 {
+			in, key = ApiParamInPath, f.Tag.Get("path")
+		}
+		if len(key) == 0 {
+			in, key = ApiParamInHeader, f.Tag.Get("header")
+		}
+		if len(key) == 0 || key == "-" {
+			continue
+		}
+		r.Params = append(r.Params, &ApiParam{
+			Name:     key,
+			In:       in,
+			Type:     apiParamType(f.Type),
+			Required: strings.Contains(f.Tag.Get("check"), "notempty") || strings.Contains(f.Tag.Get("validate"), "required"),
+		})
+	}
+	return r
+}
+
+func apiParamType(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int64, reflect.Uint64:
+		return "int64"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	return "string"
+}
+
+func (c *TypedActionImpl[In, Out]) toInput(arg interface{}) (In, error) {
+
+	var in In
+	if r, ok := arg.(In); ok {
+		return r, nil
+	}
+
+	p, ok := arg.(*entities.CallParams)
+	inType := reflect.TypeOf(&in).Elem()
+	if ok && inType.Kind() == reflect.Ptr && inType.Elem().Kind() == reflect.Struct {
+		v := reflect.New(inType.Elem())
+		if err := BindCallParams(p, v.Interface()); err != nil {
+			return in, err
+		}
+		return v.Interface().(In), nil
+	}
+
+	return in, errs.NewBaseError(fmt.Sprintf("%v: аргумент типа %T не приводится к %v", c.GetName(), arg, inType))
+}
@@ -61,7 +61,7 @@ func (c *AuthServiceImpl) Login(a *entities.AuthArgs) (*entities.Session, error)
 		return c.SessionStorageService.AssignSession(user), nil
 	}
 
-	return nil, errs.NewBaseErrorWithReason(fmt.Sprintf("Неверный пароль", a.Username), ReasonAuthorizationFailedInvalidPassword)
+	return nil, errs.NewBaseErrorWithReason("Неверный пароль", ReasonAuthorizationFailedInvalidPassword)
 }
 
 func (c *AuthServiceImpl) Register(a *entities.Account) (*entities.Session, error) {